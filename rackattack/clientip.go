@@ -1,6 +1,7 @@
 package rackattack
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
@@ -8,11 +9,27 @@ import (
 
 // ClientIPFunc derives the client IP address from a request. Implementations
 // must return the IP as a plain string (no port). Returning an empty string
-// signals that the IP could not be determined; callers treat such requests as
-// un-safelisted and un-blocklisted but still subject to throttling under the
-// empty key.
+// signals that the IP could not be determined; such requests, like those
+// whose result is not an IP at all, are resolved to UnknownClientIP.
 type ClientIPFunc func(req *http.Request) string
 
+// UnknownClientIP is the client IP of a request whose IP cannot be
+// determined, such as one with an empty RemoteAddr. Such requests are never
+// safelisted or blocklisted by IP, but are still throttled, together, under
+// keys such as "api:unknown", so they are visibly distinct from real clients.
+const UnknownClientIP = "unknown"
+
+// knownClientIP wraps fn so that its result is a normalized IP, or
+// UnknownClientIP when it is empty or not an IP.
+func knownClientIP(fn ClientIPFunc) ClientIPFunc {
+	return func(req *http.Request) string {
+		if ip := normalizeIP(fn(req)); ip != "" {
+			return ip
+		}
+		return UnknownClientIP
+	}
+}
+
 // directClientIP returns the IP of the immediate peer (req.RemoteAddr),
 // ignoring any forwarding headers. This is the safe default: forwarding
 // headers are attacker-controlled unless the request demonstrably arrived
@@ -21,23 +38,51 @@ func directClientIP(req *http.Request) string {
 	return remoteAddrIP(req.RemoteAddr)
 }
 
-// remoteAddrIP extracts the host portion of an address that may or may not
+// remoteAddrIP extracts the normalized IP of an address that may or may not
 // carry a port. It tolerates bare IPs (no port), which can occur with
-// synthetic requests and some non-TCP listeners.
+// synthetic requests and some non-TCP listeners, and bracketed or zoned IPv6
+// forms such as "[fe80::1%eth0]:443".
 func remoteAddrIP(remoteAddr string) string {
 	if remoteAddr == "" {
 		return ""
 	}
+	if ip := normalizeIP(remoteAddr); ip != "" {
+		return ip
+	}
 	host, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
-		// No port present (or malformed). Treat the whole value as the host
-		// when it parses as an IP, otherwise give up.
-		if net.ParseIP(remoteAddr) != nil {
-			return remoteAddr
-		}
 		return ""
 	}
-	return host
+	return normalizeIP(host)
+}
+
+// normalizeIP returns the canonical string form of an IP literal, so that
+// equivalent spellings ("2001:DB8::0:1", "[2001:db8::1]", "::ffff:1.2.3.4")
+// compare equal. Surrounding brackets and an IPv6 zone ("%eth0") are
+// stripped. It returns "" when s is not an IP.
+func normalizeIP(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// parseListIP normalizes an IP given to a safelist or blocklist method so it
+// compares equal to the resolved client IP, rejecting input that is not an IP.
+func parseListIP(s string) (string, error) {
+	ip := normalizeIP(s)
+	if ip == "" {
+		return "", fmt.Errorf("rackattack: invalid IP address %q", s)
+	}
+	return ip, nil
 }
 
 // trustedProxyClientIP builds a ClientIPFunc that trusts X-Forwarded-For only
@@ -67,17 +112,18 @@ func trustedProxyClientIP(trusted []*net.IPNet) ClientIPFunc {
 			if candidate == "" {
 				continue
 			}
-			ip := net.ParseIP(candidate)
-			if ip == nil {
+			// Some proxies append the port or bracket IPv6 entries.
+			ip := remoteAddrIP(candidate)
+			if ip == "" {
 				// Garbage entry in the chain; the upstream is suspect, stop
-				// trusting further-left hops and return what we have.
+				// trusting further-left hops. It resolves to UnknownClientIP.
 				return candidate
 			}
-			if ipInNets(candidate, trusted) {
+			if ipInNets(ip, trusted) {
 				// This hop is one of our proxies; keep walking left.
 				continue
 			}
-			return candidate
+			return ip
 		}
 
 		// Every hop in the chain was a trusted proxy (unusual); fall back to
@@ -86,6 +132,30 @@ func trustedProxyClientIP(trusted []*net.IPNet) ClientIPFunc {
 	}
 }
 
+// proxyHopsClientIP builds a ClientIPFunc for a fixed chain of hops trusted
+// proxies: it skips that many right-most X-Forwarded-For entries, which those
+// proxies added, and returns the next one. A chain too short to hold a client
+// entry, or an unparseable one, falls back to the peer.
+func proxyHopsClientIP(hops int) ClientIPFunc {
+	return func(req *http.Request) string {
+		peer := remoteAddrIP(req.RemoteAddr)
+		var chain []string
+		for _, part := range strings.Split(req.Header.Get("X-Forwarded-For"), ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				chain = append(chain, part)
+			}
+		}
+		i := len(chain) - 1 - hops
+		if i < 0 {
+			return peer
+		}
+		if ip := remoteAddrIP(chain[i]); ip != "" {
+			return ip
+		}
+		return peer
+	}
+}
+
 // ipInNets reports whether the given IP string falls within any of the
 // provided networks.
 func ipInNets(ip string, nets []*net.IPNet) bool {
@@ -0,0 +1,27 @@
+package rackattack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteAddrIP(t *testing.T) {
+	cases := map[string]string{
+		"1.2.3.4:80":              "1.2.3.4",
+		"1.2.3.4":                 "1.2.3.4",
+		"[2001:db8::1]:443":       "2001:db8::1",
+		"[2001:DB8:0::1]:443":     "2001:db8::1",
+		"[2001:db8::1]":           "2001:db8::1",
+		"2001:db8::1":             "2001:db8::1",
+		"[fe80::1%eth0]:8080":     "fe80::1",
+		"fe80::1%eth0":            "fe80::1",
+		"[::ffff:192.0.2.1]:1234": "192.0.2.1",
+		"":                        "",
+		"garbage":                 "",
+		"host.example:80":         "",
+	}
+	for in, want := range cases {
+		assert.Equal(t, want, remoteAddrIP(in), in)
+	}
+}
@@ -0,0 +1,428 @@
+package rackattack
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config is a declarative description of the safelist, blocklist, and rules,
+// for loading from a file with LoadConfig. It only covers what can be
+// expressed as data: function-valued settings such as CountIf, Trigger, or
+// SafelistIf predicates must still be set in code.
+//
+// The field tags suit encoding/json and the common YAML libraries; durations
+// are written as Go duration strings such as "1m" or "1h30m".
+type Config struct {
+	// Safelist and Blocklist hold IPs and CIDR ranges.
+	Safelist  []string         `json:"safelist" yaml:"safelist"`
+	Blocklist []string         `json:"blocklist" yaml:"blocklist"`
+	Throttle  []ThrottleConfig `json:"throttle" yaml:"throttle"`
+	Fail2Ban  []Fail2BanConfig `json:"fail2ban" yaml:"fail2ban"`
+}
+
+// ThrottleConfig is the data form of a ThrottleRule.
+type ThrottleConfig struct {
+	Name                 string         `json:"name" yaml:"name"`
+	PathPattern          string         `json:"path_pattern" yaml:"path_pattern"`
+	PathRegex            string         `json:"path_regex" yaml:"path_regex"`
+	CaseInsensitivePath  bool           `json:"case_insensitive_path" yaml:"case_insensitive_path"`
+	IgnoreTrailingSlash  bool           `json:"ignore_trailing_slash" yaml:"ignore_trailing_slash"`
+	Method               string         `json:"method" yaml:"method"`
+	HostPattern          string         `json:"host_pattern" yaml:"host_pattern"`
+	CountryPattern       string         `json:"country_pattern" yaml:"country_pattern"`
+	Key                  string         `json:"key" yaml:"key"`
+	KeyScope             KeyScope       `json:"key_scope" yaml:"key_scope"`
+	Limit                int            `json:"limit" yaml:"limit"`
+	MethodLimits         map[string]int `json:"method_limits" yaml:"method_limits"`
+	Period               Duration       `json:"period" yaml:"period"`
+	Interval             Duration       `json:"interval" yaml:"interval"`
+	Algorithm            Algorithm      `json:"algorithm" yaml:"algorithm"`
+	Burst                int            `json:"burst" yaml:"burst"`
+	DistinctKey          string         `json:"distinct_key" yaml:"distinct_key"`
+	ExpiryJitter         Duration       `json:"expiry_jitter" yaml:"expiry_jitter"`
+	Cost                 int            `json:"cost" yaml:"cost"`
+	ByteLimit            bool           `json:"byte_limit" yaml:"byte_limit"`
+	DefaultContentLength int            `json:"default_content_length" yaml:"default_content_length"`
+	SampleRate           float64        `json:"sample_rate" yaml:"sample_rate"`
+	DryRun               bool           `json:"dry_run" yaml:"dry_run"`
+	Priority             int            `json:"priority" yaml:"priority"`
+	StopOnMatch          bool           `json:"stop_on_match" yaml:"stop_on_match"`
+	Disabled             bool           `json:"disabled" yaml:"disabled"`
+	FailClosed           bool           `json:"fail_closed" yaml:"fail_closed"`
+	SharedKey            bool           `json:"shared_key" yaml:"shared_key"`
+	Ban                  BanConfig      `json:"ban" yaml:"ban"`
+}
+
+// BanConfig is the data form of a BanPolicy.
+type BanConfig struct {
+	MaxRetry   int      `json:"max_retry" yaml:"max_retry"`
+	FindTime   Duration `json:"find_time" yaml:"find_time"`
+	BanTime    Duration `json:"ban_time" yaml:"ban_time"`
+	Backoff    float64  `json:"backoff" yaml:"backoff"`
+	MaxBanTime Duration `json:"max_ban_time" yaml:"max_ban_time"`
+}
+
+// Fail2BanConfig is the data form of a Fail2BanRule. Without a Trigger, every
+// matching request is an offense, which suits honeypot paths.
+type Fail2BanConfig struct {
+	Name        string   `json:"name" yaml:"name"`
+	PathPattern string   `json:"path_pattern" yaml:"path_pattern"`
+	Method      string   `json:"method" yaml:"method"`
+	MaxRetry    int      `json:"max_retry" yaml:"max_retry"`
+	FindTime    Duration `json:"find_time" yaml:"find_time"`
+	BanTime     Duration `json:"ban_time" yaml:"ban_time"`
+}
+
+// Duration is a time.Duration that unmarshals from a Go duration string.
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// String returns the algorithm's config name: "sliding_window",
+// "fixed_window", "token_bucket", "leaky_bucket", or "distinct".
+func (a Algorithm) String() string {
+	switch a {
+	case SlidingWindow:
+		return "sliding_window"
+	case FixedWindow:
+		return "fixed_window"
+	case TokenBucket:
+		return "token_bucket"
+	case LeakyBucket:
+		return "leaky_bucket"
+	case Distinct:
+		return "distinct"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (a Algorithm) MarshalText() ([]byte, error) {
+	if a.String() == "unknown" {
+		return nil, errUnknownAlgorithm
+	}
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the names
+// String returns. An empty string is SlidingWindow.
+func (a *Algorithm) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "sliding_window":
+		*a = SlidingWindow
+	case "fixed_window":
+		*a = FixedWindow
+	case "token_bucket":
+		*a = TokenBucket
+	case "leaky_bucket":
+		*a = LeakyBucket
+	case "distinct":
+		*a = Distinct
+	default:
+		return fmt.Errorf("rackattack: unknown throttle algorithm %q", text)
+	}
+	return nil
+}
+
+// String returns the key scope's config name: "key", "ip", "ip_path",
+// "ip_path_method", or "global".
+func (s KeyScope) String() string {
+	switch s {
+	case ScopeKey:
+		return "key"
+	case ScopeIP:
+		return "ip"
+	case ScopeIPPath:
+		return "ip_path"
+	case ScopeIPPathMethod:
+		return "ip_path_method"
+	case ScopeGlobal:
+		return "global"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s KeyScope) MarshalText() ([]byte, error) {
+	if s.String() == "unknown" {
+		return nil, errors.New("rackattack: unknown key scope")
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the names
+// String returns. An empty string is ScopeKey.
+func (s *KeyScope) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "key":
+		*s = ScopeKey
+	case "ip":
+		*s = ScopeIP
+	case "ip_path":
+		*s = ScopeIPPath
+	case "ip_path_method":
+		*s = ScopeIPPathMethod
+	case "global":
+		*s = ScopeGlobal
+	default:
+		return fmt.Errorf("rackattack: unknown key scope %q", text)
+	}
+	return nil
+}
+
+// rule converts c to a ThrottleRule.
+func (c ThrottleConfig) rule() (ThrottleRule, error) {
+	r := ThrottleRule{
+		Name:                 c.Name,
+		PathPattern:          c.PathPattern,
+		CaseInsensitivePath:  c.CaseInsensitivePath,
+		IgnoreTrailingSlash:  c.IgnoreTrailingSlash,
+		Method:               c.Method,
+		HostPattern:          c.HostPattern,
+		CountryPattern:       c.CountryPattern,
+		Key:                  c.Key,
+		KeyScope:             c.KeyScope,
+		Limit:                c.Limit,
+		MethodLimits:         c.MethodLimits,
+		Period:               time.Duration(c.Period),
+		Interval:             time.Duration(c.Interval),
+		Algorithm:            c.Algorithm,
+		Burst:                c.Burst,
+		DistinctKey:          c.DistinctKey,
+		ExpiryJitter:         time.Duration(c.ExpiryJitter),
+		Cost:                 c.Cost,
+		ByteLimit:            c.ByteLimit,
+		DefaultContentLength: c.DefaultContentLength,
+		SampleRate:           c.SampleRate,
+		DryRun:               c.DryRun,
+		Priority:             c.Priority,
+		StopOnMatch:          c.StopOnMatch,
+		Disabled:             c.Disabled,
+		FailClosed:           c.FailClosed,
+		SharedKey:            c.SharedKey,
+		Ban: BanPolicy{
+			MaxRetry:   c.Ban.MaxRetry,
+			FindTime:   time.Duration(c.Ban.FindTime),
+			BanTime:    time.Duration(c.Ban.BanTime),
+			Backoff:    c.Ban.Backoff,
+			MaxBanTime: time.Duration(c.Ban.MaxBanTime),
+		},
+	}
+	if c.PathRegex != "" {
+		re, err := regexp.Compile(c.PathRegex)
+		if err != nil {
+			return ThrottleRule{}, err
+		}
+		r.PathRegex = re
+	}
+	return r, nil
+}
+
+// rule converts c to a Fail2BanRule.
+func (c Fail2BanConfig) rule() (Fail2BanRule, error) {
+	r := Fail2BanRule{
+		Name:        c.Name,
+		PathPattern: c.PathPattern,
+		Method:      c.Method,
+		MaxRetry:    c.MaxRetry,
+		FindTime:    time.Duration(c.FindTime),
+		BanTime:     time.Duration(c.BanTime),
+	}
+	switch {
+	case r.Name == "":
+		return r, errors.New("name must not be empty")
+	case r.MaxRetry <= 0:
+		return r, errors.New("max_retry must be positive")
+	case r.FindTime <= 0 || r.BanTime <= 0:
+		return r, errors.New("find_time and ban_time must be positive")
+	case checkPathPattern(r.PathPattern) != nil:
+		return r, checkPathPattern(r.PathPattern)
+	}
+	return r, nil
+}
+
+// LoadConfig validates cfg and, only if all of it is valid, replaces the
+// safelist, blocklist, throttle rules, and Fail2Ban rules with it in one
+// step, so concurrent requests see either the old configuration or the new
+// one. Use it to hot-reload a config file. SafelistIf and BlocklistIf
+// predicates, path-scoped entries, the SetGlobalLimit rule, and temporary
+// blocks are left as they are.
+func (ra *RedisRackAttack) LoadConfig(cfg Config) error {
+	safeIPs, safeNets, err := parseIPList(cfg.Safelist)
+	if err != nil {
+		return fmt.Errorf("rackattack: safelist: %w", err)
+	}
+	blockIPs, blockNets, err := parseIPList(cfg.Blocklist)
+	if err != nil {
+		return fmt.Errorf("rackattack: blocklist: %w", err)
+	}
+	throttleRules := make([]ThrottleRule, 0, len(cfg.Throttle))
+	for i, c := range cfg.Throttle {
+		r, err := c.rule()
+		if err != nil {
+			err = &invalidRuleError{err: err}
+		} else {
+			err = ra.checkRule(r)
+		}
+		if err != nil {
+			return fmt.Errorf("rackattack: throttle rule %d (%q): %w", i, c.Name, err)
+		}
+		throttleRules = append(throttleRules, r.compiled())
+	}
+	slices.SortStableFunc(throttleRules, func(a, b ThrottleRule) int { return cmp.Compare(b.Priority, a.Priority) })
+	fail2banRules := make([]Fail2BanRule, 0, len(cfg.Fail2Ban))
+	for i, c := range cfg.Fail2Ban {
+		r, err := c.rule()
+		if err != nil {
+			return fmt.Errorf("rackattack: fail2ban rule %d (%q): %w", i, c.Name, &invalidRuleError{err: err})
+		}
+		m := compilePath(r.PathPattern)
+		r.path = &m
+		fail2banRules = append(fail2banRules, r)
+	}
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.safelistIPs, ra.safelistNets = safeIPs, safeNets
+	ra.blocklistIPs, ra.blocklistNets = blockIPs, blockNets
+	ra.throttleRules = throttleRules
+	ra.fail2banRules = fail2banRules
+	return nil
+}
+
+// parseIPList splits entries into normalized IPs and CIDR ranges.
+func parseIPList(entries []string) (map[string]struct{}, []*net.IPNet, error) {
+	ips := make(map[string]struct{})
+	var nets []*net.IPNet
+	for _, e := range entries {
+		ip, n, err := parseListEntry(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n != nil {
+			nets = append(nets, n)
+		} else {
+			ips[ip] = struct{}{}
+		}
+	}
+	return ips, nets, nil
+}
+
+// parseListEntry parses a list entry as either a CIDR range, when it has a
+// "/", or a normalized IP.
+func parseListEntry(e string) (ip string, n *net.IPNet, err error) {
+	if strings.Contains(e, "/") {
+		_, n, err = net.ParseCIDR(strings.TrimSpace(e))
+		return "", n, err
+	}
+	ip, err = parseListIP(e)
+	return ip, nil, err
+}
+
+// LoadBlocklist adds the IPs and CIDR ranges read from r, one per line, to
+// the blocklist, for syncing a threat-intelligence feed at runtime. Blank
+// lines are skipped, and "#" or ";" starts a comment, so feeds such as
+// Spamhaus DROP load as they are. It returns how many distinct entries it
+// read; entries already blocklisted count but are not added twice.
+// Malformed lines are skipped and reported in err, which joins a
+// *LineError per line; the valid entries are added regardless. If reading r
+// fails, nothing is added.
+func (ra *RedisRackAttack) LoadBlocklist(r io.Reader) (added int, err error) {
+	ips, nets, malformed, err := readIPList(r)
+	if err != nil {
+		return 0, err
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	merged := maps.Clone(ra.blocklistIPs)
+	if merged == nil {
+		merged = make(map[string]struct{}, len(ips))
+	}
+	maps.Copy(merged, ips)
+	ra.blocklistIPs = merged
+	// Skip ranges already listed, so reloading a feed does not grow the list.
+	listed := make(map[string]struct{}, len(ra.blocklistNets))
+	for _, n := range ra.blocklistNets {
+		listed[n.String()] = struct{}{}
+	}
+	for _, n := range nets {
+		if _, ok := listed[n.String()]; !ok {
+			ra.blocklistNets = append(ra.blocklistNets, n)
+		}
+	}
+	return len(ips) + len(nets), errors.Join(malformed...)
+}
+
+// ReplaceBlocklist is LoadBlocklist, except that the entries read from r
+// replace the blocklisted IPs and CIDR ranges in one step, so a periodic
+// refresh drops entries the feed no longer lists and concurrent requests see
+// the old list or the new one. BlocklistIf predicates, path-scoped entries,
+// and temporary blocks are left as they are. If reading r fails, the
+// blocklist is unchanged.
+func (ra *RedisRackAttack) ReplaceBlocklist(r io.Reader) (added int, err error) {
+	ips, nets, malformed, err := readIPList(r)
+	if err != nil {
+		return 0, err
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.blocklistIPs, ra.blocklistNets = ips, nets
+	return len(ips) + len(nets), errors.Join(malformed...)
+}
+
+// readIPList reads a line-oriented IP list for LoadBlocklist, returning its
+// entries, a *LineError for each malformed line, and any read error.
+func readIPList(r io.Reader) (ips map[string]struct{}, nets []*net.IPNet, malformed []error, err error) {
+	ips = make(map[string]struct{})
+	seen := make(map[string]struct{})
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.IndexAny(text, "#;"); i >= 0 {
+			text = text[:i]
+		}
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		ip, n, err := parseListEntry(text)
+		switch {
+		case err != nil:
+			malformed = append(malformed, &LineError{Line: line, Text: text, Err: err})
+		case n != nil:
+			if _, dup := seen[n.String()]; !dup {
+				seen[n.String()] = struct{}{}
+				nets = append(nets, n)
+			}
+		default:
+			ips[ip] = struct{}{}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	return ips, nets, malformed, nil
+}
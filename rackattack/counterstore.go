@@ -0,0 +1,207 @@
+package rackattack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCounterStore is a Redis-backed Store for managed Redis services that
+// forbid scripting. It sends only plain commands, in MULTI/EXEC transactions
+// where it can, so it supports the FixedWindow algorithm alone, and a step
+// that reads before it writes is not atomic: hits racing past the limit are
+// counted and then taken back, so a concurrent hit may be throttled early,
+// and two strikes racing to the ban may both count as the last. Prefer
+// RedisStore wherever EVAL is allowed. Pair it with StartRefiller to drain
+// its counters steadily between window resets.
+type RedisCounterStore struct {
+	client redis.Cmdable
+	// keys shares RedisStore's key layout and its script-free methods.
+	keys *RedisStore
+}
+
+// NewRedisCounterStore wraps a go-redis client as a RedisCounterStore. The
+// client and keyPrefix are as for NewRedisStore, and the two stores lay out
+// their keys alike. An instance built on it rejects throttle rules that set
+// no Algorithm or any but FixedWindow, and SetGlobalLimit and Allow count
+// fixed windows.
+func NewRedisCounterStore(client redis.Cmdable, keyPrefix string) *RedisCounterStore {
+	return &RedisCounterStore{client: client, keys: NewRedisStore(client, keyPrefix)}
+}
+
+// Throttle implements Store. It counts the hit and, if that took the key past
+// Limit, takes it back.
+func (s *RedisCounterStore) Throttle(ctx context.Context, key string, q Quota) (Result, error) {
+	if err := checkCounterQuota(q); err != nil {
+		return Result{}, err
+	}
+	k, cost := s.keys.k(key), q.cost()
+	pipe := s.client.TxPipeline()
+	// SET NX starts the window with its TTL, so no counter is left without
+	// an expiry.
+	pipe.SetNX(ctx, k, 0, q.window())
+	incr := pipe.IncrBy(ctx, k, int64(cost))
+	ttl := pipe.PTTL(ctx, k)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Result{}, err
+	}
+	count := int(incr.Val())
+	limited := count > q.Limit
+	if limited {
+		if err := s.Decay(ctx, key, cost); err != nil {
+			return Result{}, err
+		}
+		count -= cost
+	}
+	return counterResult(count, max(ttl.Val(), 0), limited, q), nil
+}
+
+// Peek implements Store.
+func (s *RedisCounterStore) Peek(ctx context.Context, key string, q Quota) (Result, error) {
+	if err := checkCounterQuota(q); err != nil {
+		return Result{}, err
+	}
+	k := s.keys.k(key)
+	pipe := s.client.Pipeline()
+	get := pipe.Get(ctx, k)
+	ttl := pipe.PTTL(ctx, k)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return Result{}, err
+	}
+	count, err := counterValue(get)
+	if err != nil {
+		return Result{}, err
+	}
+	return counterResult(count, max(ttl.Val(), 0), count+q.cost() > q.Limit, q), nil
+}
+
+// Decay implements DecayStore.
+func (s *RedisCounterStore) Decay(ctx context.Context, key string, n int) error {
+	k := s.keys.k(key)
+	left, err := s.client.DecrBy(ctx, k, int64(n)).Result()
+	if err != nil || left > 0 {
+		return err
+	}
+	// Drained, or expired in the meantime and so recreated below zero.
+	return s.client.Del(ctx, k).Err()
+}
+
+// Strike implements Store.
+func (s *RedisCounterStore) Strike(ctx context.Context, key string, p BanPolicy) (bool, int, error) {
+	banKey, countKey, levelKey := s.keys.k("ban:"+key), s.keys.k("strike:"+key), s.keys.k("level:"+key)
+	pipe := s.client.Pipeline()
+	levelCmd := pipe.Get(ctx, levelKey)
+	bannedCmd := pipe.Exists(ctx, banKey)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return false, 0, err
+	}
+	level, err := counterValue(levelCmd)
+	if err != nil {
+		return false, 0, err
+	}
+	if bannedCmd.Val() == 1 {
+		return true, level, nil
+	}
+
+	tx := s.client.TxPipeline()
+	tx.SetNX(ctx, countKey, 0, p.FindTime)
+	count := tx.Incr(ctx, countKey)
+	if _, err := tx.Exec(ctx); err != nil {
+		return false, 0, err
+	}
+	if int(count.Val()) < p.MaxRetry {
+		return false, level, nil
+	}
+
+	banTime, level := p.BanTime, 0
+	tx = s.client.TxPipeline()
+	if p.Backoff > 1 {
+		// The level is read back before the ban is set, so it cannot join
+		// the transaction.
+		n, err := s.client.Incr(ctx, levelKey).Result()
+		if err != nil {
+			return false, 0, err
+		}
+		level = int(n)
+		banTime = p.banTime(level)
+		tx.PExpire(ctx, levelKey, mulDuration(banTime, 2))
+	}
+	tx.Set(ctx, banKey, 1, banTime)
+	tx.Del(ctx, countKey)
+	if _, err := tx.Exec(ctx); err != nil {
+		return false, 0, err
+	}
+	return true, level, nil
+}
+
+// Banned implements Store.
+func (s *RedisCounterStore) Banned(ctx context.Context, key string) (bool, error) {
+	return s.keys.Banned(ctx, key)
+}
+
+// BanTTL implements BanTTLStore.
+func (s *RedisCounterStore) BanTTL(ctx context.Context, key string) (time.Duration, error) {
+	return s.keys.BanTTL(ctx, key)
+}
+
+// Ban implements Store.
+func (s *RedisCounterStore) Ban(ctx context.Context, key string, banTime time.Duration) error {
+	return s.keys.Ban(ctx, key, banTime)
+}
+
+// Reset implements Store.
+func (s *RedisCounterStore) Reset(ctx context.Context, key string) (bool, error) {
+	return s.keys.Reset(ctx, key)
+}
+
+// ResetAll implements ResetAllStore, as RedisStore does.
+func (s *RedisCounterStore) ResetAll(ctx context.Context, prefix string) (int, error) {
+	return s.keys.ResetAll(ctx, prefix)
+}
+
+// checkCounterQuota is checkRedisQuota for a store that counts FixedWindow
+// alone.
+func checkCounterQuota(q Quota) error {
+	if err := checkRedisQuota(q); err != nil {
+		return err
+	}
+	if q.Algorithm != FixedWindow {
+		return errUnknownAlgorithm
+	}
+	return nil
+}
+
+// counterValue returns the integer a GET read, or zero for a missing key.
+func counterValue(get *redis.StringCmd) (int, error) {
+	raw, err := get.Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("rackattack: counter is not an integer: %w", err)
+	}
+	return n, nil
+}
+
+// counterResult builds the Result for a FixedWindow counter at count, whose
+// window ends after reset.
+func counterResult(count int, reset time.Duration, limited bool, q Quota) Result {
+	result := Result{
+		Limit:     q.Limit,
+		Limited:   limited,
+		Remaining: max(q.Limit-count, 0),
+		Reset:     reset,
+	}
+	if limited {
+		result.RetryAfter = reset
+	}
+	return result
+}
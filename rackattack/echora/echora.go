@@ -0,0 +1,67 @@
+// Package echora adapts rackattack to the Echo web framework. It lives in its
+// own module so that only Echo users take on the Echo dependency.
+package echora
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/nandha854/go-rack-attack/rackattack"
+)
+
+// Middleware returns Echo middleware that filters requests through ra, the
+// Echo counterpart of ra.Middleware. Allowed requests continue down the chain
+// with the rate-limit headers set. Throttled requests fail with a 429
+// *echo.HTTPError (Retry-After is already set), blocklisted and banned ones
+// with 403, so Echo's HTTPErrorHandler renders them. Store errors go to
+// ra.ReportError and, under WithFailClosed, fail with 503.
+//
+// Every store call uses the request's context, so a client that goes away or
+// a deadline set earlier in the chain cancels the check.
+//
+// Hits against rules with CountIf or StatusCost are recorded once the handler
+// returns, using the status it wrote or the code of the *echo.HTTPError it
+// returned.
+func Middleware(ra *rackattack.RedisRackAttack) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			decision, err := ra.Check(req)
+			if err != nil {
+				if ra.ReportError(req, err) {
+					return echo.NewHTTPError(http.StatusServiceUnavailable)
+				}
+				return next(c)
+			}
+
+			ra.SetRateLimitHeaders(c.Response().Header(), decision)
+			switch {
+			case decision.Allowed:
+				err := next(c)
+				if rerr := ra.Record(req, responseStatus(c, err)); rerr != nil {
+					ra.ReportError(req, rerr)
+				}
+				return err
+			case decision.Reason == rackattack.ReasonThrottled:
+				return echo.NewHTTPError(http.StatusTooManyRequests)
+			default:
+				return echo.NewHTTPError(http.StatusForbidden)
+			}
+		}
+	}
+}
+
+// responseStatus returns the status a handler produced: the one already
+// written, or the one Echo will write for the error it returned.
+func responseStatus(c echo.Context, err error) int {
+	if c.Response().Committed || err == nil {
+		return c.Response().Status
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,106 @@
+package echora_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nandha854/go-rack-attack/rackattack"
+	"github.com/nandha854/go-rack-attack/rackattack/echora"
+)
+
+func newServer(ra *rackattack.RedisRackAttack) *echo.Echo {
+	e := echo.New()
+	e.Use(echora.Middleware(ra))
+	e.GET("/ok", func(c echo.Context) error { return c.String(http.StatusOK, "ok") })
+	e.GET("/fail", func(echo.Context) error { return echo.NewHTTPError(http.StatusUnauthorized) })
+	return e
+}
+
+func serve(e *echo.Echo, path, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMiddlewareThrottles(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore())
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	e := newServer(ra)
+
+	rec := serve(e, "/ok", "1.1.1.1:1")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+
+	rec = serve(e, "/ok", "1.1.1.1:1")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+}
+
+func TestMiddlewareBlocks(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore())
+	require.NoError(t, err)
+	ra.BlocklistIP("6.6.6.6")
+	e := newServer(ra)
+
+	assert.Equal(t, http.StatusForbidden, serve(e, "/ok", "6.6.6.6:1").Code)
+	assert.Equal(t, http.StatusOK, serve(e, "/ok", "1.1.1.1:1").Code)
+}
+
+// failingStore makes every Check fail with the request context's error, or
+// a generic one.
+type failingStore struct{ rackattack.Store }
+
+func (failingStore) Throttle(ctx context.Context, _ string, _ rackattack.Quota) (rackattack.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return rackattack.Result{}, err
+	}
+	return rackattack.Result{}, errors.New("store down")
+}
+
+func TestMiddlewareStoreErrors(t *testing.T) {
+	var reported error
+	ra, err := rackattack.New(failingStore{}, rackattack.WithErrorHandler(func(_ *http.Request, err error) { reported = err }))
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	e := newServer(ra)
+	assert.Equal(t, http.StatusOK, serve(e, "/ok", "1.1.1.1:1").Code, "fails open by default")
+	assert.EqualError(t, reported, "store down")
+
+	// The check runs under the request's context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/ok", nil).WithContext(ctx)
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	assert.ErrorIs(t, reported, context.Canceled)
+
+	ra, err = rackattack.New(failingStore{}, rackattack.WithFailClosed())
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	assert.Equal(t, http.StatusServiceUnavailable, serve(newServer(ra), "/ok", "1.1.1.1:1").Code)
+}
+
+func TestMiddlewareRecordsCountIfFromHandlerErrors(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore())
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{
+		Key: "login:%{ip}", Limit: 1, Period: time.Minute,
+		CountIf: func(status int) bool { return status == http.StatusUnauthorized },
+	})
+	e := newServer(ra)
+
+	assert.Equal(t, http.StatusOK, serve(e, "/ok", "1.1.1.1:1").Code)
+	assert.Equal(t, http.StatusOK, serve(e, "/ok", "1.1.1.1:1").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(e, "/fail", "1.1.1.1:1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(e, "/ok", "1.1.1.1:1").Code)
+}
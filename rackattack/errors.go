@@ -0,0 +1,107 @@
+package rackattack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRuleInvalid is matched, via errors.Is, by the errors Throttle,
+// SetGlobalLimit, and LoadConfig return for a rule that could only misbehave,
+// including one with a shared key under WithStrictKeys. It marks a
+// configuration bug, never a runtime condition.
+var ErrRuleInvalid = errors.New("rackattack: invalid rule")
+
+// ErrUnscopedReset is returned by ResetAll when neither the store nor
+// WithKeyPrefix sets a key prefix, so there is no way to tell ra's keys from
+// the rest of the database.
+var ErrUnscopedReset = errors.New("rackattack: ResetAll needs a key prefix")
+
+// invalidRuleError marks a rule validation failure as ErrRuleInvalid while
+// keeping its message.
+type invalidRuleError struct {
+	err error
+}
+
+func (e *invalidRuleError) Error() string        { return e.err.Error() }
+func (e *invalidRuleError) Unwrap() error        { return e.err }
+func (e *invalidRuleError) Is(target error) bool { return target == ErrRuleInvalid }
+
+// LineError reports a malformed line in a list read by LoadBlocklist or
+// ReplaceBlocklist.
+type LineError struct {
+	// Line is the 1-based line number.
+	Line int
+	// Text is the entry, without any comment or surrounding space.
+	Text string
+	// Err is the parse error.
+	Err error
+}
+
+func (e *LineError) Error() string { return fmt.Sprintf("line %d: %v", e.Line, e.Err) }
+func (e *LineError) Unwrap() error { return e.Err }
+
+// StoreError reports that a Store call failed, for instance because Redis is
+// unreachable, as opposed to a configuration error. Every store failure
+// returned by Check, IsThrottled, and the other methods that reach the store
+// is, or wraps, a *StoreError; find it with errors.As to alert on outages.
+// Its message is that of Err.
+type StoreError struct {
+	// Op is the Store method that failed, e.g. "Throttle" or "Batch".
+	Op string
+	// Err is the error the store returned, such as a go-redis error. Context
+	// errors stay visible to errors.Is through it.
+	Err error
+}
+
+func (e *StoreError) Error() string { return e.Err.Error() }
+func (e *StoreError) Unwrap() error { return e.Err }
+
+// storeError wraps err, returned by the store's op method, in a StoreError.
+func storeError(op string, err error) error {
+	var se *StoreError
+	if err == nil || errors.As(err, &se) {
+		return err
+	}
+	return &StoreError{Op: op, Err: err}
+}
+
+// errorStore wraps every error from the wrapped Store in a StoreError.
+type errorStore struct {
+	Store
+}
+
+func (s *errorStore) Throttle(ctx context.Context, key string, q Quota) (Result, error) {
+	res, err := s.Store.Throttle(ctx, key, q)
+	return res, storeError("Throttle", err)
+}
+
+func (s *errorStore) Peek(ctx context.Context, key string, q Quota) (Result, error) {
+	res, err := s.Store.Peek(ctx, key, q)
+	return res, storeError("Peek", err)
+}
+
+func (s *errorStore) Strike(ctx context.Context, key string, p BanPolicy) (bool, int, error) {
+	banned, level, err := s.Store.Strike(ctx, key, p)
+	return banned, level, storeError("Strike", err)
+}
+
+func (s *errorStore) Banned(ctx context.Context, key string) (bool, error) {
+	banned, err := s.Store.Banned(ctx, key)
+	return banned, storeError("Banned", err)
+}
+
+func (s *errorStore) Reset(ctx context.Context, key string) (bool, error) {
+	existed, err := s.Store.Reset(ctx, key)
+	return existed, storeError("Reset", err)
+}
+
+func (s *errorStore) Ban(ctx context.Context, key string, banTime time.Duration) error {
+	return storeError("Ban", s.Store.Ban(ctx, key, banTime))
+}
+
+func (s *errorStore) Batch(ctx context.Context, ops []BatchOp) ([]Result, error) {
+	results, err := runBatch(ctx, s.Store, ops)
+	return results, storeError("Batch", err)
+}
@@ -0,0 +1,75 @@
+package rackattack
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// GeoResolver maps a client IP to its country, for CountryPattern rules and
+// the %{country} placeholder. The package bundles no GeoIP database; adapt
+// MaxMind's GeoLite2 or similar. CountryOf is called once per evaluated
+// request, so it should be a local lookup rather than a network call, and it
+// must be safe for concurrent use.
+type GeoResolver interface {
+	// CountryOf returns the ISO 3166-1 alpha-2 code of ip's country, such as
+	// "DE", or "" when it is unknown.
+	CountryOf(ip string) (string, error)
+}
+
+// countryContextKey is the type used to carry the resolved country in the
+// request context during evaluation.
+type countryContextKey struct{}
+
+// CountryFromRequest returns the upper-cased country WithGeoResolver resolved
+// for req, or "" when it is unknown or no resolver is configured. It is set
+// on the request that SafelistIf and BlocklistIf predicates, KeyFunc, and
+// CostFunc receive, so a predicate can block a country outright.
+func CountryFromRequest(req *http.Request) string {
+	c, _ := req.Context().Value(countryContextKey{}).(string)
+	return c
+}
+
+// client resolves req's client IP and, under WithGeoResolver, its country,
+// which it attaches to the returned request for matching and keying, along
+// with any WithContextKey keys. A resolver error leaves the country unknown.
+func (ra *RedisRackAttack) client(req *http.Request) (*http.Request, string) {
+	ip := ra.clientIP(req)
+	return ra.withClient(req, ip), ip
+}
+
+// withClient attaches what client does to req for the client IP ip.
+func (ra *RedisRackAttack) withClient(req *http.Request, ip string) *http.Request {
+	if ra.contextKeys != nil {
+		req = req.WithContext(context.WithValue(req.Context(), contextKeysKey{}, ra.contextKeys))
+	}
+	if ra.geo == nil {
+		return req
+	}
+	var country string
+	if ip != UnknownClientIP {
+		if c, err := ra.geo.CountryOf(ip); err == nil {
+			country = strings.ToUpper(c)
+		}
+	}
+	return req.WithContext(context.WithValue(req.Context(), countryContextKey{}, country))
+}
+
+// matchCountry reports whether country matches the rule's pattern, a
+// comma-separated list of country codes such as "CN,RU". An empty pattern
+// matches everything, including an unknown country; otherwise an unknown
+// country matches nothing. Comparison is case-insensitive.
+func matchCountry(pattern, country string) bool {
+	if pattern == "" {
+		return true
+	}
+	if country == "" {
+		return false
+	}
+	for _, c := range strings.Split(pattern, ",") {
+		if strings.EqualFold(strings.TrimSpace(c), country) {
+			return true
+		}
+	}
+	return false
+}
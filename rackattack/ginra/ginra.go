@@ -0,0 +1,46 @@
+// Package ginra adapts rackattack to the Gin web framework. It lives in its
+// own module so that only Gin users take on the Gin dependency.
+package ginra
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/nandha854/go-rack-attack/rackattack"
+)
+
+// Middleware returns a Gin handler that filters requests through ra, the Gin
+// counterpart of ra.Middleware. Allowed requests continue down the chain with
+// the rate-limit headers set. Throttled requests are aborted with 429 and
+// Retry-After; blocklisted and banned ones with 403. Store errors go to
+// ra.ReportError and, under WithFailClosed, abort with 503.
+//
+// Hits against rules with CountIf or StatusCost are recorded once the rest of
+// the chain has run, using the status it wrote.
+func Middleware(ra *rackattack.RedisRackAttack) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		decision, err := ra.Check(c.Request)
+		if err != nil {
+			if ra.ReportError(c.Request, err) {
+				c.AbortWithStatus(http.StatusServiceUnavailable)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		ra.SetRateLimitHeaders(c.Writer.Header(), decision)
+		switch {
+		case decision.Allowed:
+			c.Next()
+			if err := ra.Record(c.Request, c.Writer.Status()); err != nil {
+				ra.ReportError(c.Request, err)
+			}
+		case decision.Reason == rackattack.ReasonThrottled:
+			c.AbortWithStatus(http.StatusTooManyRequests)
+		default:
+			c.AbortWithStatus(http.StatusForbidden)
+		}
+	}
+}
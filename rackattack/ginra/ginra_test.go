@@ -0,0 +1,107 @@
+package ginra_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nandha854/go-rack-attack/rackattack"
+	"github.com/nandha854/go-rack-attack/rackattack/ginra"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newRouter(t *testing.T, ra *rackattack.RedisRackAttack) *gin.Engine {
+	t.Helper()
+	r := gin.New()
+	r.Use(ginra.Middleware(ra))
+	r.GET("/*path", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	return r
+}
+
+func serve(r http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api", nil)
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMiddlewareThrottles(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore())
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	r := newRouter(t, ra)
+
+	rec := serve(r, "1.1.1.1:1")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+
+	rec = serve(r, "1.1.1.1:1")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+	assert.Empty(t, rec.Body.String(), "the handler never ran")
+}
+
+func TestMiddlewareBlocks(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore())
+	require.NoError(t, err)
+	ra.BlocklistIP("6.6.6.6")
+	r := newRouter(t, ra)
+
+	assert.Equal(t, http.StatusForbidden, serve(r, "6.6.6.6:1").Code)
+	assert.Equal(t, http.StatusOK, serve(r, "1.1.1.1:1").Code)
+}
+
+// failingStore makes every Check fail.
+type failingStore struct{ rackattack.Store }
+
+func (failingStore) Throttle(context.Context, string, rackattack.Quota) (rackattack.Result, error) {
+	return rackattack.Result{}, errors.New("store down")
+}
+
+func TestMiddlewareStoreErrors(t *testing.T) {
+	var reported error
+	ra, err := rackattack.New(failingStore{}, rackattack.WithErrorHandler(func(_ *http.Request, err error) { reported = err }))
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	assert.Equal(t, http.StatusOK, serve(newRouter(t, ra), "1.1.1.1:1").Code, "fails open by default")
+	assert.EqualError(t, reported, "store down")
+
+	ra, err = rackattack.New(failingStore{}, rackattack.WithFailClosed())
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	assert.Equal(t, http.StatusServiceUnavailable, serve(newRouter(t, ra), "1.1.1.1:1").Code)
+}
+
+func TestMiddlewareRecordsCountIfAfterHandler(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore())
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{
+		Key: "login:%{ip}", Limit: 1, Period: time.Minute,
+		CountIf: func(status int) bool { return status == http.StatusUnauthorized },
+	})
+	r := gin.New()
+	r.Use(ginra.Middleware(ra))
+	r.GET("/ok", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/fail", func(c *gin.Context) { c.Status(http.StatusUnauthorized) })
+
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, get("/ok"))
+	assert.Equal(t, http.StatusOK, get("/ok"))
+	assert.Equal(t, http.StatusUnauthorized, get("/fail"))
+	assert.Equal(t, http.StatusTooManyRequests, get("/ok"))
+}
@@ -0,0 +1,91 @@
+package rackattack
+
+import (
+	"context"
+	"time"
+)
+
+// guardedStore bounds every call to the wrapped Store with a per-attempt
+// timeout and retries failed attempts, per WithStoreTimeout and
+// WithStoreRetries.
+type guardedStore struct {
+	Store
+	timeout time.Duration
+	retries int
+}
+
+// do runs op up to 1+retries times, each under its own timeout. It stops
+// early once ctx itself is done, since retrying cannot help the caller then.
+func (s *guardedStore) do(ctx context.Context, op func(context.Context) error) error {
+	var err error
+	for attempt := 0; attempt <= s.retries; attempt++ {
+		err = s.attempt(ctx, op)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *guardedStore) attempt(ctx context.Context, op func(context.Context) error) error {
+	if s.timeout <= 0 {
+		return op(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return op(ctx)
+}
+
+func (s *guardedStore) Throttle(ctx context.Context, key string, q Quota) (res Result, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		res, err = s.Store.Throttle(ctx, key, q)
+		return err
+	})
+	return res, err
+}
+
+func (s *guardedStore) Peek(ctx context.Context, key string, q Quota) (res Result, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		res, err = s.Store.Peek(ctx, key, q)
+		return err
+	})
+	return res, err
+}
+
+func (s *guardedStore) Strike(ctx context.Context, key string, p BanPolicy) (banned bool, level int, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		banned, level, err = s.Store.Strike(ctx, key, p)
+		return err
+	})
+	return banned, level, err
+}
+
+func (s *guardedStore) Banned(ctx context.Context, key string) (banned bool, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		banned, err = s.Store.Banned(ctx, key)
+		return err
+	})
+	return banned, err
+}
+
+func (s *guardedStore) Reset(ctx context.Context, key string) (existed bool, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		existed, err = s.Store.Reset(ctx, key)
+		return err
+	})
+	return existed, err
+}
+
+func (s *guardedStore) Ban(ctx context.Context, key string, banTime time.Duration) error {
+	return s.do(ctx, func(ctx context.Context) error {
+		return s.Store.Ban(ctx, key, banTime)
+	})
+}
+
+func (s *guardedStore) Batch(ctx context.Context, ops []BatchOp) (results []Result, err error) {
+	err = s.do(ctx, func(ctx context.Context) error {
+		results, err = runBatch(ctx, s.Store, ops)
+		return err
+	})
+	return results, err
+}
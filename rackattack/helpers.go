@@ -1,12 +1,39 @@
 package rackattack
 
-import "errors"
+import (
+	"errors"
+	"net"
+)
 
 // errMalformedScriptReply indicates the Lua throttle script returned a reply
 // shape the client did not expect. It signals a version/wiring bug rather than
 // a runtime condition.
 var errMalformedScriptReply = errors.New("rackattack: malformed throttle script reply")
 
+// errUnknownAlgorithm is returned by the bundled stores for an Algorithm value
+// they do not implement.
+var errUnknownAlgorithm = errors.New("rackattack: unknown throttle algorithm")
+
+// errInvalidQuota is returned by the bundled stores for a Quota they cannot
+// count under, such as one with a zero Limit or Period.
+var errInvalidQuota = errors.New("rackattack: invalid quota")
+
+// failClosedError wraps a store error from a ThrottleRule with FailClosed
+// set, so the error-handling paths deny the request regardless of the
+// instance policy.
+type failClosedError struct {
+	err error
+}
+
+func (e *failClosedError) Error() string { return e.err.Error() }
+func (e *failClosedError) Unwrap() error { return e.err }
+
+// deniesOnError reports whether err came from a rule that fails closed.
+func deniesOnError(err error) bool {
+	var fc *failClosedError
+	return errors.As(err, &fc)
+}
+
 // toInt coerces a Redis reply element (which arrives as int64) to int.
 func toInt(v any) int {
 	if n, ok := v.(int64); ok {
@@ -33,3 +60,60 @@ func withKey(m map[string]struct{}, key string) map[string]struct{} {
 	next[key] = struct{}{}
 	return next
 }
+
+// withoutKey returns a copy of m with key removed, for the same copy-on-write
+// reason as withKey.
+func withoutKey(m map[string]struct{}, key string) map[string]struct{} {
+	next := make(map[string]struct{}, len(m))
+	for k := range m {
+		if k != key {
+			next[k] = struct{}{}
+		}
+	}
+	return next
+}
+
+// withoutNet returns a copy of nets without any network equal to n.
+func withoutNet(nets []*net.IPNet, n *net.IPNet) []*net.IPNet {
+	next := make([]*net.IPNet, 0, len(nets))
+	for _, existing := range nets {
+		if existing.String() != n.String() {
+			next = append(next, existing)
+		}
+	}
+	return next
+}
+
+// inPathEntries reports whether ip has an entry whose pattern matches
+// reqPath.
+func inPathEntries(entries []pathEntry, ip, reqPath string) bool {
+	for _, e := range entries {
+		if e.ip == ip && matchPath(e.pattern, reqPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// withEntry returns a copy of entries with e added, unless already present,
+// for the same copy-on-write reason as withKey.
+func withEntry(entries []pathEntry, e pathEntry) []pathEntry {
+	next := make([]pathEntry, 0, len(entries)+1)
+	for _, existing := range entries {
+		if existing != e {
+			next = append(next, existing)
+		}
+	}
+	return append(next, e)
+}
+
+// withoutEntry returns a copy of entries without e.
+func withoutEntry(entries []pathEntry, e pathEntry) []pathEntry {
+	next := make([]pathEntry, 0, len(entries))
+	for _, existing := range entries {
+		if existing != e {
+			next = append(next, existing)
+		}
+	}
+	return next
+}
@@ -0,0 +1,195 @@
+package rackattack
+
+import (
+	"encoding/json"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Rules returns a copy of the throttle rules in evaluation order, ending with
+// the SetGlobalLimit rule when one is set. Modifying the result, MethodLimits
+// included, does not affect ra.
+func (ra *RedisRackAttack) Rules() []ThrottleRule {
+	ra.mu.RLock()
+	defer ra.mu.RUnlock()
+	rules := slices.Clone(withGlobal(ra.throttleRules, ra.globalRule))
+	for i := range rules {
+		rules[i].MethodLimits = maps.Clone(rules[i].MethodLimits)
+	}
+	return rules
+}
+
+// Fail2BanRules returns a copy of the Fail2Ban rules in evaluation order.
+func (ra *RedisRackAttack) Fail2BanRules() []Fail2BanRule {
+	ra.mu.RLock()
+	defer ra.mu.RUnlock()
+	return slices.Clone(ra.fail2banRules)
+}
+
+// SafelistedIPs returns the safelisted IPs, sorted.
+func (ra *RedisRackAttack) SafelistedIPs() []string {
+	ra.mu.RLock()
+	defer ra.mu.RUnlock()
+	return sortedKeys(ra.safelistIPs)
+}
+
+// BlocklistedIPs returns the blocklisted IPs, sorted. Temporary blocks held
+// in the store are not included.
+func (ra *RedisRackAttack) BlocklistedIPs() []string {
+	ra.mu.RLock()
+	defer ra.mu.RUnlock()
+	return sortedKeys(ra.blocklistIPs)
+}
+
+// SafelistedCIDRs returns the safelisted ranges in CIDR notation, in the order
+// they were added.
+func (ra *RedisRackAttack) SafelistedCIDRs() []string {
+	ra.mu.RLock()
+	defer ra.mu.RUnlock()
+	return netStrings(ra.safelistNets)
+}
+
+// BlocklistedCIDRs returns the blocklisted ranges in CIDR notation, in the
+// order they were added.
+func (ra *RedisRackAttack) BlocklistedCIDRs() []string {
+	ra.mu.RLock()
+	defer ra.mu.RUnlock()
+	return netStrings(ra.blocklistNets)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func netStrings(nets []*net.IPNet) []string {
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	return out
+}
+
+// debugState is the JSON body DebugHandler writes.
+type debugState struct {
+	IP          string      `json:"ip"`
+	Safelisted  bool        `json:"safelisted"`
+	Blocklisted bool        `json:"blocklisted"`
+	Rules       []debugRule `json:"rules"`
+	Fail2Ban    []debugBan  `json:"fail2ban"`
+}
+
+// debugRule is a throttle rule's counter in a debugState. Count, Limit, and
+// TTL are as Stats reports them.
+type debugRule struct {
+	Name     string   `json:"name"`
+	Key      string   `json:"key"`
+	Matches  bool     `json:"matches"`
+	Disabled bool     `json:"disabled,omitempty"`
+	Count    int      `json:"count"`
+	Limit    int      `json:"limit"`
+	TTL      Duration `json:"ttl"`
+	Banned   bool     `json:"banned,omitempty"`
+}
+
+// debugBan is a Fail2Ban rule's ban state in a debugState.
+type debugBan struct {
+	Name   string `json:"name"`
+	Banned bool   `json:"banned"`
+}
+
+// DebugHandler returns a handler that reports, as JSON, how ra sees the
+// client IP in the ip query parameter, for on-call debugging: whether it is
+// safelisted or blocklisted (including temporary blocks), each throttle
+// rule's key, count, limit, and TTL for it, and its bans. It only reads the
+// store, recording nothing. The optional path and method parameters, "/" and
+// "GET" by default, shape the request that rule keys and matches, and
+// path-scoped entries, are derived from; SafelistIf and BlocklistIf
+// predicates are not evaluated. The output exposes rules and client state,
+// so mount it behind your own authentication, e.g. at
+// "/debug/rackattack?ip=1.2.3.4".
+func (ra *RedisRackAttack) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		ip, err := parseListIP(q.Get("ip"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		method, target := q.Get("method"), q.Get("path")
+		if method == "" {
+			method = http.MethodGet
+		}
+		if target == "" {
+			target = "/"
+		}
+		req, err := http.NewRequestWithContext(r.Context(), method, target, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.RemoteAddr = net.JoinHostPort(ip, "0")
+		state, err := ra.debugState(ra.withClient(req, ip), ip)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(state)
+	})
+}
+
+// debugState gathers DebugHandler's report on client ip for req.
+func (ra *RedisRackAttack) debugState(req *http.Request, ip string) (debugState, error) {
+	ctx := req.Context()
+	ra.mu.RLock()
+	_, safe := ra.safelistIPs[ip]
+	safe = safe || ipInNets(ip, ra.safelistNets) || inPathEntries(ra.safelistPaths, ip, req.URL.Path)
+	_, blocked := ra.blocklistIPs[ip]
+	blocked = blocked || ipInNets(ip, ra.blocklistNets) || inPathEntries(ra.blocklistPaths, ip, req.URL.Path)
+	rules := withGlobal(ra.throttleRules, ra.globalRule)
+	fail2banRules := ra.fail2banRules
+	ra.mu.RUnlock()
+
+	if !blocked && ra.tempBlocklist {
+		var err error
+		if blocked, err = ra.store.Banned(ctx, tempBlockKey(ip)); err != nil {
+			return debugState{}, err
+		}
+	}
+	state := debugState{IP: ip, Safelisted: safe, Blocklisted: blocked, Rules: []debugRule{}, Fail2Ban: []debugBan{}}
+	for _, rule := range rules {
+		d := debugRule{Name: rule.name(), Key: rule.key(ip, req), Matches: rule.matches(req), Disabled: rule.Disabled}
+		if d.Key != "" {
+			res, err := ra.store.Peek(ctx, d.Key, rule.unitQuota(req))
+			if err != nil {
+				return debugState{}, err
+			}
+			d.Count, d.Limit, d.TTL = res.Limit-res.Remaining, res.Limit, Duration(res.Reset.Round(time.Millisecond))
+			if rule.Ban.enabled() {
+				if d.Banned, err = ra.store.Banned(ctx, throttleBanKey(d.Key)); err != nil {
+					return debugState{}, err
+				}
+			}
+		}
+		state.Rules = append(state.Rules, d)
+	}
+	for _, rule := range fail2banRules {
+		banned, err := ra.store.Banned(ctx, rule.Name+":"+ip)
+		if err != nil {
+			return debugState{}, err
+		}
+		state.Fail2Ban = append(state.Fail2Ban, debugBan{Name: rule.Name, Banned: banned})
+	}
+	return state, nil
+}
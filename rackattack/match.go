@@ -1,56 +1,341 @@
 package rackattack
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
 	"path"
 	"strings"
 )
 
 // matchPath reports whether reqPath matches pattern. An empty pattern matches
 // everything. A pattern ending in "/*" matches the entire subtree (e.g.
-// "/api/*" matches "/api", "/api/users", and "/api/v1/users"). Otherwise the
-// pattern is treated as a glob per path.Match (so "*" matches within a single
-// segment and patterns like "/api/v*/users" work), falling back to an exact
-// comparison when the pattern contains no metacharacters.
+// "/api/*" matches "/api", "/api/users", and "/api/v1/users"). A "**" segment
+// matches zero or more whole segments (e.g. "/api/**/admin" matches
+// "/api/admin" and "/api/v1/x/admin"). Otherwise the pattern is treated as a
+// glob per path.Match (so "*" matches within a single segment and patterns
+// like "/api/v*/users", "/files/*.json", and "/api*" work, the last matching
+// "/api" and "/apix" but not "/api/users"), falling back to an exact
+// comparison when the pattern contains no metacharacters. The request path is
+// cleaned first, which drops its trailing slash, so an exact "/api/" matches
+// "/api" but a wildcard pattern ending in "/" matches nothing unless the rule
+// sets IgnoreTrailingSlash. Malformed patterns match nothing;
+// checkPathPattern rejects them up front.
 func matchPath(pattern, reqPath string) bool {
 	if pattern == "" {
 		return true
 	}
-	clean := path.Clean(reqPath)
+	m := compilePath(pattern)
+	return m.match(path.Clean(reqPath))
+}
+
+// pathKind is how a pathMatcher compares a path.
+type pathKind int
+
+const (
+	pathAny      pathKind = iota // everything
+	pathExact                    // equal to pattern
+	pathSubtree                  // equal to or under pattern
+	pathGlob                     // path.Match
+	pathSegments                 // matchSegments, for "**"
+)
+
+// pathMatcher is a matchPath pattern parsed once, when its rule is added, so
+// that matching a request path is a comparison or two rather than trimming,
+// scanning, and splitting the pattern for every rule on every request.
+type pathMatcher struct {
+	kind pathKind
+	// lit is the literal leading segments of a wildcard pattern, which the
+	// path must equal or be under before the wildcards are tried. It rules
+	// out most paths at the cost of a prefix comparison.
+	lit     string
+	pattern string
+	segs    []string
+}
 
-	// Subtree wildcard: "/prefix/*" matches the prefix and anything under it.
-	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
-		if prefix == "" {
-			return true // "/*" matches everything
+// compilePath parses pattern for matchPath.
+func compilePath(pattern string) pathMatcher {
+	if pattern == "" {
+		return pathMatcher{kind: pathAny}
+	}
+	var m pathMatcher
+	if i := strings.IndexAny(pattern, "*?["); i > 0 {
+		if j := strings.LastIndexByte(pattern[:i], '/'); j > 0 {
+			m.lit = pattern[:j]
 		}
-		return clean == prefix || strings.HasPrefix(clean, prefix+"/")
 	}
+	switch prefix, subtree := strings.CutSuffix(pattern, "/*"); {
+	case subtree && prefix == "":
+		m.kind = pathAny // "/*" matches everything
+	case subtree:
+		m.kind, m.pattern = pathSubtree, prefix
+	case strings.Contains(pattern, "**"):
+		m.kind, m.segs = pathSegments, strings.Split(pattern, "/")
+	case strings.ContainsAny(pattern, "*?["):
+		m.kind, m.pattern = pathGlob, pattern
+	default:
+		m.kind, m.pattern = pathExact, path.Clean(pattern)
+	}
+	return m
+}
 
-	if strings.ContainsAny(pattern, "*?[") {
-		if ok, err := path.Match(pattern, clean); err == nil && ok {
-			return true
-		}
+// match reports whether clean, a path.Clean'ed request path, matches m.
+func (m *pathMatcher) match(clean string) bool {
+	if m.lit != "" && !atOrUnder(clean, m.lit) {
 		return false
 	}
+	switch m.kind {
+	case pathExact:
+		return clean == m.pattern
+	case pathSubtree:
+		return atOrUnder(clean, m.pattern)
+	case pathGlob:
+		ok, err := path.Match(m.pattern, clean)
+		return err == nil && ok
+	case pathSegments:
+		return matchSegments(m.segs, strings.Split(clean, "/"))
+	}
+	return true
+}
+
+// atOrUnder reports whether clean is dir or a path beneath it.
+func atOrUnder(clean, dir string) bool {
+	return clean == dir || len(clean) > len(dir) && clean[len(dir)] == '/' && strings.HasPrefix(clean, dir)
+}
+
+// requestPath is a request path cleaned once for matching against every rule.
+type requestPath struct {
+	clean string
+	lower string // the lower-cased clean, computed on first use
+}
+
+func newRequestPath(reqPath string) requestPath {
+	return requestPath{clean: path.Clean(reqPath)}
+}
+
+// folded returns the lower-cased path, for CaseInsensitivePath rules.
+func (p *requestPath) folded() string {
+	if p.lower == "" {
+		p.lower = strings.ToLower(p.clean)
+	}
+	return p.lower
+}
 
-	return clean == path.Clean(pattern)
+// checkPathPattern reports why pattern is not a valid matchPath pattern: a
+// malformed glob, such as an unclosed "[", or a "**" that is not a whole
+// segment, such as "/api**".
+func checkPathPattern(pattern string) error {
+	for _, seg := range strings.Split(pattern, "/") {
+		if strings.Contains(seg, "**") && seg != "**" {
+			return fmt.Errorf("path pattern %q: ** must be a whole path segment", pattern)
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("path pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
 }
 
-// matchMethod reports whether method matches the rule's method. An empty rule
-// method matches everything. Comparison is case-insensitive.
+// matchSegments matches path segments against pattern segments, where a "**"
+// segment consumes any number of path segments and every other segment is a
+// path.Match glob.
+func matchSegments(pattern, segs []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(rest, segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], segs[0]); err != nil || !ok {
+			return false
+		}
+		pattern, segs = pattern[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// matchHost reports whether the request host matches pattern, ignoring case
+// and any port. An empty pattern matches everything. A pattern with
+// metacharacters is a path.Match glob, so "*.example.com" matches every
+// subdomain of example.com (but not example.com itself).
+func matchHost(pattern, host string) bool {
+	if pattern == "" {
+		return true
+	}
+	pattern = strings.ToLower(pattern)
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, err := path.Match(pattern, host)
+		return err == nil && ok
+	}
+	return pattern == host
+}
+
+// checkHostPattern reports why pattern is not a valid matchHost pattern: a
+// malformed glob, such as an unclosed "[".
+func checkHostPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("host pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// requestHost returns req.Host lower-cased, without a port or trailing dot.
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// matchMethod reports whether method matches the rule's method, which may be
+// a comma-separated list such as "POST,PUT". An empty rule method, or a "*"
+// entry, matches everything. Comparison is case-insensitive.
 func matchMethod(ruleMethod, method string) bool {
-	if ruleMethod == "" {
+	if ruleMethod == "" || ruleMethod == "*" {
 		return true
 	}
-	return strings.EqualFold(ruleMethod, method)
+	for _, m := range strings.Split(ruleMethod, ",") {
+		if m = strings.TrimSpace(m); m == "*" || strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
 }
 
-// expandKey substitutes %{ip} and %{path} placeholders in a key template.
-func expandKey(template, ip, reqPath string) string {
+// expandKey substitutes placeholders in a key template:
+//
+//	%{ip}           the client IP
+//	%{host}         the request host, lower-cased and without a port
+//	%{country}      the client's country code (see WithGeoResolver)
+//	%{path}         the request path
+//	%{method}       the request method
+//	%{header:Name}  the value of request header Name ("" when absent)
+//	%{query:name}   the value of query parameter name ("" when absent)
+//	%{context:name} the request-context value WithContextKey registered as
+//	                name ("" when absent)
+//
+// Unknown placeholders are left in place verbatim.
+func expandKey(template, ip string, req *http.Request) string {
 	if !strings.Contains(template, "%{") {
 		return template
 	}
-	return strings.NewReplacer(
-		"%{ip}", ip,
-		"%{path}", reqPath,
-	).Replace(template)
+	var b strings.Builder
+	rest := template
+	for {
+		start := strings.Index(rest, "%{")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+		b.WriteString(rest[:start])
+		if v, ok := placeholderValue(rest[start+2:end], ip, req); ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(rest[start : end+1])
+		}
+		rest = rest[end+1:]
+	}
+	b.WriteString(rest)
+	return b.String()
+}
+
+// perClientKey reports whether template contains a placeholder that can
+// differ between clients: %{ip}, %{header:Name}, %{query:name}, or
+// %{context:name}. Without one, every client shares a single counter.
+func perClientKey(template string) bool {
+	rest := template
+	for {
+		start := strings.Index(rest, "%{")
+		if start < 0 {
+			return false
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return false
+		}
+		name := rest[start+2 : start+end]
+		if name == "ip" || strings.HasPrefix(name, "header:") || strings.HasPrefix(name, "query:") ||
+			strings.HasPrefix(name, "context:") {
+			return true
+		}
+		rest = rest[start+end+1:]
+	}
+}
+
+// placeholderValue resolves a single key-template placeholder name. The bool
+// is false for names expandKey does not recognize.
+func placeholderValue(name, ip string, req *http.Request) (string, bool) {
+	switch name {
+	case "ip":
+		return ip, true
+	case "host":
+		return requestHost(req), true
+	case "country":
+		return CountryFromRequest(req), true
+	case "path":
+		return req.URL.Path, true
+	case "method":
+		return req.Method, true
+	}
+	if header, ok := strings.CutPrefix(name, "header:"); ok {
+		return req.Header.Get(header), true
+	}
+	if param, ok := strings.CutPrefix(name, "query:"); ok {
+		return req.URL.Query().Get(param), true
+	}
+	if name, ok := strings.CutPrefix(name, "context:"); ok {
+		keys, _ := req.Context().Value(contextKeysKey{}).(map[string]any)
+		key, registered := keys[name]
+		if !registered {
+			return "", false
+		}
+		return contextString(req.Context(), key), true
+	}
+	return "", false
+}
+
+// contextKeysKey is the context key under which client attaches the
+// WithContextKey registrations, for %{context:name}.
+type contextKeysKey struct{}
+
+// contextString returns the value stored under key in ctx as a string, or ""
+// when there is none.
+func contextString(ctx context.Context, key any) string {
+	switch v := ctx.Value(key).(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ContextKeyFunc returns a KeyFunc that buckets requests by the value stored
+// under key in the request context, such as the user ID an authentication
+// middleware attached, prefixed with prefix: ContextKeyFunc("user:",
+// userIDKey{}) keys a request for user 42 as "user:42". Requests without the
+// value, such as anonymous ones, skip the rule; cover them with an IP-keyed
+// rule.
+func ContextKeyFunc(prefix string, key any) func(*http.Request) string {
+	return func(req *http.Request) string {
+		v := contextString(req.Context(), key)
+		if v == "" {
+			return ""
+		}
+		return prefix + v
+	}
 }
@@ -0,0 +1,184 @@
+package rackattack
+
+import (
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchPath(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"", "/anything", true},
+		{"/login", "/login", true},
+		{"/login", "/login/", true},
+		{"/login", "/logins", false},
+		{"/api/*", "/api", true},
+		{"/api/*", "/api/v1/users", true},
+		{"/api/*", "/apix", false},
+		{"/*", "/x/y", true},
+		// Single-segment wildcards in the middle of a path.
+		{"/users/*/settings", "/users/42/settings", true},
+		{"/users/*/settings", "/users/42/43/settings", false},
+		{"/users/*/settings", "/users/settings", false},
+		{"/api/*/admin/*/edit", "/api/v1/admin/7/edit", true},
+		{"/api/v*/users", "/api/v2/users", true},
+		// Multi-segment wildcards.
+		{"/api/**/admin", "/api/admin", true},
+		{"/api/**/admin", "/api/v1/tenants/9/admin", true},
+		{"/api/**/admin", "/api/v1/admin/x", false},
+		{"/api/**", "/api", true},
+		{"/api/**", "/api/a/b/c", true},
+		{"/**/secret", "/a/b/secret", true},
+		{"/**/*.php", "/wp/admin/setup.php", true},
+		{"/**/*.php", "/wp/admin/setup.html", false},
+		// The literal segments before a wildcard must match.
+		{"/api/v*/users", "/apix/v2/users", false},
+		{"/api/**", "/apix/a", false},
+		{"/a/b/*.json", "/a/b", false},
+		{"x*", "xyz", true},
+		// A wildcard without a slash before it stays within its segment.
+		{"/api*", "/api", true},
+		{"/api*", "/apix", true},
+		{"/api*", "/api/users", false},
+		{"/files/*.json", "/files/report.json", true},
+		{"/files/*.json", "/files/report.csv", false},
+		{"/files/*.json", "/files/2024/report.json", false},
+		// The request path is cleaned, so a wildcard pattern's trailing slash
+		// matches nothing unless the rule sets IgnoreTrailingSlash.
+		{"/api/", "/api", true},
+		{"/api/", "/api/", true},
+		{"/users/*/", "/users/42", false},
+		{"/users/*/", "/users/42/", false},
+		{"/users/*/settings/", "/users/42/settings", false},
+		{"/api/**/admin/", "/api/v1/admin/", false},
+		// Matching is case-sensitive unless the rule opts out.
+		{"/api/*", "/API/users", false},
+		// Traversal is cleaned before matching.
+		{"/admin/*", "/public/../admin/panel", true},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, matchPath(tc.pattern, tc.path), "%q vs %q", tc.pattern, tc.path)
+
+		// A registered rule matches through its compiled pattern.
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = tc.path
+		rule := ThrottleRule{PathPattern: tc.pattern}.compiled()
+		assert.Equal(t, tc.want, rule.matches(r), "compiled %q vs %q", tc.pattern, tc.path)
+	}
+}
+
+func TestIgnoreTrailingSlash(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/users/*/", "/users/42", true},
+		{"/users/*/", "/users/42/", true},
+		{"/users/*/", "/users/42/settings", true}, // trimmed to the subtree "/users/*"
+		{"/users/*/settings/", "/users/42/settings", true},
+		{"/api/**/admin/", "/api/v1/admin/", true},
+		{"/api/*/", "/api/v1", true},
+		{"/", "/", true},
+		{"/", "/x", false},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = tc.path
+		rule := ThrottleRule{PathPattern: tc.pattern, IgnoreTrailingSlash: true}
+		assert.Equal(t, tc.want, rule.matches(r), "%q vs %q", tc.pattern, tc.path)
+		assert.Equal(t, tc.want, rule.compiled().matches(r), "compiled %q vs %q", tc.pattern, tc.path)
+	}
+}
+
+func TestCheckPathPattern(t *testing.T) {
+	for _, pattern := range []string{"", "/api/*", "/api*", "/files/*.json", "/api/**/admin", "/v[12]/*"} {
+		assert.NoError(t, checkPathPattern(pattern), pattern)
+	}
+	for _, pattern := range []string{"/api/[", "/files/[a-/x", "/api**", "/a/**b/c"} {
+		assert.Error(t, checkPathPattern(pattern), pattern)
+	}
+}
+
+func TestCheckHostPattern(t *testing.T) {
+	for _, pattern := range []string{"", "api.example.com", "*.example.com", "api-[12].example.com"} {
+		assert.NoError(t, checkHostPattern(pattern), pattern)
+	}
+	for _, pattern := range []string{"[.example.com", "api-[a-.example.com", `api\`} {
+		assert.ErrorIs(t, checkHostPattern(pattern), path.ErrBadPattern, pattern)
+	}
+}
+
+func TestExpandKey(t *testing.T) {
+	r := httptest.NewRequest("POST", "/v1/orders?tenant=acme&page=2", nil)
+	r.Header.Set("X-Api-Key", "k-123")
+	r.Host = "Acme.example.com:443"
+
+	cases := []struct {
+		template, want string
+	}{
+		{"static", "static"},
+		{"ip:%{ip}", "ip:1.2.3.4"},
+		{"%{ip}:%{path}:%{method}", "1.2.3.4:/v1/orders:POST"},
+		{"host:%{host}", "host:acme.example.com"},
+		{"key:%{header:X-Api-Key}", "key:k-123"},
+		{"key:%{header:x-api-key}", "key:k-123"},
+		{"missing:%{header:Authorization}", "missing:"},
+		{"tenant:%{query:tenant}", "tenant:acme"},
+		{"tenant:%{query:missing}", "tenant:"},
+		{"unknown:%{nope}:%{ip}", "unknown:%{nope}:1.2.3.4"},
+		{"unterminated:%{ip", "unterminated:%{ip"},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, expandKey(tc.template, "1.2.3.4", r), tc.template)
+	}
+}
+
+func TestPerClientKey(t *testing.T) {
+	for template, want := range map[string]bool{
+		"static":                   false,
+		"api:%{path}:%{method}":    false,
+		"unknown:%{nope}":          false,
+		"unterminated:%{ip":        false,
+		"api:%{ip}":                true,
+		"%{path}:%{header:X-User}": true,
+		"tenant:%{query:tenant}":   true,
+	} {
+		assert.Equal(t, want, perClientKey(template), template)
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	cases := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"", "anything.test", true},
+		{"api.example.com", "api.example.com", true},
+		{"API.Example.com", "api.example.com", true},
+		{"api.example.com", "www.example.com", false},
+		{"*.example.com", "acme.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "acme.example.org", false},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, matchHost(tc.pattern, tc.host), "%q vs %q", tc.pattern, tc.host)
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	for host, want := range map[string]string{
+		"Acme.Example.com":      "acme.example.com",
+		"acme.example.com:8443": "acme.example.com",
+		"example.com.":          "example.com",
+		"[::1]:8080":            "::1",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		assert.Equal(t, want, requestHost(r), host)
+	}
+}
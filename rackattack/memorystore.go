@@ -0,0 +1,452 @@
+package rackattack
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval bounds how often MemoryStore scans for expired entries. Expiry
+// is otherwise lazy, so keys that are never touched again would linger.
+const sweepInterval = time.Minute
+
+// MemoryStore is an in-process Store, for tests and single-node deployments.
+// State is not shared between processes and is lost on restart. It mirrors
+// RedisStore's semantics: the same throttle algorithms and the same Fail2Ban
+// strike/ban engine.
+type MemoryStore struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	windows   map[string]*memWindow
+	counters  map[string]*memCounter
+	tats      map[string]time.Time
+	leaks     map[string]*memLeak
+	distinct  map[string]*memSet
+	strikes   map[string]*memCounter
+	bans      map[string]time.Time
+	levels    map[string]*memCounter
+	lastSweep time.Time
+}
+
+// memWindow is a sliding-window log: hit timestamps in arrival order.
+type memWindow struct {
+	hits    []time.Time
+	expires time.Time
+}
+
+// memCounter is a fixed-window or strike counter that resets once expires
+// passes.
+type memCounter struct {
+	count   int
+	expires time.Time
+}
+
+// memLeak is a leaky bucket: its level when last drained, at last. It has
+// drained empty by expires.
+type memLeak struct {
+	level   float64
+	last    time.Time
+	expires time.Time
+}
+
+// memSet holds the values a Distinct key has seen in its current window. It
+// counts them exactly, where RedisStore estimates.
+type memSet struct {
+	members map[string]struct{}
+	expires time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		now:      time.Now,
+		windows:  make(map[string]*memWindow),
+		counters: make(map[string]*memCounter),
+		tats:     make(map[string]time.Time),
+		leaks:    make(map[string]*memLeak),
+		distinct: make(map[string]*memSet),
+		strikes:  make(map[string]*memCounter),
+		bans:     make(map[string]time.Time),
+		levels:   make(map[string]*memCounter),
+	}
+}
+
+func (s *MemoryStore) setClock(c Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = c.Now
+}
+
+// Throttle implements Store.
+func (s *MemoryStore) Throttle(_ context.Context, key string, q Quota) (Result, error) {
+	if err := q.check(); err != nil {
+		return Result{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.sweep(now)
+
+	switch q.Algorithm {
+	case SlidingWindow:
+		return s.throttleSliding(now, key, q.Limit, q.Period, q.cost()), nil
+	case FixedWindow:
+		return s.throttleFixed(now, key, q.Limit, q.window(), q.cost()), nil
+	case TokenBucket:
+		return s.throttleGCRA(now, key, q), nil
+	case LeakyBucket:
+		return s.throttleLeaky(now, key, q), nil
+	case Distinct:
+		return s.throttleDistinct(now, key, q), nil
+	default:
+		return Result{}, errUnknownAlgorithm
+	}
+}
+
+func (s *MemoryStore) throttleSliding(now time.Time, key string, limit int, period time.Duration, cost int) Result {
+	w := s.windows[key]
+	if w == nil {
+		w = &memWindow{}
+		s.windows[key] = w
+	}
+	// Drop hits at or before now-period, matching ZREMRANGEBYSCORE 0..cutoff.
+	cutoff := now.Add(-period)
+	i := 0
+	for i < len(w.hits) && !w.hits[i].After(cutoff) {
+		i++
+	}
+	w.hits = w.hits[i:]
+
+	limited := len(w.hits)+cost > limit
+	if !limited {
+		for i := 0; i < cost; i++ {
+			w.hits = append(w.hits, now)
+		}
+		w.expires = now.Add(period)
+	}
+
+	oldest := now
+	if len(w.hits) > 0 {
+		oldest = w.hits[0]
+	}
+	reset := max(period-now.Sub(oldest), 0)
+	result := Result{
+		Limit:     limit,
+		Limited:   limited,
+		Remaining: max(limit-len(w.hits), 0),
+		Reset:     reset,
+	}
+	if limited {
+		result.Remaining = 0
+		result.RetryAfter = reset
+	}
+	return result
+}
+
+func (s *MemoryStore) throttleFixed(now time.Time, key string, limit int, period time.Duration, cost int) Result {
+	c := s.counters[key]
+	if c == nil || !now.Before(c.expires) {
+		c = &memCounter{expires: now.Add(period)}
+		s.counters[key] = c
+	}
+	limited := c.count+cost > limit
+	if !limited {
+		c.count += cost
+	}
+
+	reset := c.expires.Sub(now)
+	result := Result{
+		Limit:     limit,
+		Limited:   limited,
+		Remaining: max(limit-c.count, 0),
+		Reset:     reset,
+	}
+	if limited {
+		result.RetryAfter = reset
+	}
+	return result
+}
+
+// throttleGCRA mirrors gcraScript: tats holds each key's theoretical arrival
+// time, which doubles as its expiry.
+func (s *MemoryStore) throttleGCRA(now time.Time, key string, q Quota) Result {
+	interval := q.Period / time.Duration(q.Limit)
+	burst := q.burst()
+
+	tat, ok := s.tats[key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+	newTat := tat.Add(mulDuration(interval, q.cost()))
+	allowAt := newTat.Add(-mulDuration(interval, burst))
+
+	if now.Before(allowAt) {
+		return Result{
+			Limited:    true,
+			Limit:      burst,
+			RetryAfter: allowAt.Sub(now),
+			Reset:      tat.Sub(now),
+		}
+	}
+	s.tats[key] = newTat
+	return Result{
+		Limit:     burst,
+		Remaining: int(now.Sub(allowAt) / interval),
+		Reset:     newTat.Sub(now),
+	}
+}
+
+// throttleLeaky mirrors leakyScript.
+func (s *MemoryStore) throttleLeaky(now time.Time, key string, q Quota) Result {
+	b := s.leaks[key]
+	if b == nil {
+		b = &memLeak{last: now}
+		s.leaks[key] = b
+	}
+	b.level = leakyLevel(b.level, b.last, now, q)
+	b.last = now
+	limited := b.level+float64(q.cost()) > float64(q.burst())
+	if !limited {
+		b.level += float64(q.cost())
+	}
+	res := leakyResult(b.level, limited, q)
+	b.expires = now.Add(res.Reset)
+	return res
+}
+
+func (s *MemoryStore) throttleDistinct(now time.Time, key string, q Quota) Result {
+	set := s.distinct[key]
+	if set == nil || !now.Before(set.expires) {
+		set = &memSet{members: make(map[string]struct{}), expires: now.Add(q.Period)}
+		s.distinct[key] = set
+	}
+	// Once over the limit, the set only needs to stay there: no new member
+	// changes the answer, so none is kept.
+	if len(set.members) <= q.Limit {
+		set.members[q.Member] = struct{}{}
+	}
+	return distinctResult(len(set.members), set.expires.Sub(now), q)
+}
+
+// Peek implements Store.
+func (s *MemoryStore) Peek(_ context.Context, key string, q Quota) (Result, error) {
+	if err := q.check(); err != nil {
+		return Result{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	var count int
+	var reset time.Duration
+	switch q.Algorithm {
+	case SlidingWindow:
+		oldest := now
+		if w := s.windows[key]; w != nil {
+			cutoff := now.Add(-q.Period)
+			for _, hit := range w.hits {
+				if hit.After(cutoff) {
+					if count == 0 {
+						oldest = hit
+					}
+					count++
+				}
+			}
+		}
+		reset = max(q.Period-now.Sub(oldest), 0)
+	case FixedWindow:
+		if c := s.counters[key]; c != nil && now.Before(c.expires) {
+			count = c.count
+			reset = c.expires.Sub(now)
+		}
+	case TokenBucket:
+		tat, ok := s.tats[key]
+		if !ok {
+			tat = now
+		}
+		return peekGCRA(now, tat, q), nil
+	case LeakyBucket:
+		var level float64
+		if b := s.leaks[key]; b != nil {
+			level = leakyLevel(b.level, b.last, now, q)
+		}
+		return peekLeaky(level, q), nil
+	case Distinct:
+		if set := s.distinct[key]; set != nil && now.Before(set.expires) {
+			return distinctResult(len(set.members), set.expires.Sub(now), q), nil
+		}
+		return distinctResult(0, 0, q), nil
+	default:
+		return Result{}, errUnknownAlgorithm
+	}
+
+	result := Result{
+		Limit:     q.Limit,
+		Limited:   count+q.cost() > q.Limit,
+		Remaining: max(q.Limit-count, 0),
+		Reset:     reset,
+	}
+	if result.Limited {
+		result.RetryAfter = reset
+	}
+	return result, nil
+}
+
+// Strike implements Store.
+func (s *MemoryStore) Strike(_ context.Context, key string, p BanPolicy) (bool, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.sweep(now)
+
+	if s.bannedLocked(key, now) {
+		return true, s.levelLocked(key, now), nil
+	}
+
+	c := s.strikes[key]
+	if c == nil || !now.Before(c.expires) {
+		c = &memCounter{expires: now.Add(p.FindTime)}
+		s.strikes[key] = c
+	}
+	c.count++
+
+	if c.count < p.MaxRetry {
+		return false, s.levelLocked(key, now), nil
+	}
+	banTime, level := p.BanTime, 0
+	if p.Backoff > 1 {
+		level = s.levelLocked(key, now) + 1
+		banTime = p.banTime(level)
+		s.levels[key] = &memCounter{count: level, expires: now.Add(mulDuration(banTime, 2))}
+	}
+	s.bans[key] = now.Add(banTime)
+	delete(s.strikes, key)
+	return true, level, nil
+}
+
+// Banned implements Store.
+func (s *MemoryStore) Banned(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bannedLocked(key, s.now()), nil
+}
+
+// Reset implements Store.
+func (s *MemoryStore) Reset(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, inWindows := s.windows[key]
+	_, inCounters := s.counters[key]
+	_, inTats := s.tats[key]
+	_, inLeaks := s.leaks[key]
+	_, inDistinct := s.distinct[key]
+	delete(s.windows, key)
+	delete(s.counters, key)
+	delete(s.tats, key)
+	delete(s.leaks, key)
+	delete(s.distinct, key)
+	return inWindows || inCounters || inTats || inLeaks || inDistinct, nil
+}
+
+// Ban implements Store.
+func (s *MemoryStore) Ban(_ context.Context, key string, banTime time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[key] = s.now().Add(banTime)
+	return nil
+}
+
+// ResetAll implements ResetAllStore. The store holds only this process's
+// state, so an empty prefix clears everything.
+func (s *MemoryStore) ResetAll(_ context.Context, prefix string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return deletePrefix(s.windows, prefix) + deletePrefix(s.counters, prefix) +
+		deletePrefix(s.tats, prefix) + deletePrefix(s.leaks, prefix) +
+		deletePrefix(s.distinct, prefix) + deletePrefix(s.strikes, prefix) +
+		deletePrefix(s.bans, prefix) + deletePrefix(s.levels, prefix), nil
+}
+
+// deletePrefix deletes the entries of m whose key begins with prefix and
+// returns how many there were.
+func deletePrefix[V any](m map[string]V, prefix string) int {
+	var n int
+	for k := range m {
+		if strings.HasPrefix(k, prefix) {
+			delete(m, k)
+			n++
+		}
+	}
+	return n
+}
+
+// levelLocked returns key's current backoff level. The caller must hold s.mu.
+func (s *MemoryStore) levelLocked(key string, now time.Time) int {
+	if l := s.levels[key]; l != nil && now.Before(l.expires) {
+		return l.count
+	}
+	return 0
+}
+
+// BanTTL implements BanTTLStore.
+func (s *MemoryStore) BanTTL(_ context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return max(s.bans[key].Sub(s.now()), 0), nil
+}
+
+func (s *MemoryStore) bannedLocked(key string, now time.Time) bool {
+	until, ok := s.bans[key]
+	return ok && now.Before(until)
+}
+
+// sweep evicts expired entries at most once per sweepInterval. The caller must
+// hold s.mu.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for k, w := range s.windows {
+		if !now.Before(w.expires) {
+			delete(s.windows, k)
+		}
+	}
+	for k, c := range s.counters {
+		if !now.Before(c.expires) {
+			delete(s.counters, k)
+		}
+	}
+	for k, tat := range s.tats {
+		if !now.Before(tat) {
+			delete(s.tats, k)
+		}
+	}
+	for k, b := range s.leaks {
+		if !now.Before(b.expires) {
+			delete(s.leaks, k)
+		}
+	}
+	for k, set := range s.distinct {
+		if !now.Before(set.expires) {
+			delete(s.distinct, k)
+		}
+	}
+	for k, c := range s.strikes {
+		if !now.Before(c.expires) {
+			delete(s.strikes, k)
+		}
+	}
+	for k, l := range s.levels {
+		if !now.Before(l.expires) {
+			delete(s.levels, k)
+		}
+	}
+	for k, until := range s.bans {
+		if !now.Before(until) {
+			delete(s.bans, k)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package rackattack
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a manually advanced time source for store tests.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Unix(1_700_000_000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestMemoryStore() (*MemoryStore, *fakeClock) {
+	clock := newFakeClock()
+	s := NewMemoryStore()
+	s.now = clock.Now
+	return s, clock
+}
+
+func TestMemoryStoreThrottleSlidingWindow(t *testing.T) {
+	s, clock := newTestMemoryStore()
+	ctx := context.Background()
+
+	res, err := s.Throttle(ctx, "k", Quota{Limit: 2, Period: time.Minute})
+	require.NoError(t, err)
+	assert.False(t, res.Limited)
+	assert.Equal(t, 1, res.Remaining)
+	assert.Equal(t, time.Minute, res.Reset)
+
+	clock.Advance(30 * time.Second)
+	res, _ = s.Throttle(ctx, "k", Quota{Limit: 2, Period: time.Minute})
+	assert.False(t, res.Limited)
+	assert.Equal(t, 0, res.Remaining)
+
+	res, _ = s.Throttle(ctx, "k", Quota{Limit: 2, Period: time.Minute})
+	assert.True(t, res.Limited)
+	assert.Equal(t, 30*time.Second, res.RetryAfter)
+
+	// The first hit ages out; one slot frees, the second hit still counts.
+	clock.Advance(30 * time.Second)
+	res, _ = s.Throttle(ctx, "k", Quota{Limit: 2, Period: time.Minute})
+	assert.False(t, res.Limited)
+	res, _ = s.Throttle(ctx, "k", Quota{Limit: 2, Period: time.Minute})
+	assert.True(t, res.Limited)
+}
+
+func TestMemoryStoreThrottleFixedWindow(t *testing.T) {
+	s, clock := newTestMemoryStore()
+	ctx := context.Background()
+	q := Quota{Algorithm: FixedWindow, Limit: 2, Period: time.Minute}
+
+	_, _ = s.Throttle(ctx, "k", q)
+	clock.Advance(50 * time.Second)
+	res, _ := s.Throttle(ctx, "k", q)
+	assert.False(t, res.Limited)
+	assert.Equal(t, 10*time.Second, res.Reset)
+
+	res, _ = s.Throttle(ctx, "k", q)
+	assert.True(t, res.Limited)
+	assert.Equal(t, 10*time.Second, res.RetryAfter)
+
+	// The whole window resets at once.
+	clock.Advance(10 * time.Second)
+	res, _ = s.Throttle(ctx, "k", q)
+	assert.False(t, res.Limited)
+	assert.Equal(t, 1, res.Remaining)
+}
+
+func TestMemoryStoreThrottleTokenBucket(t *testing.T) {
+	s, clock := newTestMemoryStore()
+	ctx := context.Background()
+	// One token per second sustained, bursts of up to three.
+	q := Quota{Algorithm: TokenBucket, Limit: 1, Period: time.Second, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		res, _ := s.Throttle(ctx, "k", q)
+		require.False(t, res.Limited)
+		assert.Equal(t, i, res.Remaining)
+	}
+	res, _ := s.Throttle(ctx, "k", q)
+	assert.True(t, res.Limited)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 3*time.Second, res.Reset)
+
+	// One token refills per second.
+	clock.Advance(time.Second)
+	res, _ = s.Throttle(ctx, "k", q)
+	assert.False(t, res.Limited)
+	assert.Equal(t, 0, res.Remaining)
+	res, _ = s.Throttle(ctx, "k", q)
+	assert.True(t, res.Limited)
+
+	// A long idle period refills to Burst, never beyond.
+	clock.Advance(time.Hour)
+	res, _ = s.Throttle(ctx, "k", q)
+	assert.Equal(t, 2, res.Remaining)
+}
+
+func TestMemoryStoreThrottleLeakyBucket(t *testing.T) {
+	s, clock := newTestMemoryStore()
+	ctx := context.Background()
+	// Drains one hit per second, holds up to three.
+	q := Quota{Algorithm: LeakyBucket, Limit: 1, Period: time.Second, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		res, _ := s.Throttle(ctx, "k", q)
+		require.False(t, res.Limited)
+		assert.Equal(t, i, res.Remaining)
+	}
+	res, _ := s.Throttle(ctx, "k", q)
+	assert.True(t, res.Limited)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 3*time.Second, res.Reset, "the bucket is empty in three seconds")
+
+	// Half a second drains half a hit, which is not room for a whole one.
+	clock.Advance(500 * time.Millisecond)
+	res, _ = s.Throttle(ctx, "k", q)
+	assert.True(t, res.Limited)
+	assert.Equal(t, 500*time.Millisecond, res.RetryAfter)
+
+	clock.Advance(500 * time.Millisecond)
+	res, _ = s.Throttle(ctx, "k", q)
+	assert.False(t, res.Limited)
+	assert.Equal(t, 0, res.Remaining)
+
+	// The bucket never drains below empty.
+	clock.Advance(time.Hour)
+	res, _ = s.Throttle(ctx, "k", q)
+	assert.Equal(t, 2, res.Remaining)
+}
+
+func TestMemoryStoreThrottleDistinct(t *testing.T) {
+	s, clock := newTestMemoryStore()
+	ctx := context.Background()
+	q := Quota{Algorithm: Distinct, Limit: 2, Period: time.Minute}
+
+	var res Result
+	for _, m := range []string{"a", "b", "a"} {
+		q.Member = m
+		res, _ = s.Throttle(ctx, "k", q)
+		require.False(t, res.Limited, m)
+	}
+	assert.Equal(t, 0, res.Remaining, "a repeat value is not counted again")
+	q.Member = "c"
+	res, _ = s.Throttle(ctx, "k", q)
+	assert.True(t, res.Limited)
+	assert.Equal(t, time.Minute, res.RetryAfter)
+	res, _ = s.Peek(ctx, "k", q)
+	assert.True(t, res.Limited)
+	for i := 0; i < 100; i++ {
+		q.Member = strconv.Itoa(i)
+		res, _ = s.Throttle(ctx, "k", q)
+		assert.True(t, res.Limited)
+	}
+	assert.Len(t, s.distinct["k"].members, 3, "members past the limit are not kept")
+
+	clock.Advance(time.Minute)
+	res, _ = s.Throttle(ctx, "k", q)
+	assert.False(t, res.Limited, "a new window starts empty")
+	assert.Equal(t, 1, res.Remaining)
+}
+
+func TestMemoryStoreThrottleCost(t *testing.T) {
+	s, _ := newTestMemoryStore()
+	ctx := context.Background()
+	for _, alg := range []Algorithm{SlidingWindow, FixedWindow, TokenBucket, LeakyBucket} {
+		q := Quota{Algorithm: alg, Limit: 5, Period: time.Minute, Cost: 3}
+		res, _ := s.Throttle(ctx, "k", q)
+		assert.Equal(t, 2, res.Remaining, alg)
+		res, _ = s.Throttle(ctx, "k", q)
+		assert.True(t, res.Limited, alg)
+
+		q.Cost = 2
+		res, _ = s.Peek(ctx, "k", q)
+		assert.False(t, res.Limited, alg)
+		res, _ = s.Throttle(ctx, "k", q)
+		assert.False(t, res.Limited, alg)
+		assert.Equal(t, 0, res.Remaining, alg)
+		_, _ = s.Reset(ctx, "k")
+	}
+}
+
+func TestMemoryStoreReset(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	for _, alg := range []Algorithm{SlidingWindow, FixedWindow, TokenBucket, LeakyBucket} {
+		q := Quota{Algorithm: alg, Limit: 1, Period: time.Minute}
+		_, _ = s.Throttle(ctx, "k", q)
+		existed, err := s.Reset(ctx, "k")
+		require.NoError(t, err)
+		assert.True(t, existed, alg)
+		res, _ := s.Throttle(ctx, "k", q)
+		assert.False(t, res.Limited, alg)
+		_, _ = s.Reset(ctx, "k")
+	}
+	existed, _ := s.Reset(ctx, "missing")
+	assert.False(t, existed)
+}
+
+func TestMemoryStoreResetAll(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	q := Quota{Limit: 1, Period: time.Minute}
+	_, _ = s.Throttle(ctx, "a:k", q)
+	_, _ = s.Throttle(ctx, "b:k", q)
+	require.NoError(t, s.Ban(ctx, "a:ban", time.Hour))
+
+	n, err := s.ResetAll(ctx, "a:")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	banned, _ := s.Banned(ctx, "a:ban")
+	assert.False(t, banned)
+	res, _ := s.Peek(ctx, "b:k", q)
+	assert.True(t, res.Limited, "other keys are kept")
+
+	n, _ = s.ResetAll(ctx, "")
+	assert.Equal(t, 1, n)
+}
+
+func TestMemoryStoreUnknownAlgorithm(t *testing.T) {
+	s := NewMemoryStore()
+	_, err := s.Throttle(context.Background(), "k", Quota{Algorithm: Algorithm(99), Limit: 1, Period: time.Second})
+	assert.ErrorIs(t, err, errUnknownAlgorithm)
+}
+
+func TestMemoryStoreStrikeAndBan(t *testing.T) {
+	s, clock := newTestMemoryStore()
+	ctx := context.Background()
+
+	ban := BanPolicy{MaxRetry: 3, FindTime: time.Minute, BanTime: time.Hour}
+	for i := 0; i < 2; i++ {
+		banned, _, err := s.Strike(ctx, "login:1.2.3.4", ban)
+		require.NoError(t, err)
+		assert.False(t, banned)
+	}
+	banned, _, _ := s.Strike(ctx, "login:1.2.3.4", ban)
+	assert.True(t, banned)
+
+	banned, _ = s.Banned(ctx, "login:1.2.3.4")
+	assert.True(t, banned)
+
+	clock.Advance(time.Hour)
+	banned, _ = s.Banned(ctx, "login:1.2.3.4")
+	assert.False(t, banned)
+}
+
+func TestMemoryStoreBan(t *testing.T) {
+	s, clock := newTestMemoryStore()
+	ctx := context.Background()
+
+	require.NoError(t, s.Ban(ctx, "k", time.Minute))
+	banned, _, _ := s.Strike(ctx, "k", BanPolicy{MaxRetry: 5, FindTime: time.Minute, BanTime: time.Hour})
+	assert.True(t, banned, "an explicit ban short-circuits strikes")
+
+	clock.Advance(time.Minute)
+	banned, _ = s.Banned(ctx, "k")
+	assert.False(t, banned)
+}
+
+func TestMemoryStoreStrikesExpireAfterFindTime(t *testing.T) {
+	s, clock := newTestMemoryStore()
+	ctx := context.Background()
+
+	ban := BanPolicy{MaxRetry: 2, FindTime: time.Minute, BanTime: time.Hour}
+	_, _, _ = s.Strike(ctx, "k", ban)
+	clock.Advance(2 * time.Minute)
+	banned, _, _ := s.Strike(ctx, "k", ban)
+	assert.False(t, banned, "the first offense should have expired")
+}
+
+func TestMemoryStoreStrikeBackoff(t *testing.T) {
+	s, clock := newTestMemoryStore()
+	ctx := context.Background()
+	ban := BanPolicy{MaxRetry: 1, FindTime: time.Minute, BanTime: time.Minute, Backoff: 3, MaxBanTime: 5 * time.Minute}
+
+	for level, want := range []time.Duration{time.Minute, 3 * time.Minute, 5 * time.Minute} {
+		banned, got, err := s.Strike(ctx, "k", ban)
+		require.NoError(t, err)
+		require.True(t, banned)
+		assert.Equal(t, level+1, got)
+
+		clock.Advance(want - time.Second)
+		banned, _ = s.Banned(ctx, "k")
+		assert.True(t, banned, "ban %d should last %v", level+1, want)
+		clock.Advance(time.Second)
+	}
+
+	// Once the key stays clean for as long as its last ban, it starts over.
+	clock.Advance(5 * time.Minute)
+	_, got, _ := s.Strike(ctx, "k", ban)
+	assert.Equal(t, 1, got)
+}
+
+func TestMemoryStoreStrikeUncappedBackoff(t *testing.T) {
+	s, _ := newTestMemoryStore()
+	ctx := context.Background()
+	ban := BanPolicy{MaxRetry: 1, FindTime: time.Minute, BanTime: time.Hour, Backoff: 1e10}
+
+	for level := 1; level <= 32; level++ {
+		_, got, err := s.Strike(ctx, "k", ban)
+		require.NoError(t, err)
+		assert.Equal(t, level, got, "a saturated ban still remembers its level")
+		delete(s.bans, "k")
+	}
+}
+
+func TestMemoryStoreSweepEvictsIdleKeys(t *testing.T) {
+	s, clock := newTestMemoryStore()
+	ctx := context.Background()
+
+	_, _ = s.Throttle(ctx, "idle", Quota{Limit: 1, Period: time.Second})
+	_, _, _ = s.Strike(ctx, "idle", BanPolicy{MaxRetry: 5, FindTime: time.Second, BanTime: time.Second})
+	clock.Advance(2 * sweepInterval)
+	_, _ = s.Throttle(ctx, "other", Quota{Limit: 1, Period: time.Second})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.NotContains(t, s.windows, "idle")
+	assert.NotContains(t, s.strikes, "idle")
+}
+
+func TestMemoryStoreConcurrentThrottle(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := s.Throttle(ctx, "c", Quota{Limit: 10, Period: time.Minute})
+			if err == nil && !res.Limited {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 10, allowed)
+}
+
+func TestMemoryStoreFixedWindowJitter(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	q := Quota{Algorithm: FixedWindow, Limit: 1, Period: time.Minute, Jitter: 10 * time.Second}
+
+	resets := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		res, err := s.Throttle(ctx, strconv.Itoa(i), q)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, res.Reset, 50*time.Second)
+		assert.LessOrEqual(t, res.Reset, 70*time.Second)
+		resets[res.Reset] = true
+	}
+	assert.Greater(t, len(resets), 1, "windows should not all reset together")
+
+	// Jitter larger than the period never yields an already-expired window.
+	q = Quota{Algorithm: FixedWindow, Limit: 1, Period: time.Millisecond, Jitter: time.Hour}
+	for i := 0; i < 20; i++ {
+		assert.GreaterOrEqual(t, q.window(), time.Millisecond)
+	}
+}
+
+func TestMemoryStoreSlidingWindowIgnoresJitter(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	q := Quota{Algorithm: SlidingWindow, Limit: 1, Period: time.Minute, Jitter: 10 * time.Second}
+	for i := 0; i < 20; i++ {
+		res, err := s.Throttle(ctx, strconv.Itoa(i), q)
+		require.NoError(t, err)
+		assert.Equal(t, time.Minute, res.Reset)
+	}
+}
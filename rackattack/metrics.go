@@ -0,0 +1,13 @@
+package rackattack
+
+// Metrics receives one observation for every request Check evaluates without
+// error. It keeps the core free of any particular metrics library; adapt it
+// to Prometheus, OpenTelemetry, StatsD, etc. Implementations must be safe for
+// concurrent use and cheap, since they run on the request path.
+//
+// Useful labels are d.Reason.String() ("allowed", "throttled", ...),
+// d.RuleName, and, when d.Rule is non-nil, d.Rule.PathPattern and
+// d.Rule.Group.
+type Metrics interface {
+	ObserveDecision(d Decision)
+}
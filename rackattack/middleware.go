@@ -5,32 +5,166 @@ import (
 	"math"
 	"net/http"
 	"strconv"
+	"time"
 )
 
-// reasonContextKey is the type used to stash the deny Decision in the request
-// context so a custom denied-handler can inspect it.
+// RateLimitHeaders names the response headers Middleware uses to report
+// throttle state. An empty name suppresses that header.
+type RateLimitHeaders struct {
+	Limit     string
+	Remaining string
+	Reset     string
+	// UnixReset reports Reset as a Unix timestamp instead of delta seconds.
+	UnixReset bool
+	// Rule names a header, such as "X-RateLimit-Rule", carrying the name of
+	// the rule that denied the request, so a client reporting 429s can say
+	// which limit it hit. Only the name is sent, never the expanded key. It
+	// is empty in both predefined sets.
+	Rule string
+	// RuleAlways sets the Rule header on every response a throttle rule
+	// matched, naming the rule reported in the other headers, for debugging.
+	RuleAlways bool
+}
+
+var (
+	// DraftRateLimitHeaders are the IETF draft RateLimit-* headers, with Reset
+	// in delta seconds. This is the default.
+	DraftRateLimitHeaders = RateLimitHeaders{
+		Limit:     "RateLimit-Limit",
+		Remaining: "RateLimit-Remaining",
+		Reset:     "RateLimit-Reset",
+	}
+	// XRateLimitHeaders are the widely deployed X-RateLimit-* headers, with
+	// Reset as a Unix timestamp.
+	XRateLimitHeaders = RateLimitHeaders{
+		Limit:     "X-RateLimit-Limit",
+		Remaining: "X-RateLimit-Remaining",
+		Reset:     "X-RateLimit-Reset",
+		UnixReset: true,
+	}
+)
+
+// RetryAfterFormat selects how the Retry-After header expresses the wait.
+type RetryAfterFormat int
+
+const (
+	// RetryAfterSeconds sends the wait in whole seconds, rounded up, as in
+	// "Retry-After: 30". This is the default.
+	RetryAfterSeconds RetryAfterFormat = iota
+	// RetryAfterHTTPDate sends the time the client may retry as an HTTP-date,
+	// as in "Retry-After: Wed, 14 Oct 2026 07:28:00 GMT", for clients that
+	// parse only that form.
+	RetryAfterHTTPDate
+)
+
+// reasonContextKey is the type used to stash the Decision in the request
+// context so a denied-handler or the wrapped handler can inspect it.
 type reasonContextKey struct{}
 
-// DecisionFromContext returns the Decision that caused a request to be denied,
-// for use inside a handler registered via WithDeniedHandler. The second return
-// value is false if no decision is present.
+// DecisionFromContext returns the Decision Middleware made for req: inside a
+// handler registered via WithDeniedHandler, the one that denied it, and in
+// the wrapped handler, the one that let it through. The second return value
+// is false if no decision is present, as when the store failed.
 func DecisionFromContext(req *http.Request) (Decision, bool) {
 	d, ok := req.Context().Value(reasonContextKey{}).(Decision)
 	return d, ok
 }
 
+// ResultFromContext returns the throttle state of the rule with the least
+// headroom for the request Middleware let through with ctx, so a handler can
+// act on the remaining budget, say by skipping optional work for a client
+// near its limit. The second return value is false when no throttle rule
+// matched or no decision is present.
+func ResultFromContext(ctx context.Context) (Result, bool) {
+	d, ok := ctx.Value(reasonContextKey{}).(Decision)
+	if !ok || d.Rule == nil {
+		return Result{}, false
+	}
+	return d.Throttle, true
+}
+
 // Middleware wraps next with request filtering. Allowed requests pass through;
 // denied requests are handled by the configured denied-handler (default:
 // 403 for blocklist/ban, 429 with Retry-After for throttle). On a store error,
 // behavior follows the fail-open/fail-closed policy.
+//
+// Hits against rules with CountIf or StatusCost are recorded after next
+// returns, using the status it wrote.
+//
+// Whenever a throttle rule matched, the rate-limit headers (see
+// WithRateLimitHeaders) are set before the request is passed on or denied, so
+// they appear on successful responses too. The Decision is attached to the
+// request either way; see DecisionFromContext and ResultFromContext.
 func (ra *RedisRackAttack) Middleware(next http.Handler) http.Handler {
+	return NewMiddleware(ra)(next)
+}
+
+// MiddlewareOption customizes a middleware built by NewMiddleware. Each
+// overrides the corresponding instance-wide setting for that middleware only.
+type MiddlewareOption func(*middlewareConfig)
+
+type middlewareConfig struct {
+	onDenied        http.HandlerFunc
+	throttledStatus int
+	blockedStatus   int
+	failClosed      bool
+}
+
+// WithDeniedStatus sets the status codes of the default denied response: one
+// for throttled requests (default 429) and one for blocklisted or banned
+// requests (default 403). It has no effect when a denied handler is set.
+func WithDeniedStatus(throttled, blocked int) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.throttledStatus = throttled
+		c.blockedStatus = blocked
+	}
+}
+
+// WithDeniedResponse writes the response for denied requests, like
+// WithDeniedHandler. A rule's own DeniedHandler still takes precedence.
+func WithDeniedResponse(h http.HandlerFunc) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.onDenied = h
+	}
+}
+
+// WithMiddlewareFailClosed chooses whether store errors deny requests (503)
+// or let them through, like WithFailClosed. Errors from a rule with
+// FailClosed set deny either way.
+func WithMiddlewareFailClosed(closed bool) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.failClosed = closed
+	}
+}
+
+// NewMiddleware returns ra's request filter in the func(http.Handler)
+// http.Handler shape routers such as chi expect, e.g.
+// r.Use(rackattack.NewMiddleware(ra)). Without options it behaves exactly
+// like ra.Middleware.
+func NewMiddleware(ra *RedisRackAttack, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	cfg := middlewareConfig{
+		onDenied:        ra.onDenied,
+		throttledStatus: http.StatusTooManyRequests,
+		blockedStatus:   http.StatusForbidden,
+		failClosed:      ra.failClosed,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.onDenied == nil {
+		cfg.onDenied = statusDeniedHandler(cfg.throttledStatus, cfg.blockedStatus)
+	}
+	return func(next http.Handler) http.Handler {
+		return ra.middleware(next, cfg)
+	}
+}
+
+func (ra *RedisRackAttack) middleware(next http.Handler, cfg middlewareConfig) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		decision, err := ra.Check(req)
 		if err != nil {
-			if ra.onError != nil {
-				ra.onError(req, err)
-			}
-			if ra.failClosed {
+			ra.ReportError(req, err)
+			if cfg.failClosed || deniesOnError(err) {
 				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 				return
 			}
@@ -38,43 +172,147 @@ func (ra *RedisRackAttack) Middleware(next http.Handler) http.Handler {
 			return
 		}
 
+		ra.SetRateLimitHeaders(w.Header(), decision)
+		req = req.WithContext(context.WithValue(req.Context(), reasonContextKey{}, decision))
 		if decision.Allowed {
-			next.ServeHTTP(w, req)
+			creq, ip, deferred := ra.deferredRules(req)
+			if len(deferred) == 0 {
+				next.ServeHTTP(w, req)
+				return
+			}
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, req)
+			if err := ra.record(creq, ip, deferred, sw.status); err != nil {
+				ra.ReportError(req, err)
+			}
 			return
 		}
 
-		req = req.WithContext(context.WithValue(req.Context(), reasonContextKey{}, decision))
-		ra.onDenied(w, req)
+		if decision.Rule != nil && decision.Rule.DeniedHandler != nil {
+			decision.Rule.DeniedHandler(w, req)
+			return
+		}
+		cfg.onDenied(w, req)
 	})
 }
 
-// defaultDeniedHandler writes a sensible default response based on the deny
-// reason. Throttle denials include RateLimit-* and Retry-After headers.
-func defaultDeniedHandler(w http.ResponseWriter, req *http.Request) {
-	decision, ok := DecisionFromContext(req)
-	if !ok {
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		return
+// statusWriter captures the response status for Record.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statusDeniedHandler writes a plain-text denied response with the given
+// status codes, chosen by the deny reason. Rate-limit headers have already
+// been set by Middleware.
+func statusDeniedHandler(throttled, blocked int) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		status := blocked
+		if d, ok := DecisionFromContext(req); ok && d.Reason == ReasonThrottled {
+			status = throttled
+		}
+		http.Error(w, http.StatusText(status), status)
 	}
+}
+
+// ReportError passes a Check or Record error to the WithErrorHandler callback,
+// if any, and reports whether the request should be denied under the
+// fail-open/fail-closed policy or the failing rule's FailClosed. Adapters for
+// other frameworks use it to handle store errors the way Middleware does.
+func (ra *RedisRackAttack) ReportError(req *http.Request, err error) bool {
+	if ra.onError != nil {
+		ra.onError(req, err)
+	}
+	return ra.failClosed || deniesOnError(err)
+}
 
-	switch decision.Reason {
-	case ReasonThrottled:
-		setRateLimitHeaders(w, decision.Throttle)
-		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+// Decide evaluates req as Middleware would and returns the outcome for the
+// caller to write onto its own response: whether to serve the request, the
+// rate-limit and Retry-After headers to set, and the status to deny it with
+// (429 for a throttle, 403 for a blocklist hit or ban, 503 for a store error
+// that denies). For a request to serve, status is http.StatusOK; headers is
+// never nil. A store error goes to ReportError and is returned,
+// with allow following the fail-open/fail-closed policy. As with Check, call
+// Record once the response status is known if any rule sets CountIf or
+// StatusCost.
+func (ra *RedisRackAttack) Decide(req *http.Request) (allow bool, headers http.Header, status int, err error) {
+	headers = make(http.Header)
+	decision, err := ra.Check(req)
+	if err != nil {
+		if ra.ReportError(req, err) {
+			return false, headers, http.StatusServiceUnavailable, err
+		}
+		return true, headers, http.StatusOK, err
+	}
+	ra.SetRateLimitHeaders(headers, decision)
+	switch {
+	case decision.Allowed:
+		return true, headers, http.StatusOK, nil
+	case decision.Reason == ReasonThrottled:
+		return false, headers, http.StatusTooManyRequests, nil
 	default:
-		// Blocklisted or banned.
-		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false, headers, http.StatusForbidden, nil
 	}
 }
 
-// setRateLimitHeaders emits the de-facto RateLimit-* headers and Retry-After.
-func setRateLimitHeaders(w http.ResponseWriter, res Result) {
-	h := w.Header()
-	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
-	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
-	if res.RetryAfter > 0 {
-		seconds := max(int(math.Ceil(res.RetryAfter.Seconds())), 1)
-		h.Set("Retry-After", strconv.Itoa(seconds))
-		h.Set("RateLimit-Reset", strconv.Itoa(seconds))
+// SetRateLimitHeaders sets the configured rate-limit headers (see
+// WithRateLimitHeaders) for d on h, plus Retry-After when d was throttled or
+// banned by a throttle rule. It does nothing when no throttle rule matched,
+// or for a ban when the store is no BanTTLStore. Middleware calls it for every
+// request; adapters for other frameworks can call it on their own response
+// headers.
+func (ra *RedisRackAttack) SetRateLimitHeaders(h http.Header, d Decision) {
+	if d.Rule == nil || d.Throttle.Limit == 0 {
+		return
+	}
+	res := d.Throttle
+	names := ra.headers
+	if names.Limit != "" {
+		h.Set(names.Limit, strconv.Itoa(res.Limit))
 	}
+	if names.Remaining != "" {
+		h.Set(names.Remaining, strconv.Itoa(res.Remaining))
+	}
+	if names.Rule != "" && (!d.Allowed || names.RuleAlways) {
+		h.Set(names.Rule, d.RuleName)
+	}
+	if names.Reset != "" {
+		if names.UnixReset {
+			h.Set(names.Reset, strconv.FormatInt(ra.now().Add(res.Reset).Unix(), 10))
+		} else {
+			h.Set(names.Reset, strconv.Itoa(ceilSeconds(res.Reset)))
+		}
+	}
+	if res.Limited && res.RetryAfter > 0 {
+		wait := time.Duration(max(ceilSeconds(res.RetryAfter), 1)) * time.Second
+		if ra.retryAfter == RetryAfterHTTPDate {
+			h.Set("Retry-After", ra.now().Add(wait).UTC().Format(http.TimeFormat))
+		} else {
+			h.Set("Retry-After", strconv.Itoa(int(wait/time.Second)))
+		}
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
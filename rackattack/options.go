@@ -1,13 +1,21 @@
 package rackattack
 
 import (
+	"context"
 	"errors"
+	"log/slog"
 	"net"
 	"net/http"
+	"time"
 )
 
 var (
-	errNilStore = errors.New("rackattack: store must not be nil")
+	errNilStore                   = errors.New("rackattack: store must not be nil")
+	errTemporaryBlocklistDisabled = errors.New("rackattack: temporary blocklist not enabled (see WithTemporaryBlocklist)")
+	errNonPositiveTTL             = errors.New("rackattack: block duration must be positive")
+	errNonPositiveTimeout         = errors.New("rackattack: store timeout must be positive")
+	errNegativeRetries            = errors.New("rackattack: store retries must not be negative")
+	errSharedKey                  = errors.New("key has no per-client placeholder such as %{ip}; set SharedKey if one counter for all clients is intended")
 )
 
 // Option configures a RedisRackAttack at construction time.
@@ -33,6 +41,52 @@ func WithTrustedProxies(cidrs ...string) Option {
 	}
 }
 
+// WithTrustedProxyHops enables X-Forwarded-For parsing for a fixed chain of
+// hops proxies in front of the application: the client IP is the entry just
+// left of the hops right-most entries, which the proxies themselves added.
+// When the header has too few entries, the connection peer is used. The peer
+// is not checked, so use this only when the application is reachable solely
+// through those proxies; otherwise prefer WithTrustedProxies.
+func WithTrustedProxyHops(hops int) Option {
+	return func(ra *RedisRackAttack) error {
+		if hops < 0 {
+			return errors.New("rackattack: trusted proxy hops must not be negative")
+		}
+		ra.clientIP = proxyHopsClientIP(hops)
+		return nil
+	}
+}
+
+// WithGeoResolver resolves each request's client country through r, once per
+// evaluation, for CountryPattern rules, the %{country} placeholder, and
+// CountryFromRequest. Without it every country is unknown.
+func WithGeoResolver(r GeoResolver) Option {
+	return func(ra *RedisRackAttack) error {
+		ra.geo = r
+		return nil
+	}
+}
+
+// WithContextKey makes the %{context:name} key placeholder expand to the
+// value stored under key in the request context, so a throttle key can name
+// the user an authentication middleware attached, e.g.
+// WithContextKey("userID", userIDKey{}) with Key "user:%{context:userID}".
+// The value is expanded as a string via fmt.Sprint, and a missing value
+// expands to "". For a rule that should skip requests without the value,
+// use ContextKeyFunc instead.
+func WithContextKey(name string, key any) Option {
+	return func(ra *RedisRackAttack) error {
+		if name == "" || key == nil {
+			return errors.New("rackattack: context key name and key must be set")
+		}
+		if ra.contextKeys == nil {
+			ra.contextKeys = make(map[string]any)
+		}
+		ra.contextKeys[name] = key
+		return nil
+	}
+}
+
 // WithClientIPFunc overrides client IP resolution entirely. Use this for
 // environments where the IP comes from a known-good header set by your own
 // infrastructure (e.g. a cloud load balancer's True-Client-IP). You are
@@ -57,6 +111,29 @@ func WithDeniedHandler(h http.HandlerFunc) Option {
 	}
 }
 
+// WithRateLimitHeaders sets the header names Middleware uses to report
+// throttle state. The default is DraftRateLimitHeaders; pass
+// XRateLimitHeaders for the X-RateLimit-* convention.
+func WithRateLimitHeaders(h RateLimitHeaders) Option {
+	return func(ra *RedisRackAttack) error {
+		ra.headers = h
+		return nil
+	}
+}
+
+// WithRetryAfterFormat sets how Middleware and SetRateLimitHeaders write
+// Retry-After: RetryAfterSeconds (the default) or RetryAfterHTTPDate, the
+// current time plus the wait the rule reported.
+func WithRetryAfterFormat(f RetryAfterFormat) Option {
+	return func(ra *RedisRackAttack) error {
+		if f != RetryAfterSeconds && f != RetryAfterHTTPDate {
+			return errors.New("rackattack: unknown Retry-After format")
+		}
+		ra.retryAfter = f
+		return nil
+	}
+}
+
 // WithErrorHandler registers a callback invoked when the store returns an
 // error during Middleware evaluation. It does not affect the allow/deny
 // outcome (see WithFailClosed) but lets you log or emit metrics.
@@ -67,6 +144,55 @@ func WithErrorHandler(fn func(*http.Request, error)) Option {
 	}
 }
 
+// WithOnThrottled registers a callback invoked synchronously by Check each
+// time a request is throttled, with the rule that denied it. Start a goroutine
+// inside the callback if the work is slow.
+func WithOnThrottled(fn func(req *http.Request, rule ThrottleRule)) Option {
+	return func(ra *RedisRackAttack) error {
+		ra.onThrottled = fn
+		return nil
+	}
+}
+
+// WithOnBlocked registers a callback invoked synchronously by Check each time
+// a request is denied by the blocklist or a ban, with the resolved client IP.
+func WithOnBlocked(fn func(req *http.Request, ip string)) Option {
+	return func(ra *RedisRackAttack) error {
+		ra.onBlocked = fn
+		return nil
+	}
+}
+
+// WithMetrics registers a Metrics sink observed on every evaluated request.
+func WithMetrics(m Metrics) Option {
+	return func(ra *RedisRackAttack) error {
+		ra.metrics = m
+		return nil
+	}
+}
+
+// WithTracer starts a span around every request Check evaluates, recording
+// the decision, the deciding rule, and the time spent in the store (see
+// Tracer). Without it no spans are started.
+func WithTracer(t Tracer) Option {
+	return func(ra *RedisRackAttack) error {
+		ra.tracer = t
+		return nil
+	}
+}
+
+// WithLogger logs through l: each decision Check makes, with the client IP,
+// path, and deciding rule (denials at Info, everything else at Debug); each
+// matched throttle rule with its key, count, and limit (Debug); and store
+// errors (Warn). Without it nothing is logged, except the warning about
+// rules whose key is shared by every client, which goes to slog.Default.
+func WithLogger(l *slog.Logger) Option {
+	return func(ra *RedisRackAttack) error {
+		ra.logger = l
+		return nil
+	}
+}
+
 // WithFailClosed makes store errors deny the request (503). The default is
 // fail-open: if the backing store is unavailable, requests are allowed through
 // so a Redis outage does not take down the whole service.
@@ -76,3 +202,103 @@ func WithFailClosed() Option {
 		return nil
 	}
 }
+
+// WithTemporaryBlocklist enables BlocklistIPFor. Temporary blocks live in the
+// store, so they are shared by every instance using it and survive restarts;
+// the cost is one extra store lookup per non-safelisted request. Enable it on
+// every instance that should honor the blocks, not just the one creating them.
+func WithTemporaryBlocklist() Option {
+	return func(ra *RedisRackAttack) error {
+		ra.tempBlocklist = true
+		return nil
+	}
+}
+
+// WithStoreTimeout bounds every store call made while evaluating a request
+// to d, so a slow Redis cannot stall requests indefinitely. A call that times
+// out fails like any other store error, following the fail-open/fail-closed
+// policy. The request context's own deadline still applies.
+func WithStoreTimeout(d time.Duration) Option {
+	return func(ra *RedisRackAttack) error {
+		if d <= 0 {
+			return errNonPositiveTimeout
+		}
+		ra.storeTimeout = d
+		return nil
+	}
+}
+
+// WithStoreRetries retries a failed store call up to n more times, each
+// attempt with a fresh WithStoreTimeout budget, unless the request context is
+// already done. Retries ride out transient errors such as a failover, but a
+// throttle or strike whose reply was lost may be counted twice, so keep n
+// small.
+func WithStoreRetries(n int) Option {
+	return func(ra *RedisRackAttack) error {
+		if n < 0 {
+			return errNegativeRetries
+		}
+		ra.storeRetries = n
+		return nil
+	}
+}
+
+// WithKeyPrefix prepends prefix to every key the instance passes to its
+// store: throttle keys, Fail2Ban and ban keys, and temporary blocks. Use it to
+// keep apps that share one Redis apart without editing every rule's Key; a
+// trailing separator is recommended, e.g. "billing:". It works with any
+// Store, and composes with the prefix given to NewRedisStore. Keys passed to
+// ResetThrottle are prefixed too, so they are given as the rule expands them.
+func WithKeyPrefix(prefix string) Option {
+	return func(ra *RedisRackAttack) error {
+		ra.keyPrefix = prefix
+		return nil
+	}
+}
+
+// WithClock makes the bundled stores read the time from c, so tests can
+// advance time-based algorithms without sleeping. MemoryStore follows c
+// entirely; RedisStore uses it for the timestamps its scripts compare, but
+// Redis still expires keys on its own clock, which is all RedisCounterStore
+// goes by. The Unix timestamp of a UnixReset header, the RetryAfterHTTPDate
+// date, and StartRefiller's drain are read from c as well. It changes the
+// store passed to New, so give an instance with a clock a store of its own.
+// Custom stores are not affected.
+func WithClock(c Clock) Option {
+	return func(ra *RedisRackAttack) error {
+		if c == nil {
+			return errors.New("rackattack: clock must not be nil")
+		}
+		ra.clock = c
+		return nil
+	}
+}
+
+// WithContextFunc derives the context for the store calls made while
+// evaluating or counting a request (by Check, Middleware, Commit, and
+// Record) from the request, in place of req.Context(). Use it to attach a
+// base context's tracing baggage, or to detach store calls from client
+// cancellation with context.WithoutCancel.
+func WithContextFunc(fn func(*http.Request) context.Context) Option {
+	return func(ra *RedisRackAttack) error {
+		if fn == nil {
+			return errors.New("rackattack: context func must not be nil")
+		}
+		ra.contextFunc = fn
+		return nil
+	}
+}
+
+// WithStrictKeys makes Throttle, SetGlobalLimit, and LoadConfig reject a rule
+// whose Key has no per-client placeholder (%{ip}, %{header:Name},
+// %{query:name}, or %{context:name}) unless the rule sets SharedKey. Such a
+// key puts every client on one counter, so the first Limit requests
+// site-wide throttle everyone.
+// Without this option the rule is accepted and a warning is logged through
+// log/slog.
+func WithStrictKeys() Option {
+	return func(ra *RedisRackAttack) error {
+		ra.strictKeys = true
+		return nil
+	}
+}
@@ -0,0 +1,46 @@
+package rackattack
+
+import (
+	"context"
+	"time"
+)
+
+// prefixedStore prepends prefix to every key before passing it to the
+// wrapped Store, per WithKeyPrefix.
+type prefixedStore struct {
+	Store
+	prefix string
+}
+
+func (s *prefixedStore) Throttle(ctx context.Context, key string, q Quota) (Result, error) {
+	return s.Store.Throttle(ctx, s.prefix+key, q)
+}
+
+func (s *prefixedStore) Peek(ctx context.Context, key string, q Quota) (Result, error) {
+	return s.Store.Peek(ctx, s.prefix+key, q)
+}
+
+func (s *prefixedStore) Strike(ctx context.Context, key string, p BanPolicy) (bool, int, error) {
+	return s.Store.Strike(ctx, s.prefix+key, p)
+}
+
+func (s *prefixedStore) Banned(ctx context.Context, key string) (bool, error) {
+	return s.Store.Banned(ctx, s.prefix+key)
+}
+
+func (s *prefixedStore) Reset(ctx context.Context, key string) (bool, error) {
+	return s.Store.Reset(ctx, s.prefix+key)
+}
+
+func (s *prefixedStore) Ban(ctx context.Context, key string, banTime time.Duration) error {
+	return s.Store.Ban(ctx, s.prefix+key, banTime)
+}
+
+func (s *prefixedStore) Batch(ctx context.Context, ops []BatchOp) ([]Result, error) {
+	prefixed := make([]BatchOp, len(ops))
+	for i, op := range ops {
+		op.Key = s.prefix + op.Key
+		prefixed[i] = op
+	}
+	return runBatch(ctx, s.Store, prefixed)
+}
@@ -2,8 +2,8 @@
 // modeled on Ruby's Rack::Attack. It layers four policies, evaluated in
 // precedence order on every request:
 //
-//  1. Safelist  — always allow (IPs and CIDR ranges).
-//  2. Blocklist — always deny (IPs and CIDR ranges).
+//  1. Safelist  — always allow (IPs, CIDR ranges, and request predicates).
+//  2. Blocklist — always deny (IPs, CIDR ranges, and request predicates).
 //  3. Fail2Ban  — deny clients that have accumulated too many offenses.
 //  4. Throttle  — rate-limit by configurable per-rule keys.
 //
@@ -40,8 +40,19 @@
 package rackattack
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -63,32 +74,530 @@ const (
 	ReasonThrottled
 )
 
+// String returns a lower-case name for the reason, suitable for log fields
+// and metric labels.
+func (r ReasonKind) String() string {
+	switch r {
+	case ReasonNone:
+		return "allowed"
+	case ReasonSafelisted:
+		return "safelisted"
+	case ReasonBlocklisted:
+		return "blocklisted"
+	case ReasonBanned:
+		return "banned"
+	case ReasonThrottled:
+		return "throttled"
+	default:
+		return "unknown"
+	}
+}
+
 // Decision is the outcome of evaluating a request.
 type Decision struct {
 	// Allowed reports whether the request should proceed.
 	Allowed bool
 	// Reason explains the decision.
 	Reason ReasonKind
-	// RuleName is the matched throttle/ban rule's identifier, when applicable.
+	// RuleName identifies the matched rule, when applicable: the Fail2Ban
+	// rule's Name, or the throttle rule's Name (its Key when unnamed).
 	RuleName string
+	// Rule is the throttle rule behind Throttle: the rule that denied the
+	// request, or, for an allowed request, the matching rule with the least
+	// headroom. Nil when no throttle rule matched.
+	Rule *ThrottleRule
 	// Throttle carries rate-limit details when Reason is ReasonThrottled.
 	Throttle Result
+	// DryRun names the DryRun rules that would have throttled this request.
+	DryRun []string
+	// BanLevel is the backoff level of the rule's ban when this request
+	// was throttled: how many consecutive bans the key has earned, including
+	// one this request just triggered. It stays zero unless the rule's
+	// BanPolicy sets Backoff.
+	BanLevel int
 }
 
+// KeyScope generates a ThrottleRule's key for the common cases, in place of
+// a hand-written Key template. Each key begins with the rule's Name, so
+// rules with the same scope keep separate counters.
+type KeyScope int
+
+const (
+	// ScopeKey takes the key from Key or KeyFunc. This is the default.
+	ScopeKey KeyScope = iota
+	// ScopeIP counts each client IP: "Name:%{ip}".
+	ScopeIP
+	// ScopeIPPath counts each client IP on each path: "Name:%{ip}:%{path}".
+	ScopeIPPath
+	// ScopeIPPathMethod counts each client IP on each path and method:
+	// "Name:%{ip}:%{path}:%{method}".
+	ScopeIPPathMethod
+	// ScopeGlobal counts every client together under "Name", for a site-wide
+	// ceiling. It implies SharedKey.
+	ScopeGlobal
+)
+
 // ThrottleRule is a rate-limiting rule for matching requests.
 type ThrottleRule struct {
+	// Name identifies the rule in decisions and for RemoveThrottleRule. When
+	// empty, Key stands in for it.
+	Name string
 	// PathPattern matches the request path; supports glob wildcards (see
-	// path.Match semantics, extended so a trailing "/*" matches any subtree).
-	// Empty matches every path.
+	// path.Match semantics, extended so a trailing "/*" matches any subtree
+	// and a "**" segment matches any number of segments, so "/files/*.json"
+	// matches "/files/report.json" and "/api*" matches "/apix" but not
+	// "/api/x"). A malformed glob is rejected when the rule is added. Empty
+	// matches every path.
 	PathPattern string
-	// Method matches the HTTP method. Empty matches every method.
+	// PathRegex, when set, matches the cleaned request path instead of
+	// PathPattern; the two are mutually exclusive. Compile it once (e.g. with
+	// regexp.MustCompile) when building the rule. Anchor it with ^ and $ to
+	// match the whole path.
+	PathRegex *regexp.Regexp
+	// CaseInsensitivePath matches PathPattern regardless of case, so that on
+	// a case-insensitive router "/API/Users" cannot slip past "/api/*". For
+	// PathRegex, use the (?i) flag instead.
+	CaseInsensitivePath bool
+	// IgnoreTrailingSlash drops a trailing slash from PathPattern, so that
+	// "/users/*/" matches as "/users/*" does, the whole subtree. Request paths
+	// are cleaned, so without it a wildcard pattern ending in "/" matches
+	// nothing.
+	IgnoreTrailingSlash bool
+	// Method matches the HTTP method, case-insensitively. A comma-separated
+	// list such as "POST,PUT" matches any of its entries. Empty or "*"
+	// matches every method; pair "*" with a %{method} key to limit all
+	// methods with one rule while counting each separately.
 	Method string
-	// Key is the throttle key template. %{ip} and %{path} are expanded.
+	// HostPattern matches the request host, case-insensitively and ignoring
+	// any port. It may be a glob such as "*.example.com", which matches every
+	// subdomain. Empty matches every host.
+	HostPattern string
+	// CountryPattern matches the client's country, as resolved by
+	// WithGeoResolver: a comma-separated list of ISO country codes such as
+	// "CN,RU", compared case-insensitively. A request whose country is unknown
+	// never matches it. Empty matches every country.
+	CountryPattern string
+	// Key is the throttle key template. %{ip}, %{host}, %{country}, %{path},
+	// %{method}, %{header:Name}, %{query:name}, and %{context:name} (see
+	// WithContextKey) are expanded; a missing header, query parameter, or
+	// context value, or an unknown country, expands to "".
 	Key string
+	// KeyFunc, when set, derives the throttle key from the request in place
+	// of Key, for bucketing a template cannot express, such as a JWT subject
+	// combined with a path prefix. An empty result skips the rule for that
+	// request. Set Name when Key is empty, so the rule can be identified.
+	KeyFunc func(*http.Request) string
+	// KeyScope, when set, generates the key and takes precedence over Key,
+	// so the common per-IP, per-path, and per-method keys need no template.
+	// It requires Name and excludes KeyFunc.
+	KeyScope KeyScope
 	// Limit is the maximum number of requests allowed within Period.
 	Limit int
-	// Period is the sliding window length.
+	// MethodLimits overrides Limit for the listed HTTP methods, e.g.
+	// {"GET": 1000, "POST": 10}, keeping related limits in one rule. Method
+	// names match case-insensitively, and each listed method counts on its
+	// own key: Key with ":" and the upper-cased method appended. Other
+	// methods share Limit, or skip the rule when Limit is zero. The rule
+	// keeps a copy with the names upper-cased, as Rules reports them.
+	MethodLimits map[string]int
+	// Period is the window length.
 	Period time.Duration
+	// Interval, when set, replaces Limit, Period, and Algorithm with "at most
+	// one request per Interval": a request is throttled until Interval has
+	// passed since the last admitted one, as for debouncing webhooks. It is a
+	// FixedWindow of one hit, so the store keeps a single expiring key for
+	// it, and every request counts as one hit whatever its Cost.
+	Interval time.Duration
+	// Algorithm selects the counting strategy. The zero value is
+	// SlidingWindow.
+	Algorithm Algorithm
+	// Burst is the bucket capacity for TokenBucket and LeakyBucket; the
+	// sustained rate stays Limit per Period. Zero means Limit.
+	Burst int
+	// DistinctKey is the template, expanded like Key, whose distinct values
+	// the Distinct algorithm counts per key. With Key
+	// "token:%{header:X-Api-Token}" and Limit 50, a token used from more than
+	// 50 IPs within Period is throttled, flagging a shared credential. Empty
+	// means "%{ip}". Only Distinct rules may set it.
+	DistinctKey string
+	// ExpiryJitter randomizes each FixedWindow window by up to ±ExpiryJitter,
+	// so clients throttled together are not all let back in at the same
+	// instant. Zero disables it; other algorithms ignore it.
+	ExpiryJitter time.Duration
+	// Cost is how many hits each matching request counts as, for endpoints
+	// that are more expensive than others. Zero means 1.
+	Cost int
+	// CostFunc, when set, computes Cost per request, e.g. from the body
+	// size. Results below 1 count as 1.
+	CostFunc func(*http.Request) int
+	// ByteLimit counts each request as its body size, req.ContentLength, in
+	// place of Cost and CostFunc, so that Limit (and Burst) become a byte
+	// budget per Period, capping bandwidth rather than request rate. A
+	// request larger than the budget is always throttled. It needs an
+	// algorithm that counts in constant space: FixedWindow, TokenBucket, or
+	// LeakyBucket.
+	ByteLimit bool
+	// DefaultContentLength is how many bytes ByteLimit counts for a request
+	// of unknown length, such as a chunked upload. Zero counts it as 1.
+	DefaultContentLength int
+	// Ban escalates clients that keep getting throttled by this rule into a
+	// ban. The zero value disables it.
+	Ban BanPolicy
+	// DryRun counts hits and reports would-be throttles (via OnThrottled,
+	// Metrics, and Decision.DryRun) without denying anything, so a new limit
+	// can be tuned against real traffic. Ban is not applied in dry-run mode,
+	// and the rule never supplies Decision.Rule or rate-limit headers.
+	DryRun bool
+	// DeniedHandler, when set, writes Middleware's response for requests this
+	// rule throttles or bans, in place of the handler from WithDeniedHandler.
+	// DecisionFromContext exposes the rule and Retry-After details.
+	DeniedHandler http.HandlerFunc
+	// CountIf, when set, defers counting until the response is known: Check
+	// only tests whether the key is already over limit, and a hit is recorded
+	// afterwards (by Middleware, or by calling Record) if CountIf returns true
+	// for the response status. Use it to count only failed logins, say. Two
+	// requests in flight at once can both pass before either is recorded.
+	CountIf func(status int) bool
+	// StatusCost, when set, defers counting like CountIf, but weighs the hit
+	// by the response status: a request counts as StatusCost(status) hits,
+	// and as none when that is 0 or less. Use it so that requests failing
+	// through no fault of the client, such as 5xx responses, do not count
+	// against it. A weighted hit larger than the budget left fills the rest
+	// of it, so the client still runs out. It replaces Cost, CostFunc,
+	// ByteLimit, and CountIf.
+	StatusCost func(status int) int
+	// FailClosed denies matching requests (503 from Middleware, true from
+	// IsThrottled) when the store fails while evaluating this rule, even if
+	// the instance fails open. Use it for sensitive endpoints where letting
+	// traffic through unchecked is worse than an outage.
+	FailClosed bool
+	// SampleRate, between 0 and 1, applies the rule to only that fraction of
+	// matching requests, picked at random, so a new limit can be ramped from
+	// 1% of traffic to all of it while watching metrics; the rest skip the
+	// rule as though it did not match. Zero means 1: every request. Each of
+	// Check, Peek, Commit, and Record draws on its own, so Commit may count a
+	// rule that the Peek before it skipped, or skip one Peek applied.
+	SampleRate float64
+	// Group names the rule group the rule belongs to; AddRuleGroup sets it.
+	// Decisions carry it through Rule, for tagging logs and metrics by the
+	// team that owns the rule.
+	Group string
+	// Priority orders evaluation: rules with a higher Priority are evaluated
+	// first, and rules of equal Priority in registration order. It matters
+	// only with StopOnMatch.
+	Priority int
+	// StopOnMatch makes the rule, when it applies to a request, the last one
+	// evaluated for it: lower-priority rules, including the SetGlobalLimit
+	// rule, are skipped. Give a specific rule such as "/api/login" a higher
+	// Priority and StopOnMatch to override a broad "/api/*" one.
+	StopOnMatch bool
+	// Disabled turns the rule off without removing it: it matches no
+	// request until SetRuleEnabled turns it back on.
+	Disabled bool
+	// SharedKey acknowledges that Key has no per-client placeholder, so one
+	// counter is deliberately shared by every client, as for a site-wide
+	// ceiling. Without it such a rule is logged as a likely mistake, or
+	// rejected under WithStrictKeys.
+	SharedKey bool
+
+	// path is PathPattern compiled when the rule is registered, or nil for a
+	// rule that never was.
+	path *pathMatcher
+}
+
+// PerSecond returns r limited to n requests per second, setting Limit and
+// Period together, e.g. ThrottleRule{Key: "api:%{ip}"}.PerSecond(10).
+func (r ThrottleRule) PerSecond(n int) ThrottleRule {
+	r.Limit, r.Period = n, time.Second
+	return r
+}
+
+// PerMinute returns r limited to n requests per minute.
+func (r ThrottleRule) PerMinute(n int) ThrottleRule {
+	r.Limit, r.Period = n, time.Minute
+	return r
+}
+
+// PerHour returns r limited to n requests per hour.
+func (r ThrottleRule) PerHour(n int) ThrottleRule {
+	r.Limit, r.Period = n, time.Hour
+	return r
+}
+
+// throttleBanKey namespaces the ban state of a throttle key.
+func throttleBanKey(key string) string {
+	return "throttle:" + key
+}
+
+// name returns the rule's identifier for decisions and removal.
+func (r ThrottleRule) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Key
+}
+
+// matches reports whether the rule applies to req.
+func (r ThrottleRule) matches(req *http.Request) bool {
+	p := newRequestPath(req.URL.Path)
+	return r.matchesPath(req, &p)
+}
+
+// matchesPath is matches with req's path already cleaned into p, so that
+// evaluating many rules cleans it once.
+func (r ThrottleRule) matchesPath(req *http.Request, p *requestPath) bool {
+	if r.Disabled {
+		return false
+	}
+	if !matchMethod(r.Method, req.Method) {
+		return false
+	}
+	// Skip deriving the host and country for the many rules that ignore them.
+	if r.HostPattern != "" && !matchHost(r.HostPattern, requestHost(req)) ||
+		r.CountryPattern != "" && !matchCountry(r.CountryPattern, CountryFromRequest(req)) {
+		return false
+	}
+	if r.PathRegex != nil {
+		// Cleaning first keeps "/a/../admin" from slipping past a regex
+		// written for "/admin".
+		return r.PathRegex.MatchString(p.clean)
+	}
+	m := r.path
+	if m == nil {
+		compiled := r.compiledPath()
+		m = &compiled
+	}
+	if r.CaseInsensitivePath {
+		return m.match(p.folded())
+	}
+	return m.match(p.clean)
+}
+
+// compiledPath compiles PathPattern, lower-cased under CaseInsensitivePath
+// and without its trailing slash under IgnoreTrailingSlash.
+func (r ThrottleRule) compiledPath() pathMatcher {
+	pattern := r.PathPattern
+	if r.IgnoreTrailingSlash && len(pattern) > 1 {
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if r.CaseInsensitivePath {
+		pattern = strings.ToLower(pattern)
+	}
+	return compilePath(pattern)
+}
+
+// compiled returns a copy of the rule with its path pattern compiled and its
+// MethodLimits copied under upper-cased names.
+func (r ThrottleRule) compiled() ThrottleRule {
+	m := r.compiledPath()
+	r.path = &m
+	if r.MethodLimits != nil {
+		limits := make(map[string]int, len(r.MethodLimits))
+		for method, limit := range r.MethodLimits {
+			limits[strings.ToUpper(method)] = limit
+		}
+		r.MethodLimits = limits
+	}
+	return r
+}
+
+// sampled reports whether the rule applies to a request under SampleRate.
+func (r ThrottleRule) sampled() bool {
+	return r.SampleRate == 0 || r.SampleRate >= 1 || rand.Float64() < r.SampleRate
+}
+
+// validate reports the first setting that would make the rule misbehave at
+// runtime.
+func (r ThrottleRule) validate() error {
+	switch {
+	case r.KeyScope < ScopeKey || r.KeyScope > ScopeGlobal:
+		return errors.New("unknown key scope")
+	case r.KeyScope != ScopeKey && r.Name == "":
+		return errors.New("name must not be empty when the key comes from KeyScope")
+	case r.KeyScope != ScopeKey && r.KeyFunc != nil:
+		return errors.New("key scope and key func are mutually exclusive")
+	case r.KeyScope == ScopeKey && r.Key == "" && r.KeyFunc == nil:
+		return errors.New("key must not be empty")
+	case r.Key == "" && r.Name == "":
+		return errors.New("name must not be empty when the key comes from KeyFunc")
+	case r.Interval < 0:
+		return errors.New("interval must not be negative")
+	case r.Interval > 0 && (r.Limit != 0 || r.Period != 0 || len(r.MethodLimits) > 0):
+		return errors.New("interval replaces limit, period, and method limits")
+	case r.Interval == 0 && (r.Limit < 0 || r.Limit == 0 && len(r.MethodLimits) == 0):
+		return errors.New("limit must be positive")
+	case r.Interval == 0 && r.Period <= 0:
+		return errors.New("period must be positive")
+	case r.Algorithm < SlidingWindow || r.Algorithm > Distinct:
+		return errUnknownAlgorithm
+	case r.DistinctKey != "" && r.Algorithm != Distinct:
+		return errors.New("distinct key needs the Distinct algorithm")
+	case r.Algorithm == Distinct && (r.Cost != 0 || r.CostFunc != nil || r.ByteLimit):
+		return errors.New("the Distinct algorithm counts values, so it takes no cost, cost func, or byte limit")
+	case r.PathRegex != nil && r.PathPattern != "":
+		return errors.New("path pattern and path regex are mutually exclusive")
+	case checkPathPattern(r.PathPattern) != nil:
+		return checkPathPattern(r.PathPattern)
+	case checkHostPattern(r.HostPattern) != nil:
+		return checkHostPattern(r.HostPattern)
+	case r.ExpiryJitter < 0:
+		return errors.New("expiry jitter must not be negative")
+	case r.SampleRate < 0 || r.SampleRate > 1:
+		return errors.New("sample rate must be between 0 and 1")
+	case r.ByteLimit && r.Algorithm == SlidingWindow:
+		return errors.New("byte limits need FixedWindow, TokenBucket, or LeakyBucket, since a sliding window logs every byte")
+	case r.ByteLimit && (r.Cost != 0 || r.CostFunc != nil):
+		return errors.New("byte limits replace cost and cost func")
+	case r.DefaultContentLength < 0:
+		return errors.New("default content length must not be negative")
+	case r.StatusCost != nil && (r.Cost != 0 || r.CostFunc != nil || r.ByteLimit || r.CountIf != nil):
+		return errors.New("status cost replaces cost, cost func, byte limits, and count if")
+	case r.StatusCost != nil && r.Algorithm == Distinct:
+		return errors.New("the Distinct algorithm counts values, so it takes no status cost")
+	}
+	methods := make(map[string]bool, len(r.MethodLimits))
+	for method, limit := range r.MethodLimits {
+		if limit <= 0 {
+			return fmt.Errorf("limit for method %s must be positive", method)
+		}
+		method = strings.ToUpper(method)
+		if methods[method] {
+			return fmt.Errorf("method %s has more than one limit", method)
+		}
+		methods[method] = true
+	}
+	return nil
+}
+
+// checkRule validates rule, checks that the store can run its algorithm, and
+// checks that its key separates clients. A shared key is an error under
+// WithStrictKeys and a logged warning otherwise, unless the rule sets
+// SharedKey. Its errors match ErrRuleInvalid.
+func (ra *RedisRackAttack) checkRule(rule ThrottleRule) error {
+	if err := rule.validate(); err != nil {
+		return &invalidRuleError{err: err}
+	}
+	if ra.fixedWindow && rule.Interval == 0 && rule.Algorithm != FixedWindow {
+		return &invalidRuleError{err: fmt.Errorf("the store counts FixedWindow alone, not %s", rule.Algorithm)}
+	}
+	if rule.SharedKey || rule.KeyFunc != nil || rule.KeyScope == ScopeGlobal || perClientKey(rule.keyTemplate()) {
+		return nil
+	}
+	if ra.strictKeys {
+		return &invalidRuleError{err: errSharedKey}
+	}
+	logger := ra.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Warn("rackattack: throttle key has no per-client placeholder, so all clients share one counter",
+		"rule", rule.name(), "key", rule.keyTemplate())
+	return nil
+}
+
+// keyTemplate returns the rule's key template: the one KeyScope generates,
+// or Key.
+func (r ThrottleRule) keyTemplate() string {
+	switch r.KeyScope {
+	case ScopeIP:
+		return r.Name + ":%{ip}"
+	case ScopeIPPath:
+		return r.Name + ":%{ip}:%{path}"
+	case ScopeIPPathMethod:
+		return r.Name + ":%{ip}:%{path}:%{method}"
+	case ScopeGlobal:
+		return r.Name
+	}
+	return r.Key
+}
+
+// key returns the throttle key for req, whose client IP is ip. An empty key
+// means the rule does not apply to req.
+func (r ThrottleRule) key(ip string, req *http.Request) string {
+	limit, perMethod := r.limitFor(req.Method)
+	if limit == 0 && len(r.MethodLimits) > 0 {
+		return ""
+	}
+	var key string
+	if r.KeyFunc != nil {
+		key = r.KeyFunc(req)
+	} else {
+		key = expandKey(r.keyTemplate(), ip, req)
+	}
+	if perMethod && key != "" {
+		key += ":" + strings.ToUpper(req.Method)
+	}
+	return key
+}
+
+// limitFor returns the rule's limit for method, and whether it comes from
+// MethodLimits, whose names compiled has upper-cased.
+func (r ThrottleRule) limitFor(method string) (limit int, perMethod bool) {
+	if limit, ok := r.MethodLimits[strings.ToUpper(method)]; ok {
+		return limit, true
+	}
+	return r.Limit, false
+}
+
+// storeError marks err, a store failure while evaluating the rule, as denying
+// the request when the rule fails closed.
+func (r ThrottleRule) storeError(err error) error {
+	if r.FailClosed {
+		return &failClosedError{err: err}
+	}
+	return err
+}
+
+// quota returns the store-level limit for the rule when counting req, whose
+// client IP is ip.
+func (r ThrottleRule) quota(ip string, req *http.Request) Quota {
+	q := r.unitQuota(req)
+	if r.Interval > 0 {
+		return q
+	}
+	if r.Algorithm == Distinct {
+		q.Member = expandKey(cmp.Or(r.DistinctKey, "%{ip}"), ip, req)
+		return q
+	}
+	q.Cost = r.Cost
+	switch {
+	case r.ByteLimit && req.ContentLength >= 0:
+		q.Cost = int(min(req.ContentLength, math.MaxInt))
+	case r.ByteLimit:
+		q.Cost = r.DefaultContentLength
+	case r.CostFunc != nil:
+		q.Cost = r.CostFunc(req)
+	}
+	return q
+}
+
+// unitQuota returns the store-level limit for the rule at unit cost.
+func (r ThrottleRule) unitQuota(req *http.Request) Quota {
+	if r.Interval > 0 {
+		return Quota{Algorithm: FixedWindow, Limit: 1, Period: r.Interval, Jitter: r.ExpiryJitter}
+	}
+	limit, _ := r.limitFor(req.Method)
+	return Quota{Algorithm: r.Algorithm, Limit: limit, Period: r.Period, Burst: r.Burst, Jitter: r.ExpiryJitter}
+}
+
+// deferred reports whether the rule counts hits only once the response is
+// known, through CountIf or StatusCost.
+func (r ThrottleRule) deferred() bool {
+	return r.CountIf != nil || r.StatusCost != nil
+}
+
+// statusQuota returns the store-level limit for counting req, a deferred
+// rule's request that completed with status, and whether to count it at all.
+func (r ThrottleRule) statusQuota(ip string, req *http.Request, status int) (Quota, bool) {
+	q := r.quota(ip, req)
+	if r.StatusCost == nil {
+		return q, r.CountIf(status)
+	}
+	cost := r.StatusCost(status)
+	if r.Interval == 0 {
+		q.Cost = cost
+	}
+	return q, cost > 0
 }
 
 // Fail2BanRule bans a client after it triggers too many offenses. An offense
@@ -107,6 +616,32 @@ type Fail2BanRule struct {
 	MaxRetry int
 	FindTime time.Duration
 	BanTime  time.Duration
+
+	// path is PathPattern compiled by Fail2Ban, or nil for a rule that was
+	// never registered.
+	path *pathMatcher
+}
+
+// matches reports whether the rule applies to req.
+func (r Fail2BanRule) matches(req *http.Request) bool {
+	p := newRequestPath(req.URL.Path)
+	return r.matchesPath(req, &p)
+}
+
+// matchesPath is matches with req's path already cleaned into p.
+func (r Fail2BanRule) matchesPath(req *http.Request, p *requestPath) bool {
+	if !matchMethod(r.Method, req.Method) {
+		return false
+	}
+	if r.path == nil {
+		return matchPath(r.PathPattern, p.clean)
+	}
+	return r.path.match(p.clean)
+}
+
+// policy returns the rule's ban settings as a BanPolicy.
+func (r Fail2BanRule) policy() BanPolicy {
+	return BanPolicy{MaxRetry: r.MaxRetry, FindTime: r.FindTime, BanTime: r.BanTime}
 }
 
 // RedisRackAttack is the request filter. It is safe for concurrent use,
@@ -118,14 +653,48 @@ type RedisRackAttack struct {
 	onDenied   http.HandlerFunc
 	onError    func(*http.Request, error)
 	failClosed bool
+	headers    RateLimitHeaders
+	retryAfter RetryAfterFormat
+
+	onThrottled func(*http.Request, ThrottleRule)
+	onBlocked   func(*http.Request, string)
+	metrics     Metrics
+	tracer      Tracer
+	geo         GeoResolver
+	contextKeys map[string]any
+	logger      *slog.Logger
+	contextFunc func(*http.Request) context.Context
 
-	mu            sync.RWMutex
-	safelistIPs   map[string]struct{}
-	blocklistIPs  map[string]struct{}
-	safelistNets  []*net.IPNet
-	blocklistNets []*net.IPNet
-	throttleRules []ThrottleRule
-	fail2banRules []Fail2BanRule
+	tempBlocklist bool
+	strictKeys    bool
+	keyPrefix     string
+	clock         Clock
+	storeTimeout  time.Duration
+	storeRetries  int
+
+	// fixedWindow is set when the store counts FixedWindow alone, as
+	// RedisCounterStore does.
+	fixedWindow bool
+
+	closer    io.Closer
+	resetter  ResetAllStore
+	banTTLs   BanTTLStore
+	refill    *refiller
+	closeOnce sync.Once
+	closeErr  error
+
+	mu             sync.RWMutex
+	safelistIPs    map[string]struct{}
+	blocklistIPs   map[string]struct{}
+	safelistNets   []*net.IPNet
+	blocklistNets  []*net.IPNet
+	safelistPaths  []pathEntry
+	blocklistPaths []pathEntry
+	safelistIfs    []func(*http.Request) bool
+	blocklistIfs   []func(*http.Request) bool
+	throttleRules  []ThrottleRule
+	globalRule     *ThrottleRule
+	fail2banRules  []Fail2BanRule
 }
 
 // New creates a RedisRackAttack backed by the given Store. By default the
@@ -138,6 +707,7 @@ func New(store Store, opts ...Option) (*RedisRackAttack, error) {
 	ra := &RedisRackAttack{
 		store:        store,
 		clientIP:     directClientIP,
+		headers:      DraftRateLimitHeaders,
 		safelistIPs:  make(map[string]struct{}),
 		blocklistIPs: make(map[string]struct{}),
 	}
@@ -146,17 +716,89 @@ func New(store Store, opts ...Option) (*RedisRackAttack, error) {
 			return nil, err
 		}
 	}
-	if ra.onDenied == nil {
-		ra.onDenied = defaultDeniedHandler
+	ra.clientIP = knownClientIP(ra.clientIP)
+	_, ra.fixedWindow = ra.store.(*RedisCounterStore)
+	if ra.clock != nil {
+		if cs, ok := ra.store.(clockSetter); ok {
+			cs.setClock(ra.clock)
+		}
+	}
+	if c, ok := ra.store.(io.Closer); ok {
+		ra.closer = c
+	}
+	if r, ok := ra.store.(ResetAllStore); ok {
+		ra.resetter = r
+	}
+	if b, ok := ra.store.(BanTTLStore); ok {
+		ra.banTTLs = b
+	}
+	if d, ok := ra.store.(DecayStore); ok {
+		ra.refill = &refiller{store: d, now: ra.now, logger: ra.logger}
+	}
+	ra.store = &errorStore{Store: ra.store}
+	if ra.refill != nil {
+		ra.store = &refillStore{Store: ra.store, refill: ra.refill}
+	}
+	if ra.keyPrefix != "" {
+		ra.store = &prefixedStore{Store: ra.store, prefix: ra.keyPrefix}
+	}
+	if ra.storeTimeout > 0 || ra.storeRetries > 0 {
+		ra.store = &guardedStore{Store: ra.store, timeout: ra.storeTimeout, retries: ra.storeRetries}
+	}
+	if ra.tracer != nil {
+		ra.store = &timedStore{Store: ra.store}
 	}
 	return ra, nil
 }
 
-// SafelistIP adds an exact IP to the safelist.
-func (ra *RedisRackAttack) SafelistIP(ip string) {
+// Close releases ra's resources: it stops any background work and, if the
+// store implements io.Closer, closes it. The bundled stores do not, since the
+// caller owns the Redis client given to NewRedisStore. ra must not be used
+// after Close. Calling Close again returns the first call's result.
+func (ra *RedisRackAttack) Close() error {
+	ra.closeOnce.Do(func() {
+		if ra.refill != nil {
+			ra.refill.close()
+		}
+		if ra.closer != nil {
+			ra.closeErr = ra.closer.Close()
+		}
+	})
+	return ra.closeErr
+}
+
+// ResetAll deletes every counter, strike, ban, and temporary block ra's store
+// holds under its key prefix, the store's own prefix (as given to
+// NewRedisStore) plus any WithKeyPrefix, for test teardown and emergency
+// resets. RedisStore walks the keys with SCAN, so Redis keeps serving while
+// it runs, and other keys in the database are left alone; with no prefix at
+// all it refuses, returning ErrUnscopedReset, rather than delete keys it may
+// not own. MemoryStore holds only the state of the instances given it, so
+// there an empty prefix clears everything, including that of any other
+// instance sharing the store. The store must implement ResetAllStore.
+func (ra *RedisRackAttack) ResetAll(ctx context.Context) error {
+	if ra.resetter == nil {
+		return errors.New("rackattack: store does not implement ResetAllStore")
+	}
+	_, err := ra.resetter.ResetAll(ctx, ra.keyPrefix)
+	if errors.Is(err, ErrUnscopedReset) {
+		return err
+	}
+	return storeError("ResetAll", err)
+}
+
+// SafelistIP adds an exact IP to the safelist. The IP is normalized the way
+// client IPs are (surrounding space, brackets, and zones are stripped, and
+// IPv4-mapped IPv6 becomes IPv4), and an unparseable IP is an error.
+func (ra *RedisRackAttack) SafelistIP(ip string) error {
+	norm, err := parseListIP(ip)
+	if err != nil {
+		return err
+	}
 	ra.mu.Lock()
 	defer ra.mu.Unlock()
-	ra.safelistIPs = withKey(ra.safelistIPs, ip)
+	ra.safelistIPs = withKey(ra.safelistIPs, norm)
+	return nil
 }
 
 // SafelistCIDR adds a CIDR range to the safelist.
@@ -171,11 +813,63 @@ func (ra *RedisRackAttack) SafelistCIDR(cidr string) error {
 	return nil
 }
 
-// BlocklistIP adds an exact IP to the blocklist.
-func (ra *RedisRackAttack) BlocklistIP(ip string) {
+// privateNetworks are the ranges SafelistPrivateNetworks adds: loopback,
+// link-local, RFC 1918, and IPv6 unique local addresses.
+var privateNetworks = []string{
+	"127.0.0.0/8", "::1/128",
+	"169.254.0.0/16", "fe80::/10",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+	"fc00::/7",
+}
+
+// SafelistPrivateNetworks safelists loopback, link-local, RFC 1918, and IPv6
+// unique local ranges in one call, for development and internal traffic.
+// It is never on by default: behind NAT or a proxy without
+// WithTrustedProxies, every client can appear to come from a private
+// address. UnsafelistCIDR removes the ranges one at a time.
+func (ra *RedisRackAttack) SafelistPrivateNetworks() {
+	nets := make([]*net.IPNet, len(privateNetworks))
+	for i, cidr := range privateNetworks {
+		_, nets[i], _ = net.ParseCIDR(cidr)
+	}
 	ra.mu.Lock()
 	defer ra.mu.Unlock()
-	ra.blocklistIPs = withKey(ra.blocklistIPs, ip)
+	ra.safelistNets = append(ra.safelistNets, nets...)
+}
+
+// UnsafelistIP removes an exact IP from the safelist, normalized as in
+// SafelistIP.
+func (ra *RedisRackAttack) UnsafelistIP(ip string) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.safelistIPs = withoutKey(ra.safelistIPs, normalizeIP(ip))
+}
+
+// UnsafelistCIDR removes a CIDR range from the safelist. The range must be
+// given exactly as added (after normalization, so "10.1.2.3/8" removes
+// "10.0.0.0/8").
+func (ra *RedisRackAttack) UnsafelistCIDR(cidr string) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.safelistNets = withoutNet(ra.safelistNets, n)
+	return nil
+}
+
+// BlocklistIP adds an exact IP to the blocklist, normalized and validated as
+// in SafelistIP.
+func (ra *RedisRackAttack) BlocklistIP(ip string) error {
+	norm, err := parseListIP(ip)
+	if err != nil {
+		return err
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.blocklistIPs = withKey(ra.blocklistIPs, norm)
+	return nil
 }
 
 // BlocklistCIDR adds a CIDR range to the blocklist.
@@ -190,20 +884,448 @@ func (ra *RedisRackAttack) BlocklistCIDR(cidr string) error {
 	return nil
 }
 
-// Throttle registers a throttle rule.
-func (ra *RedisRackAttack) Throttle(rule ThrottleRule) {
+// BlocklistIPFor blocks ip for ttl via the store, so the block is honored by
+// every instance sharing it and expires on its own. It requires
+// WithTemporaryBlocklist.
+func (ra *RedisRackAttack) BlocklistIPFor(ctx context.Context, ip string, ttl time.Duration) error {
+	if !ra.tempBlocklist {
+		return errTemporaryBlocklistDisabled
+	}
+	if ttl <= 0 {
+		return errNonPositiveTTL
+	}
+	norm, err := parseListIP(ip)
+	if err != nil {
+		return err
+	}
+	return ra.store.Ban(ctx, tempBlockKey(norm), ttl)
+}
+
+// Track is Allow2Ban: it records one application-defined offense (a failed
+// login, a 404 scan) against discriminator, a client IP normalized as in
+// SafelistIP. Once limit offenses accumulate within period, discriminator is
+// blocked for banTime and Check denies its requests with ReasonBlocklisted.
+// It reports whether discriminator is now blocked. A non-positive limit,
+// period, or banTime is an error matching ErrRuleInvalid. Like
+// BlocklistIPFor, it requires WithTemporaryBlocklist.
+func (ra *RedisRackAttack) Track(ctx context.Context, discriminator string, limit int, period, banTime time.Duration) (bool, error) {
+	if !ra.tempBlocklist {
+		return false, errTemporaryBlocklistDisabled
+	}
+	if limit <= 0 || period <= 0 || banTime <= 0 {
+		return false, &invalidRuleError{err: errors.New("rackattack: track limit, period, and ban time must be positive")}
+	}
+	ip, err := parseListIP(discriminator)
+	if err != nil {
+		return false, err
+	}
+	banned, _, err := ra.store.Strike(ctx, tempBlockKey(ip),
+		BanPolicy{MaxRetry: limit, FindTime: period, BanTime: banTime})
+	return banned, err
+}
+
+// tempBlockKey is the store key marking a temporary block on ip.
+func tempBlockKey(ip string) string {
+	return "blocklist:" + ip
+}
+
+// IsBlocked reports whether ip, normalized as in SafelistIP, is blocklisted,
+// exactly or by a CIDR range. It reads only the in-memory lists: temporary
+// blocks live in the store, so use IsBlockedCtx to see them. Path-scoped
+// entries and BlocklistIf predicates, which need a request, are not
+// consulted.
+func (ra *RedisRackAttack) IsBlocked(ip string) bool {
+	ip = normalizeIP(ip)
+	if ip == "" {
+		return false
+	}
+	ra.mu.RLock()
+	defer ra.mu.RUnlock()
+	_, ok := ra.blocklistIPs[ip]
+	return ok || ipInNets(ip, ra.blocklistNets)
+}
+
+// IsBlockedCtx is like IsBlocked, but under WithTemporaryBlocklist it also
+// asks the store for a BlocklistIPFor or Track block, so it sees blocks made
+// by every instance sharing the store. ctx bounds that store call. An invalid
+// ip is an error.
+func (ra *RedisRackAttack) IsBlockedCtx(ctx context.Context, ip string) (bool, error) {
+	norm, err := parseListIP(ip)
+	if err != nil {
+		return false, err
+	}
+	if ra.IsBlocked(norm) {
+		return true, nil
+	}
+	if !ra.tempBlocklist {
+		return false, nil
+	}
+	return ra.store.Banned(ctx, tempBlockKey(norm))
+}
+
+// UnblocklistIP removes an exact IP from the blocklist, normalized as in
+// SafelistIP.
+func (ra *RedisRackAttack) UnblocklistIP(ip string) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.blocklistIPs = withoutKey(ra.blocklistIPs, normalizeIP(ip))
+}
+
+// UnblocklistCIDR removes a CIDR range from the blocklist, matching on the
+// normalized network as UnsafelistCIDR does.
+func (ra *RedisRackAttack) UnblocklistCIDR(cidr string) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.blocklistNets = withoutNet(ra.blocklistNets, n)
+	return nil
+}
+
+// pathEntry is a safelist or blocklist IP that only applies on matching
+// paths.
+type pathEntry struct {
+	ip      string
+	pattern string
+}
+
+// SafelistIPForPath safelists ip, normalized as in SafelistIP, but only for
+// requests whose path matches pathPattern (with ThrottleRule.PathPattern
+// semantics), so a monitoring host can skip limits on "/health" while staying
+// limited on "/api/*". Unscoped entries still apply everywhere.
+func (ra *RedisRackAttack) SafelistIPForPath(ip, pathPattern string) error {
+	norm, err := parseListIP(ip)
+	if err != nil {
+		return err
+	}
+	if err := checkPathPattern(pathPattern); err != nil {
+		return err
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.safelistPaths = withEntry(ra.safelistPaths, pathEntry{norm, pathPattern})
+	return nil
+}
+
+// BlocklistIPForPath blocklists ip, normalized as in SafelistIP, but only for
+// requests whose path matches pathPattern.
+func (ra *RedisRackAttack) BlocklistIPForPath(ip, pathPattern string) error {
+	norm, err := parseListIP(ip)
+	if err != nil {
+		return err
+	}
+	if err := checkPathPattern(pathPattern); err != nil {
+		return err
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.blocklistPaths = withEntry(ra.blocklistPaths, pathEntry{norm, pathPattern})
+	return nil
+}
+
+// UnsafelistIPForPath removes an entry added by SafelistIPForPath. The
+// pattern must be given exactly as added.
+func (ra *RedisRackAttack) UnsafelistIPForPath(ip, pathPattern string) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.safelistPaths = withoutEntry(ra.safelistPaths, pathEntry{normalizeIP(ip), pathPattern})
+}
+
+// UnblocklistIPForPath removes an entry added by BlocklistIPForPath. The
+// pattern must be given exactly as added.
+func (ra *RedisRackAttack) UnblocklistIPForPath(ip, pathPattern string) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.blocklistPaths = withoutEntry(ra.blocklistPaths, pathEntry{normalizeIP(ip), pathPattern})
+}
+
+// Throttle registers a throttle rule. It rejects rules that could only
+// misbehave: no Key or KeyFunc, a non-positive Limit or Period, an unknown
+// Algorithm, a malformed PathPattern, or both PathPattern and PathRegex set.
+func (ra *RedisRackAttack) Throttle(rule ThrottleRule) error {
+	if err := ra.checkRule(rule); err != nil {
+		return fmt.Errorf("rackattack: throttle rule %q: %w", rule.name(), err)
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.throttleRules = insertRule(ra.throttleRules, rule)
+	return nil
+}
+
+// insertRule returns a copy of rules, which are in evaluation order, with rule
+// added after every rule of at least its priority. Copy-on-write so
+// concurrent readers iterate a stable slice.
+func insertRule(rules []ThrottleRule, rule ThrottleRule) []ThrottleRule {
+	i := len(rules)
+	for i > 0 && rules[i-1].Priority < rule.Priority {
+		i--
+	}
+	out := make([]ThrottleRule, 0, len(rules)+1)
+	out = append(out, rules[:i]...)
+	out = append(out, rule.compiled())
+	return append(out, rules[i:]...)
+}
+
+// AddRuleGroup registers rules as the group name, so that a set of rules
+// owned by one team can be managed as a unit: each rule's Group is set to
+// name, and any rules already in the group are replaced. Either every rule is
+// registered or, if one is invalid, none is and the existing group is kept.
+// Requests are evaluated against all groups together.
+func (ra *RedisRackAttack) AddRuleGroup(name string, rules []ThrottleRule) error {
+	if name == "" {
+		return fmt.Errorf("rackattack: rule group name must not be empty: %w", ErrRuleInvalid)
+	}
+	for _, rule := range rules {
+		if err := ra.checkRule(rule); err != nil {
+			return fmt.Errorf("rackattack: rule group %q: throttle rule %q: %w", name, rule.name(), err)
+		}
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	next := withoutGroup(ra.throttleRules, name)
+	for _, rule := range rules {
+		rule.Group = name
+		next = insertRule(next, rule)
+	}
+	ra.throttleRules = next
+	return nil
+}
+
+// RemoveRuleGroup removes every throttle rule in the group name in one step,
+// and reports whether there were any.
+func (ra *RedisRackAttack) RemoveRuleGroup(name string) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	rules := withoutGroup(ra.throttleRules, name)
+	removed := len(rules) != len(ra.throttleRules)
+	ra.throttleRules = rules
+	return removed
+}
+
+// withoutGroup returns a copy of rules without those in the group name.
+func withoutGroup(rules []ThrottleRule, name string) []ThrottleRule {
+	out := make([]ThrottleRule, 0, len(rules))
+	for _, r := range rules {
+		if r.Group != name {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// MustThrottle is like Throttle but panics on an invalid rule, for rules
+// fixed at compile time.
+func (ra *RedisRackAttack) MustThrottle(rule ThrottleRule) {
+	if err := ra.Throttle(rule); err != nil {
+		panic(err)
+	}
+}
+
+// RemoveThrottleRule removes every throttle rule whose Name (or Key, for
+// unnamed rules) equals name, and reports whether any were removed.
+func (ra *RedisRackAttack) RemoveThrottleRule(name string) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	rules := make([]ThrottleRule, 0, len(ra.throttleRules))
+	for _, r := range ra.throttleRules {
+		if r.name() != name {
+			rules = append(rules, r)
+		}
+	}
+	removed := len(rules) != len(ra.throttleRules)
+	ra.throttleRules = rules
+	return removed
+}
+
+// SetRuleEnabled turns every throttle rule whose Name (or Key, for unnamed
+// rules) equals name off or back on, keeping its configuration and counters,
+// and reports whether any rule matched. The SetGlobalLimit rule is named
+// "global". Use it to lift a limit during an incident without deleting it.
+func (ra *RedisRackAttack) SetRuleEnabled(name string, enabled bool) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	found := false
+	rules := make([]ThrottleRule, len(ra.throttleRules))
+	for i, r := range ra.throttleRules {
+		if r.name() == name {
+			r.Disabled = !enabled
+			found = true
+		}
+		rules[i] = r
+	}
+	ra.throttleRules = rules
+	if g := ra.globalRule; g != nil && g.name() == name {
+		global := *g
+		global.Disabled = !enabled
+		ra.globalRule = &global
+		found = true
+	}
+	return found
+}
+
+// ClearThrottleRules removes all throttle rules.
+func (ra *RedisRackAttack) ClearThrottleRules() {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.throttleRules = nil
+}
+
+// SafelistIf registers a predicate that safelists any request for which it
+// returns true, independent of the client IP: a signed internal-service
+// header, say. Predicates run after the IP safelist and before everything
+// else, on every request, so keep them cheap.
+func (ra *RedisRackAttack) SafelistIf(predicate func(*http.Request) bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	preds := make([]func(*http.Request) bool, len(ra.safelistIfs), len(ra.safelistIfs)+1)
+	copy(preds, ra.safelistIfs)
+	ra.safelistIfs = append(preds, predicate)
+}
+
+// BlocklistIf registers a predicate that blocklists any request for which it
+// returns true, e.g. a known scraper User-Agent or a missing required header.
+// Predicates run after the safelist (so safelisted requests are never
+// blocked) and before Fail2Ban and throttling, on every request.
+func (ra *RedisRackAttack) BlocklistIf(predicate func(*http.Request) bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	preds := make([]func(*http.Request) bool, len(ra.blocklistIfs), len(ra.blocklistIfs)+1)
+	copy(preds, ra.blocklistIfs)
+	ra.blocklistIfs = append(preds, predicate)
+}
+
+// SetGlobalLimit installs a catch-all throttle rule named "global" that
+// applies to every request, limiting each expansion of keyTemplate (e.g.
+// "global:%{ip}") to limit hits per period. It is evaluated after the
+// registered throttle rules, and a request must satisfy both: either can
+// throttle it. Calling it again replaces the limit; a limit of zero or less
+// removes it. ClearThrottleRules leaves it in place. Like Throttle, it
+// rejects an empty keyTemplate or a non-positive period. It counts with the
+// default SlidingWindow, or FixedWindow on a RedisCounterStore.
+func (ra *RedisRackAttack) SetGlobalLimit(limit int, period time.Duration, keyTemplate string) error {
+	var global *ThrottleRule
+	if limit > 0 {
+		global = &ThrottleRule{Name: "global", Key: keyTemplate, Limit: limit, Period: period, Algorithm: ra.algorithm()}
+		if err := ra.checkRule(*global); err != nil {
+			return fmt.Errorf("rackattack: global limit: %w", err)
+		}
+	}
 	ra.mu.Lock()
 	defer ra.mu.Unlock()
-	// Copy-on-write so concurrent readers iterate a stable slice.
-	rules := make([]ThrottleRule, len(ra.throttleRules), len(ra.throttleRules)+1)
-	copy(rules, ra.throttleRules)
-	ra.throttleRules = append(rules, rule)
+	ra.globalRule = global
+	return nil
+}
+
+// withGlobal returns rules followed by the global rule, if any, without
+// modifying the shared rules slice.
+func withGlobal(rules []ThrottleRule, global *ThrottleRule) []ThrottleRule {
+	if global == nil {
+		return rules
+	}
+	return append(rules[:len(rules):len(rules)], *global)
+}
+
+// ResetThrottle clears the throttle counter stored under key (an expanded
+// rule Key, e.g. "api:203.0.113.9") and reports whether one existed.
+func (ra *RedisRackAttack) ResetThrottle(ctx context.Context, key string) (bool, error) {
+	return ra.store.Reset(ctx, key)
+}
+
+// KeyFor returns the throttle key rule derives for req, exactly as Check
+// would, for asserting key templates in tests and debugging collisions. It
+// is "" when the rule would skip req, such as a KeyFunc returning "". The key
+// is the one ResetThrottle takes: WithKeyPrefix and a store's own key prefix
+// are added beneath it. It does not check whether rule matches req.
+func (ra *RedisRackAttack) KeyFor(rule ThrottleRule, req *http.Request) string {
+	req, ip := ra.client(req)
+	return rule.key(ip, req)
+}
+
+// ResetThrottleFor clears the counter rule keeps for req's client, deriving
+// the key exactly as Check would. Build req with the client's address (and
+// any headers or path the rule's Key uses).
+func (ra *RedisRackAttack) ResetThrottleFor(ctx context.Context, rule ThrottleRule, req *http.Request) (bool, error) {
+	req, ip := ra.client(req)
+	key := rule.key(ip, req)
+	if key == "" {
+		return false, nil
+	}
+	return ra.store.Reset(ctx, key)
+}
+
+// RetryAfter reports how long req's client must wait before rule admits its
+// next request, without recording a hit, for a "try again in" message. It is
+// zero when the client has room left or no counter exists. Like
+// ResetThrottleFor, it derives the key exactly as Check would; a ban under
+// rule.Ban is not reflected.
+func (ra *RedisRackAttack) RetryAfter(ctx context.Context, rule ThrottleRule, req *http.Request) (time.Duration, error) {
+	req, ip := ra.client(req)
+	key := rule.key(ip, req)
+	if key == "" {
+		return 0, nil
+	}
+	res, err := ra.store.Peek(ctx, key, rule.quota(ip, req))
+	if err != nil || !res.Limited {
+		return 0, err
+	}
+	return res.RetryAfter, nil
+}
+
+// Stats reports how much of rule's budget req's client has used without
+// recording a hit, for usage dashboards and support tooling: current hits
+// counted in the window, the limit (the capacity for TokenBucket and
+// LeakyBucket), and how long until the oldest hit frees up. It derives the
+// key exactly as Check would. A client with no counter reports zero hits, and
+// a KeyFunc rule that does not apply to req reports all zeros.
+func (ra *RedisRackAttack) Stats(ctx context.Context, rule ThrottleRule, req *http.Request) (current int, limit int, ttl time.Duration, err error) {
+	req, ip := ra.client(req)
+	key := rule.key(ip, req)
+	if key == "" {
+		return 0, 0, 0, nil
+	}
+	// Peek at unit cost: Stats reports on the window, not on req's weight.
+	res, err := ra.store.Peek(ctx, key, rule.unitQuota(req))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return res.Limit - res.Remaining, res.Limit, res.Reset, nil
+}
+
+// Allow records a hit against key and reports whether it is within limit hits
+// per period, with the hits left in the window, for rate limiting outside the
+// request model, such as outbound calls to a vendor API. It uses the same
+// sliding window as a ThrottleRule, or a fixed window on a RedisCounterStore,
+// and key shares the namespace of expanded rule keys, so ResetThrottle clears
+// it. On a store error, allowed follows the instance's fail-open or
+// fail-closed policy.
+func (ra *RedisRackAttack) Allow(ctx context.Context, key string, limit int, period time.Duration) (allowed bool, remaining int, err error) {
+	if limit <= 0 || period <= 0 {
+		return false, 0, errors.New("rackattack: limit and period must be positive")
+	}
+	res, err := ra.store.Throttle(ctx, key, Quota{Algorithm: ra.algorithm(), Limit: limit, Period: period})
+	if err != nil {
+		return !ra.failClosed, 0, err
+	}
+	return !res.Limited, res.Remaining, nil
+}
+
+// algorithm returns the algorithm for limits that name none: SlidingWindow,
+// or FixedWindow when the store counts nothing else.
+func (ra *RedisRackAttack) algorithm() Algorithm {
+	if ra.fixedWindow {
+		return FixedWindow
+	}
+	return SlidingWindow
 }
 
 // Fail2Ban registers a Fail2Ban rule.
 func (ra *RedisRackAttack) Fail2Ban(rule Fail2BanRule) {
 	ra.mu.Lock()
 	defer ra.mu.Unlock()
+	m := compilePath(rule.PathPattern)
+	rule.path = &m
 	rules := make([]Fail2BanRule, len(ra.fail2banRules), len(ra.fail2banRules)+1)
 	copy(rules, ra.fail2banRules)
 	ra.fail2banRules = append(rules, rule)
@@ -211,98 +1333,547 @@ func (ra *RedisRackAttack) Fail2Ban(rule Fail2BanRule) {
 
 // Check evaluates the request against all policies and returns a Decision. It
 // does not write any response; use Middleware for that.
-func (ra *RedisRackAttack) Check(req *http.Request) (Decision, error) {
-	ctx := req.Context()
-	ip := ra.clientIP(req)
-	reqPath := req.URL.Path
+//
+// A request throttled by one rule still counts against every other matching
+// rule with room left, so no window misses an attempt. A request denied by a
+// ban, blocklist, or Fail2Ban rule counts against none.
+//
+// The hits for every matching rule are sent together when the store is a
+// BatchStore, so a request costs one round trip for them however many rules
+// it matches.
+//
+// Every store call is made with req.Context(), so request deadlines and
+// cancellation reach the backend. To evaluate under a different context, pass
+// req.WithContext(ctx), or derive one for every request with WithContextFunc.
+func (ra *RedisRackAttack) Check(req *http.Request) (decision Decision, err error) {
+	req, ip := ra.client(req)
+	ctx := ra.storeContext(req)
+	if ra.tracer != nil {
+		var span Span
+		var storeTime time.Duration
+		ctx, span = ra.tracer.Start(ctx, "rackattack.check")
+		ctx = withStoreTimer(ctx, &storeTime)
+		defer span.End()
+		defer func() { traceDecision(span, decision, err, storeTime) }()
+	}
+	decision, err = ra.evaluate(ctx, req, ip, false)
+	if err != nil {
+		ra.logError(req, ip, err)
+		return decision, err
+	}
+	ra.observe(req, ip, decision)
+	return decision, nil
+}
+
+// CheckBatch evaluates reqs as Check would, in order, and reports for each
+// whether it should be denied. Their throttle hits are counted in a single
+// round trip when the store is a BatchStore, such as RedisStore, which suits
+// pre-checking a queue of synthetic requests before draining it. Each request
+// is matched against the rules on its own, and a later request sees the hits
+// of earlier ones, but not bans those hits trigger. Store calls use ctx
+// rather than each request's context.
+//
+// On a store error no decisions are reported: every entry is set as
+// IsThrottled would for that error, and callbacks and metrics do not fire.
+func (ra *RedisRackAttack) CheckBatch(ctx context.Context, reqs []*http.Request) ([]bool, error) {
+	denied := make([]bool, len(reqs))
+	fail := func(req *http.Request, ip string, err error) ([]bool, error) {
+		ra.logError(req, ip, err)
+		for i := range denied {
+			denied[i] = ra.failClosed || deniesOnError(err)
+		}
+		return denied, err
+	}
+
+	type pending struct {
+		ip       string
+		decision Decision
+		matched  []throttleMatch
+		done     bool
+		first    int // index of the request's first op in ops
+	}
+	pend := make([]pending, len(reqs))
+	var ops []BatchOp
+	for i, req := range reqs {
+		req, ip := ra.client(req)
+		d, matched, done, err := ra.prepare(ctx, req, ip, false)
+		if err != nil {
+			return fail(req, ip, err)
+		}
+		pend[i] = pending{ip: ip, decision: d, matched: matched, done: done, first: len(ops)}
+		if !done {
+			ops = append(ops, throttleOps(req, ip, matched, false)...)
+		}
+	}
+
+	results, err := runBatch(ctx, ra.store, ops)
+	if err != nil {
+		var matched []throttleMatch
+		for _, p := range pend {
+			matched = append(matched, p.matched...)
+		}
+		return fail(reqs[0], pend[0].ip, matchedError(matched, err))
+	}
+
+	for i, req := range reqs {
+		p := &pend[i]
+		if p.done {
+			continue
+		}
+		d, err := ra.decide(ctx, req, p.ip, p.matched, results[p.first:p.first+len(p.matched)], false)
+		if err != nil {
+			return fail(req, p.ip, err)
+		}
+		p.decision = d
+	}
+	for i, req := range reqs {
+		ra.observe(req, pend[i].ip, pend[i].decision)
+		denied[i] = !pend[i].decision.Allowed
+	}
+	return denied, nil
+}
+
+// observe logs d and fires the callbacks and metrics for it.
+func (ra *RedisRackAttack) observe(req *http.Request, ip string, d Decision) {
+	ra.logDecision(req, ip, d)
+	ra.notify(req, ip, d)
+	if ra.metrics != nil {
+		ra.metrics.ObserveDecision(d)
+	}
+}
+
+// logError logs a store error that prevented a decision for req.
+func (ra *RedisRackAttack) logError(req *http.Request, ip string, err error) {
+	if ra.logger != nil {
+		ra.logger.WarnContext(req.Context(), "rackattack: store error",
+			"ip", ip, "path", req.URL.Path, "error", err)
+	}
+}
 
+// logDecision logs d through the WithLogger logger: denials at Info,
+// everything else at Debug.
+func (ra *RedisRackAttack) logDecision(req *http.Request, ip string, d Decision) {
+	if ra.logger == nil {
+		return
+	}
+	level := slog.LevelDebug
+	if !d.Allowed {
+		level = slog.LevelInfo
+	}
+	attrs := []any{"ip", ip, "path", req.URL.Path, "allowed", d.Allowed, "reason", d.Reason.String()}
+	if d.RuleName != "" {
+		attrs = append(attrs, "rule", d.RuleName)
+	}
+	if d.Rule != nil && d.Rule.Group != "" {
+		attrs = append(attrs, "group", d.Rule.Group)
+	}
+	if d.Rule != nil {
+		attrs = append(attrs, "limit", d.Throttle.Limit, "remaining", d.Throttle.Remaining)
+	}
+	if len(d.DryRun) > 0 {
+		attrs = append(attrs, "dry_run", d.DryRun)
+	}
+	ra.logger.Log(req.Context(), level, "rackattack: decision", attrs...)
+}
+
+// notify fires the OnThrottled/OnBlocked callbacks for a denied decision.
+func (ra *RedisRackAttack) notify(req *http.Request, ip string, d Decision) {
+	switch d.Reason {
+	case ReasonThrottled:
+		if ra.onThrottled != nil {
+			ra.onThrottled(req, *d.Rule)
+		}
+	case ReasonBlocklisted, ReasonBanned:
+		if ra.onBlocked != nil {
+			ra.onBlocked(req, ip)
+		}
+	}
+}
+
+// throttleMatch is a throttle rule that applies to a request, with the key
+// it derived.
+type throttleMatch struct {
+	rule ThrottleRule
+	key  string
+}
+
+// evaluate runs the policy chain for req as seen from client ip. With peek
+// set it records nothing: no Fail2Ban offenses, throttle hits, or ban strikes.
+// Store calls use ctx.
+func (ra *RedisRackAttack) evaluate(ctx context.Context, req *http.Request, ip string, peek bool) (Decision, error) {
+	d, matched, done, err := ra.prepare(ctx, req, ip, peek)
+	if err != nil || done {
+		return d, err
+	}
+	if len(matched) == 0 {
+		// Nothing to count: skip the store entirely.
+		return Decision{Allowed: true, Reason: ReasonNone}, nil
+	}
+	// One round trip for all matched rules when the store can batch.
+	results, err := runBatch(ctx, ra.store, throttleOps(req, ip, matched, peek))
+	if err != nil {
+		return Decision{}, matchedError(matched, err)
+	}
+	return ra.decide(ctx, req, ip, matched, results, peek)
+}
+
+// prepare runs the policy chain up to counting throttle hits. When done is
+// set, the returned Decision is final. Otherwise matched lists the throttle
+// rules that apply, none of them banned, for decide to count.
+func (ra *RedisRackAttack) prepare(ctx context.Context, req *http.Request, ip string, peek bool) (d Decision, matched []throttleMatch, done bool, err error) {
 	ra.mu.RLock()
 	safelistIPs := ra.safelistIPs
 	blocklistIPs := ra.blocklistIPs
 	safelistNets := ra.safelistNets
 	blocklistNets := ra.blocklistNets
-	throttleRules := ra.throttleRules
+	safelistPaths := ra.safelistPaths
+	blocklistPaths := ra.blocklistPaths
+	safelistIfs := ra.safelistIfs
+	blocklistIfs := ra.blocklistIfs
+	throttleRules := withGlobal(ra.throttleRules, ra.globalRule)
 	fail2banRules := ra.fail2banRules
 	ra.mu.RUnlock()
 
 	// 1. Safelist wins outright.
-	if ip != "" {
-		if _, ok := safelistIPs[ip]; ok || ipInNets(ip, safelistNets) {
-			return Decision{Allowed: true, Reason: ReasonSafelisted}, nil
+	if ip != UnknownClientIP {
+		if _, ok := safelistIPs[ip]; ok || ipInNets(ip, safelistNets) || inPathEntries(safelistPaths, ip, req.URL.Path) {
+			return Decision{Allowed: true, Reason: ReasonSafelisted}, nil, true, nil
+		}
+	}
+	for _, pred := range safelistIfs {
+		if pred(req) {
+			return Decision{Allowed: true, Reason: ReasonSafelisted}, nil, true, nil
 		}
 	}
 
-	// 2. Blocklist.
-	if ip != "" {
-		if _, ok := blocklistIPs[ip]; ok || ipInNets(ip, blocklistNets) {
-			return Decision{Allowed: false, Reason: ReasonBlocklisted}, nil
+	// 2. Blocklist: predicates and in-memory entries first, then temporary
+	// blocks in the store.
+	for _, pred := range blocklistIfs {
+		if pred(req) {
+			return Decision{Allowed: false, Reason: ReasonBlocklisted}, nil, true, nil
+		}
+	}
+	if ip != UnknownClientIP {
+		if _, ok := blocklistIPs[ip]; ok || ipInNets(ip, blocklistNets) || inPathEntries(blocklistPaths, ip, req.URL.Path) {
+			return Decision{Allowed: false, Reason: ReasonBlocklisted}, nil, true, nil
+		}
+		if ra.tempBlocklist {
+			blocked, err := ra.store.Banned(ctx, tempBlockKey(ip))
+			if err != nil {
+				return Decision{}, nil, false, err
+			}
+			if blocked {
+				return Decision{Allowed: false, Reason: ReasonBlocklisted}, nil, true, nil
+			}
 		}
 	}
 
 	// 3. Fail2Ban.
+	reqPath := newRequestPath(req.URL.Path)
 	for _, rule := range fail2banRules {
-		if !matchPath(rule.PathPattern, reqPath) || !matchMethod(rule.Method, req.Method) {
+		if !rule.matchesPath(req, &reqPath) {
 			continue
 		}
 		banKey := rule.Name + ":" + ip
-		offended := rule.Trigger == nil || rule.Trigger(req)
+		offended := !peek && (rule.Trigger == nil || rule.Trigger(req))
 		var banned bool
 		var err error
 		if offended {
-			banned, err = ra.store.Strike(ctx, banKey, rule.MaxRetry, rule.FindTime, rule.BanTime)
+			banned, _, err = ra.store.Strike(ctx, banKey, rule.policy())
 		} else {
 			banned, err = ra.store.Banned(ctx, banKey)
 		}
 		if err != nil {
-			return Decision{}, err
+			return Decision{}, nil, false, err
 		}
 		if banned {
-			return Decision{Allowed: false, Reason: ReasonBanned, RuleName: rule.Name}, nil
+			return Decision{Allowed: false, Reason: ReasonBanned, RuleName: rule.Name}, nil, true, nil
 		}
 	}
 
-	// 4. Throttle. Evaluate every matching rule so each window is counted, and
-	// remember the rule that leaves the least headroom so the caller can emit
-	// accurate RateLimit-* headers even when the request is allowed.
-	allowed := Decision{Allowed: true, Reason: ReasonNone}
-	haveThrottle := false
-	for _, rule := range throttleRules {
-		if !matchPath(rule.PathPattern, reqPath) || !matchMethod(rule.Method, req.Method) {
+	// 4. Throttle. Evaluate every matching rule so each window is counted,
+	// even once one has throttled. A denial reports the limited rule with the
+	// longest wait; an allowed request reports the rule that leaves the least
+	// headroom, so the caller can emit accurate RateLimit-* headers either way.
+	//
+	// Bans are checked for every matching rule before anything is counted, so
+	// a banned request consumes no budget. A throttled request, by contrast,
+	// counts against every other matching rule that still had room: each
+	// attempt is reflected in every window it falls in.
+	matched = matchRules(throttleRules, req, ip, &reqPath)
+	for _, m := range matched {
+		rule := m.rule
+		if rule.Ban.enabled() && !rule.DryRun {
+			banned, err := ra.store.Banned(ctx, throttleBanKey(m.key))
+			if err != nil {
+				return Decision{}, nil, false, rule.storeError(err)
+			}
+			if banned {
+				// Copy here, so that rule itself does not escape and cost
+				// every iteration a heap allocation.
+				banning := rule
+				d := Decision{Allowed: false, Reason: ReasonBanned, RuleName: rule.name(), Rule: &banning}
+				if d.Throttle, err = ra.banResult(ctx, req, rule, m.key); err != nil {
+					return Decision{}, nil, false, rule.storeError(err)
+				}
+				return d, nil, true, nil
+			}
+		}
+	}
+
+	return Decision{}, matched, false, nil
+}
+
+// banResult describes the ban on key, the key of rule for req, as a Result
+// for the rate-limit headers: nothing remains until the ban ends. It is zero
+// when the store cannot tell how long the ban has left.
+func (ra *RedisRackAttack) banResult(ctx context.Context, req *http.Request, rule ThrottleRule, key string) (Result, error) {
+	if ra.banTTLs == nil {
+		return Result{}, nil
+	}
+	ttl, err := ra.banTTLs.BanTTL(ctx, ra.keyPrefix+throttleBanKey(key))
+	if err != nil {
+		return Result{}, storeError("BanTTL", err)
+	}
+	limit, _ := rule.limitFor(req.Method)
+	return Result{Limit: limit, Limited: true, Reset: ttl, RetryAfter: ttl}, nil
+}
+
+// matchRules returns the rules of rules that apply to req, whose client IP
+// is ip and whose path is p, with their keys: those that match, are sampled
+// in, and derive a key, in order up to the first that sets StopOnMatch.
+func matchRules(rules []ThrottleRule, req *http.Request, ip string, p *requestPath) []throttleMatch {
+	var matched []throttleMatch
+	for _, rule := range rules {
+		if !rule.matchesPath(req, p) || !rule.sampled() {
 			continue
 		}
-		key := expandKey(rule.Key, ip, reqPath)
-		res, err := ra.store.Throttle(ctx, key, rule.Limit, rule.Period)
-		if err != nil {
-			return Decision{}, err
+		key := rule.key(ip, req)
+		if key == "" {
+			continue
+		}
+		matched = append(matched, throttleMatch{rule, key})
+		if rule.StopOnMatch {
+			break
+		}
+	}
+	return matched
+}
+
+// throttleOps returns the store operations counting req against matched:
+// a Throttle hit per rule, or only a Peek in peek mode and for rules that
+// count once the response is known.
+func throttleOps(req *http.Request, ip string, matched []throttleMatch, peek bool) []BatchOp {
+	ops := make([]BatchOp, len(matched))
+	for i, m := range matched {
+		ops[i] = BatchOp{Key: m.key, Quota: m.rule.quota(ip, req), Peek: peek || m.rule.deferred()}
+	}
+	return ops
+}
+
+// matchedError marks err, a store failure while counting matched, as denying
+// the request when any of the rules fails closed.
+func matchedError(matched []throttleMatch, err error) error {
+	for _, m := range matched {
+		if m.rule.FailClosed {
+			return m.rule.storeError(err)
+		}
+	}
+	return err
+}
+
+// decide finishes evaluate from the store results for matched, in order:
+// it strikes bans for throttled rules and picks the reported rule.
+func (ra *RedisRackAttack) decide(ctx context.Context, req *http.Request, ip string, matched []throttleMatch, results []Result, peek bool) (Decision, error) {
+	allowed := Decision{Allowed: true, Reason: ReasonNone}
+	var denied *Decision
+	var banLevel int
+	for i, m := range matched {
+		rule, key, res := m.rule, m.key, results[i]
+		if ra.logger != nil && !peek {
+			ra.logger.DebugContext(ctx, "rackattack: throttle rule matched",
+				"ip", ip, "path", req.URL.Path, "rule", rule.name(), "key", key,
+				"count", res.Limit-res.Remaining, "limit", res.Limit, "limited", res.Limited)
+		}
+		if res.Limited && rule.DryRun {
+			// Report what would have happened, but let the request through.
+			allowed.DryRun = append(allowed.DryRun, rule.name())
+			if ra.onThrottled != nil && !peek {
+				ra.onThrottled(req, rule)
+			}
+			continue
 		}
 		if res.Limited {
-			return Decision{
-				Allowed:  false,
-				Reason:   ReasonThrottled,
-				RuleName: rule.Key,
-				Throttle: res,
-			}, nil
-		}
-		if !haveThrottle || res.Remaining < allowed.Throttle.Remaining {
-			allowed.RuleName = rule.Key
+			var level int
+			if rule.Ban.enabled() && !peek {
+				var err error
+				_, level, err = ra.store.Strike(ctx, throttleBanKey(key), rule.Ban)
+				if err != nil {
+					return Decision{}, rule.storeError(err)
+				}
+			}
+			if denied == nil || res.RetryAfter > denied.Throttle.RetryAfter {
+				denied = &Decision{
+					Allowed:  false,
+					Reason:   ReasonThrottled,
+					RuleName: rule.name(),
+					Rule:     &rule,
+					Throttle: res,
+				}
+			}
+			banLevel = max(banLevel, level)
+			continue
+		}
+		if rule.DryRun {
+			continue
+		}
+		if allowed.Rule == nil || res.Remaining < allowed.Throttle.Remaining {
+			allowed.RuleName = rule.name()
+			allowed.Rule = &rule
 			allowed.Throttle = res
-			haveThrottle = true
 		}
 	}
 
+	if denied != nil {
+		denied.DryRun = allowed.DryRun
+		denied.BanLevel = banLevel
+		return *denied, nil
+	}
 	return allowed, nil
 }
 
+// Peek reports the Decision Check would make for req without consuming
+// anything: no throttle hits, Fail2Ban offenses, or ban strikes are recorded,
+// and no callbacks or metrics fire. Follow it with Commit to count the
+// request. Between the two, concurrent requests may use up the budget Peek
+// reported, and rules with a SampleRate are sampled afresh, so the two can
+// disagree on which of those apply.
+func (ra *RedisRackAttack) Peek(req *http.Request) (Decision, error) {
+	req, ip := ra.client(req)
+	return ra.evaluate(ra.storeContext(req), req, ip, true)
+}
+
+// Commit records one hit for req against every matching throttle rule, as
+// Check would, without evaluating the rest of the chain: it selects rules as
+// Check does, so rules past a StopOnMatch rule are not counted. Rules that set
+// CountIf or StatusCost are left to Record, as with Check. It returns the
+// first store error.
+func (ra *RedisRackAttack) Commit(req *http.Request) error {
+	req, ip := ra.client(req)
+
+	ra.mu.RLock()
+	rules := withGlobal(ra.throttleRules, ra.globalRule)
+	ra.mu.RUnlock()
+
+	reqPath := newRequestPath(req.URL.Path)
+	var ops []BatchOp
+	for _, m := range matchRules(rules, req, ip, &reqPath) {
+		if !m.rule.deferred() {
+			ops = append(ops, BatchOp{Key: m.key, Quota: m.rule.quota(ip, req)})
+		}
+	}
+	_, err := runBatch(ra.storeContext(req), ra.store, ops)
+	return err
+}
+
+// Record counts a completed request against the throttle rules that set
+// CountIf or StatusCost, for each such rule that matches req: once if its
+// CountIf accepts status, or StatusCost(status) times. It selects rules as
+// Check does, so a StopOnMatch rule before them keeps them from counting.
+// Middleware calls it after the wrapped handler returns; call it yourself
+// when using Check directly.
+func (ra *RedisRackAttack) Record(req *http.Request, status int) error {
+	req, ip, deferred := ra.deferredRules(req)
+	return ra.record(req, ip, deferred, status)
+}
+
+// record counts req, whose client IP is ip, against deferred, the rules
+// deferredRules selected, for a response with status.
+func (ra *RedisRackAttack) record(req *http.Request, ip string, deferred []throttleMatch, status int) error {
+	ctx := ra.storeContext(req)
+	var ops, peeks []BatchOp
+	var weighted []int // the ops whose cost may not fit whole
+	for _, m := range deferred {
+		q, ok := m.rule.statusQuota(ip, req, status)
+		if !ok {
+			continue
+		}
+		if q.Cost > 1 {
+			unit := q
+			unit.Cost = 1
+			weighted = append(weighted, len(ops))
+			peeks = append(peeks, BatchOp{Key: m.key, Quota: unit, Peek: true})
+		}
+		ops = append(ops, BatchOp{Key: m.key, Quota: q})
+	}
+	// The store throttles a hit that does not fit as a whole without counting
+	// it, so a weighted hit is cut down to what is left of the budget. With
+	// nothing left, a unit hit is sent and throttled, as the counter is full.
+	if len(peeks) > 0 {
+		results, err := runBatch(ctx, ra.store, peeks)
+		if err != nil {
+			return err
+		}
+		for i, res := range results {
+			op := &ops[weighted[i]]
+			op.Quota.Cost = max(min(op.Quota.Cost, res.Remaining), 1)
+		}
+	}
+	_, err := runBatch(ctx, ra.store, ops)
+	return err
+}
+
+// storeContext returns the context for store calls made on behalf of req.
+func (ra *RedisRackAttack) storeContext(req *http.Request) context.Context {
+	if ra.contextFunc != nil {
+		return ra.contextFunc(req)
+	}
+	return req.Context()
+}
+
+// now returns the time from the WithClock clock, if any.
+func (ra *RedisRackAttack) now() time.Time {
+	if ra.clock != nil {
+		return ra.clock.Now()
+	}
+	return time.Now()
+}
+
+// deferredRules selects the rules that apply to req as Check does, sampling
+// and stopping at StopOnMatch, and returns those that count hits only once
+// the response is known, with req as client prepares it and its client IP.
+func (ra *RedisRackAttack) deferredRules(req *http.Request) (*http.Request, string, []throttleMatch) {
+	ra.mu.RLock()
+	rules := withGlobal(ra.throttleRules, ra.globalRule)
+	ra.mu.RUnlock()
+	if !slices.ContainsFunc(rules, ThrottleRule.deferred) {
+		return req, "", nil
+	}
+
+	req, ip := ra.client(req)
+	reqPath := newRequestPath(req.URL.Path)
+	var deferred []throttleMatch
+	for _, m := range matchRules(rules, req, ip, &reqPath) {
+		if m.rule.deferred() {
+			deferred = append(deferred, m)
+		}
+	}
+	return req, ip, deferred
+}
+
 // IsThrottled reports whether the request should be denied. It is a
 // convenience wrapper over Check that preserves the original boolean-style API.
-// A true result means "deny" for any reason (blocklist, ban, or throttle).
+// A true result means "deny" for any reason (blocklist, ban, or throttle);
+// to tell them apart, for example to answer 403 for a blocklist hit and 429
+// for a throttle, call Check and switch on Decision.Reason.
 //
 // On a store error, the returned bool follows the configured fail-open or
-// fail-closed policy (default: fail open, returns false).
+// fail-closed policy (default: fail open, returns false), or the FailClosed
+// setting of the rule being evaluated.
 func (ra *RedisRackAttack) IsThrottled(req *http.Request) (bool, error) {
 	decision, err := ra.Check(req)
 	if err != nil {
-		return ra.failClosed, err
+		return ra.failClosed || deniesOnError(err), err
 	}
 	return !decision.Allowed, nil
 }
@@ -1,10 +1,23 @@
 package rackattack_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
@@ -254,6 +267,25 @@ func TestFailOpenOnStoreError(t *testing.T) {
 	assert.False(t, throttled) // fail open
 }
 
+func TestPerRuleFailClosed(t *testing.T) {
+	ra, mr, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{PathPattern: "/admin/*", Key: "admin:%{ip}", Limit: 10, Period: time.Minute, FailClosed: true})
+	ra.Throttle(rackattack.ThrottleRule{PathPattern: "/public/*", Key: "public:%{ip}", Limit: 10, Period: time.Minute})
+	mr.Close()
+
+	throttled, err := ra.IsThrottled(req("GET", "/admin/users", "1.2.3.4:1"))
+	assert.Error(t, err)
+	assert.True(t, throttled, "the admin rule fails closed")
+	throttled, err = ra.IsThrottled(req("GET", "/public/x", "1.2.3.4:1"))
+	assert.Error(t, err)
+	assert.False(t, throttled, "the rest of the site still fails open")
+
+	h := rackattack.NewMiddleware(ra, rackattack.WithMiddlewareFailClosed(false))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/admin/users", "1.2.3.4:1"))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
 func TestConcurrentMutationAndCheck(t *testing.T) {
 	ra, _, _ := setup(t)
 	ra.Throttle(rackattack.ThrottleRule{Key: "c:%{ip}", Limit: 1000000, Period: time.Minute})
@@ -265,7 +297,10 @@ func TestConcurrentMutationAndCheck(t *testing.T) {
 			defer wg.Done()
 			ra.SafelistIP("1.1.1.1")
 			ra.BlocklistIP("2.2.2.2")
+			_ = ra.SafelistCIDR("10.0.0.0/8")
+			_ = ra.BlocklistCIDR("192.0.2.0/24")
 			ra.Throttle(rackattack.ThrottleRule{Key: "x", Limit: 5, Period: time.Minute})
+			ra.Fail2Ban(rackattack.Fail2BanRule{Name: "f", MaxRetry: 100, FindTime: time.Minute, BanTime: time.Minute})
 		}()
 		go func() {
 			defer wg.Done()
@@ -284,3 +319,3329 @@ func TestEmptyRemoteAddrNotBlocklisted(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotEqual(t, rackattack.ReasonBlocklisted, d.Reason)
 }
+
+func TestMiddlewareFailOpenCallsErrorHandler(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	var gotErr error
+	ra, err := rackattack.New(rackattack.NewRedisStore(client, "test:"),
+		rackattack.WithErrorHandler(func(_ *http.Request, err error) { gotErr = err }),
+	)
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "e:%{ip}", Limit: 1, Period: time.Minute})
+	mr.Close()
+
+	called := false
+	h := ra.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		called = true
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/", "1.2.3.4:1"))
+	assert.True(t, called, "fail-open must reach the wrapped handler")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Error(t, gotErr)
+}
+
+func TestMiddlewareFailClosed(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ra, err := rackattack.New(rackattack.NewRedisStore(client, "test:"), rackattack.WithFailClosed())
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "e:%{ip}", Limit: 1, Period: time.Minute})
+	mr.Close()
+
+	h := ra.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		t.Fatal("handler should not be reached when failing closed")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/", "1.2.3.4:1"))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestCheckReportsMatchedRuleAndReset(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Key: "wide:%{ip}", Limit: 10, Period: time.Minute})
+	ra.Throttle(rackattack.ThrottleRule{Key: "tight:%{ip}", Limit: 2, Period: time.Minute})
+	r := req("GET", "/", "8.8.4.4:1")
+
+	d, err := ra.Check(r)
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	require.NotNil(t, d.Rule)
+	assert.Equal(t, "tight:%{ip}", d.Rule.Key)
+	assert.Equal(t, 2, d.Throttle.Limit)
+	assert.Equal(t, 1, d.Throttle.Remaining)
+	assert.Greater(t, d.Throttle.Reset, time.Duration(0))
+	assert.LessOrEqual(t, d.Throttle.Reset, time.Minute)
+
+	_, _ = ra.Check(r)
+	d, _ = ra.Check(r)
+	assert.False(t, d.Allowed)
+	require.NotNil(t, d.Rule)
+	assert.Equal(t, 2, d.Rule.Limit)
+	assert.Equal(t, d.Throttle.RetryAfter, d.Throttle.Reset)
+}
+
+func TestCheckWithoutMatchingRuleHasNoRule(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{PathPattern: "/api/*", Key: "a:%{ip}", Limit: 1, Period: time.Minute})
+	d, err := ra.Check(req("GET", "/static/app.js", "8.8.4.4:1"))
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Nil(t, d.Rule)
+}
+
+func TestMiddlewareSetsHeadersOnAllowedResponses(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Key: "h:%{ip}", Limit: 5, Period: time.Minute})
+	h := ra.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/", "3.3.3.3:1"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "4", rec.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", rec.Header().Get("RateLimit-Reset"))
+	assert.Empty(t, rec.Header().Get("Retry-After"))
+}
+
+func TestMiddlewareHeadersOnBannedResponses(t *testing.T) {
+	rule := rackattack.ThrottleRule{
+		Name:   "login",
+		Key:    "login:%{ip}",
+		Limit:  1,
+		Period: time.Minute,
+		Ban:    rackattack.BanPolicy{MaxRetry: 1, FindTime: time.Minute, BanTime: time.Hour},
+	}
+	banned := func(t *testing.T, store rackattack.Store) http.Header {
+		ra, err := rackattack.New(store)
+		require.NoError(t, err)
+		ra.Throttle(rule)
+		h := ra.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		var rec *httptest.ResponseRecorder
+		for i := 0; i < 3; i++ {
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, req("POST", "/login", "4.4.4.4:1"))
+		}
+		require.Equal(t, http.StatusForbidden, rec.Code)
+		return rec.Header()
+	}
+
+	mr := miniredis.RunT(t)
+	header := banned(t, rackattack.NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:"))
+	assert.Equal(t, "1", header.Get("RateLimit-Limit"))
+	assert.Equal(t, "0", header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "3600", header.Get("RateLimit-Reset"))
+	assert.Equal(t, "3600", header.Get("Retry-After"))
+
+	// A store that cannot tell the ban's TTL sends no misleading headers.
+	header = banned(t, &countingStore{Store: rackattack.NewMemoryStore()})
+	assert.Empty(t, header.Get("RateLimit-Limit"))
+	assert.Empty(t, header.Get("RateLimit-Reset"))
+	assert.Empty(t, header.Get("Retry-After"))
+}
+
+func TestMiddlewareXRateLimitHeaders(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ra, err := rackattack.New(rackattack.NewRedisStore(client, "test:"),
+		rackattack.WithRateLimitHeaders(rackattack.XRateLimitHeaders),
+	)
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "x:%{ip}", Limit: 1, Period: time.Minute})
+	h := ra.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/", "3.3.3.3:1"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/", "3.3.3.3:1"))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", rec.Header().Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+
+	reset, err := strconv.ParseInt(rec.Header().Get("X-RateLimit-Reset"), 10, 64)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Now().Add(time.Minute).Unix(), reset, 2)
+}
+
+func TestRuleHeader(t *testing.T) {
+	for _, always := range []bool{false, true} {
+		mr := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		headers := rackattack.DraftRateLimitHeaders
+		headers.Rule, headers.RuleAlways = "X-RateLimit-Rule", always
+		ra, err := rackattack.New(rackattack.NewRedisStore(client, "test:"), rackattack.WithRateLimitHeaders(headers))
+		require.NoError(t, err)
+		require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "api-burst", Key: "api:%{ip}", Limit: 1, Period: time.Minute}))
+		h := ra.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req("GET", "/", "1.1.1.1:1"))
+		if always {
+			assert.Equal(t, "api-burst", rec.Header().Get("X-RateLimit-Rule"))
+		} else {
+			assert.Empty(t, rec.Header().Get("X-RateLimit-Rule"), "allowed responses carry no rule by default")
+		}
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req("GET", "/", "1.1.1.1:1"))
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "api-burst", rec.Header().Get("X-RateLimit-Rule"))
+	}
+}
+
+// recordingStore is a minimal Store that allows everything and records the
+// keys it was asked about.
+type recordingStore struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (s *recordingStore) record(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, key)
+}
+
+func (s *recordingStore) Throttle(_ context.Context, key string, q rackattack.Quota) (rackattack.Result, error) {
+	s.record(key)
+	return rackattack.Result{Limit: q.Limit, Remaining: q.Limit - 1}, nil
+}
+
+func (s *recordingStore) Peek(_ context.Context, key string, q rackattack.Quota) (rackattack.Result, error) {
+	s.record(key)
+	return rackattack.Result{Limit: q.Limit, Remaining: q.Limit}, nil
+}
+
+func (s *recordingStore) Strike(_ context.Context, key string, _ rackattack.BanPolicy) (bool, int, error) {
+	s.record(key)
+	return false, 0, nil
+}
+
+func (s *recordingStore) Banned(_ context.Context, key string) (bool, error) {
+	s.record(key)
+	return false, nil
+}
+
+func (s *recordingStore) Reset(_ context.Context, key string) (bool, error) {
+	s.record(key)
+	return false, nil
+}
+
+func (s *recordingStore) Ban(_ context.Context, key string, _ time.Duration) error {
+	s.record(key)
+	return nil
+}
+
+func TestCustomStore(t *testing.T) {
+	store := &recordingStore{}
+	ra, err := rackattack.New(store)
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 3, Period: time.Minute})
+	ra.Fail2Ban(rackattack.Fail2BanRule{Name: "probe", MaxRetry: 3, FindTime: time.Minute, BanTime: time.Hour})
+
+	d, err := ra.Check(req("GET", "/", "5.6.7.8:1"))
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 2, d.Throttle.Remaining)
+	assert.Equal(t, []string{"probe:5.6.7.8", "api:5.6.7.8"}, store.keys)
+}
+
+func TestNewRejectsNilStore(t *testing.T) {
+	_, err := rackattack.New(nil)
+	assert.Error(t, err)
+}
+
+func TestMemoryStoreBackedFilter(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore())
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "mem:%{ip}", Limit: 1, Period: time.Minute})
+
+	d, err := ra.Check(req("GET", "/", "4.3.2.1:1"))
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	d, _ = ra.Check(req("GET", "/", "4.3.2.1:1"))
+	assert.False(t, d.Allowed)
+	assert.Equal(t, rackattack.ReasonThrottled, d.Reason)
+}
+
+func TestFixedWindowThrottle(t *testing.T) {
+	ra, mr, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{
+		Key:       "fw:%{ip}",
+		Limit:     2,
+		Period:    time.Minute,
+		Algorithm: rackattack.FixedWindow,
+	})
+	r := req("GET", "/", "9.9.9.9:1")
+
+	d, _ := ra.Check(r)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Throttle.Remaining)
+	d, _ = ra.Check(r)
+	assert.True(t, d.Allowed)
+	d, _ = ra.Check(r)
+	assert.False(t, d.Allowed)
+	assert.Greater(t, d.Throttle.RetryAfter, time.Duration(0))
+
+	// Rejected hits are not counted and the counter expires with the window.
+	assert.Equal(t, "2", mustGet(t, mr, "test:fw:9.9.9.9"))
+	assert.Greater(t, mr.TTL("test:fw:9.9.9.9"), time.Duration(0))
+
+	mr.FastForward(time.Minute)
+	d, _ = ra.Check(r)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Throttle.Remaining)
+}
+
+func TestFixedWindowExpiryJitter(t *testing.T) {
+	ra, mr, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		Key:          "fw:%{ip}",
+		Limit:        2,
+		Period:       time.Minute,
+		Algorithm:    rackattack.FixedWindow,
+		ExpiryJitter: 10 * time.Second,
+	}))
+
+	ttls := make(map[time.Duration]bool)
+	for i := 1; i <= 20; i++ {
+		_, _ = ra.Check(req("GET", "/", fmt.Sprintf("10.0.0.%d:1", i)))
+		ttl := mr.TTL(fmt.Sprintf("test:fw:10.0.0.%d", i))
+		assert.GreaterOrEqual(t, ttl, 50*time.Second)
+		assert.LessOrEqual(t, ttl, 70*time.Second)
+		ttls[ttl] = true
+	}
+	assert.Greater(t, len(ttls), 1, "windows should not all expire together")
+
+	err := ra.Throttle(rackattack.ThrottleRule{Key: "x:%{ip}", Limit: 1, Period: time.Minute, ExpiryJitter: -time.Second})
+	assert.Error(t, err)
+}
+
+func TestLeakyBucketThrottle(t *testing.T) {
+	ra, mr, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		Key:       "lb:%{ip}",
+		Limit:     10,
+		Period:    10 * time.Second,
+		Burst:     2,
+		Algorithm: rackattack.LeakyBucket,
+	}))
+	r := req("GET", "/", "9.9.9.9:1")
+
+	d, _ := ra.Check(r)
+	require.True(t, d.Allowed)
+	assert.Equal(t, 2, d.Throttle.Limit)
+	assert.Equal(t, 1, d.Throttle.Remaining)
+	d, _ = ra.Check(r)
+	require.True(t, d.Allowed)
+
+	d, err := ra.Check(r)
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Greater(t, d.Throttle.RetryAfter, time.Duration(0))
+	assert.LessOrEqual(t, d.Throttle.RetryAfter, time.Second, "one hit drains per second")
+	assert.Greater(t, mr.TTL("test:lb:9.9.9.9"), time.Duration(0))
+	assert.LessOrEqual(t, mr.TTL("test:lb:9.9.9.9"), 2*time.Second, "the key expires once the bucket is empty")
+}
+
+func TestDistinctThrottle(t *testing.T) {
+	ra, mr, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		Key:       "token:%{header:X-Api-Token}",
+		Limit:     2,
+		Period:    time.Hour,
+		Algorithm: rackattack.Distinct,
+	}))
+	from := func(ip string) *http.Request {
+		r := req("GET", "/", ip+":1")
+		r.Header.Set("X-Api-Token", "abc")
+		return r
+	}
+
+	d, _ := ra.Check(from("1.1.1.1"))
+	require.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Throttle.Remaining)
+	d, _ = ra.Check(from("2.2.2.2"))
+	require.True(t, d.Allowed)
+	d, _ = ra.Check(from("1.1.1.1"))
+	require.True(t, d.Allowed, "a repeat IP is not a new value")
+	assert.Greater(t, mr.TTL("test:token:abc"), 59*time.Minute)
+
+	d, err := ra.Check(from("3.3.3.3"))
+	require.NoError(t, err)
+	assert.False(t, d.Allowed, "a third IP crosses the limit")
+	assert.Greater(t, d.Throttle.RetryAfter, 59*time.Minute)
+	d, _ = ra.Check(from("1.1.1.1"))
+	assert.False(t, d.Allowed, "the shared token stays throttled for the window")
+
+	mr.FastForward(time.Hour)
+	d, _ = ra.Check(from("3.3.3.3"))
+	assert.True(t, d.Allowed)
+
+	err = ra.Throttle(rackattack.ThrottleRule{Key: "x:%{ip}", Limit: 1, Period: time.Minute, DistinctKey: "%{ip}"})
+	assert.ErrorIs(t, err, rackattack.ErrRuleInvalid, "only Distinct rules take a distinct key")
+	err = ra.Throttle(rackattack.ThrottleRule{Key: "x:%{ip}", Limit: 1, Period: time.Minute, Algorithm: rackattack.Distinct, Cost: 2})
+	assert.ErrorIs(t, err, rackattack.ErrRuleInvalid)
+}
+
+func TestTokenBucketThrottle(t *testing.T) {
+	ra, mr, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{
+		Key:       "tb:%{ip}",
+		Limit:     10,
+		Period:    10 * time.Second,
+		Burst:     2,
+		Algorithm: rackattack.TokenBucket,
+	})
+	r := req("GET", "/", "9.9.9.9:1")
+
+	d, _ := ra.Check(r)
+	require.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Throttle.Remaining)
+	d, _ = ra.Check(r)
+	require.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Throttle.Remaining)
+
+	d, err := ra.Check(r)
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, rackattack.ReasonThrottled, d.Reason)
+	assert.Greater(t, d.Throttle.RetryAfter, time.Duration(0))
+	assert.LessOrEqual(t, d.Throttle.RetryAfter, time.Second)
+	assert.Greater(t, mr.TTL("test:tb:9.9.9.9"), time.Duration(0))
+}
+
+// A token bucket's interval goes to Redis in full precision, so a fast rule
+// refills at its own rate rather than at a rounded one.
+func TestRedisTokenBucketSubMillisecondInterval(t *testing.T) {
+	mr := miniredis.RunT(t)
+	clock := &manualClock{t: time.Unix(1_700_000_000, 0)}
+	ra, err := rackattack.New(rackattack.NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:"), rackattack.WithClock(clock))
+	require.NoError(t, err)
+	// A 1.4µs interval and a burst of 1000, which one request spends.
+	ra.MustThrottle(rackattack.ThrottleRule{
+		Name: "fast", Key: "fast:%{ip}", Limit: 5000, Period: 7 * time.Millisecond, Burst: 1000, Cost: 1000,
+		Algorithm: rackattack.TokenBucket,
+	})
+	r := req("GET", "/", "9.9.9.9:1")
+
+	d, err := ra.Check(r)
+	require.NoError(t, err)
+	require.True(t, d.Allowed)
+	d, _ = ra.Check(r)
+	assert.False(t, d.Allowed, "the burst is spent")
+	clock.Advance(time.Millisecond)
+	d, _ = ra.Check(r)
+	assert.False(t, d.Allowed, "1ms refills about 714 of the 1000 tokens; a rounded 1µs interval refilled them all")
+	clock.Advance(time.Millisecond)
+	d, _ = ra.Check(r)
+	assert.True(t, d.Allowed, "the bucket refills")
+
+	require.True(t, ra.RemoveThrottleRule("fast"))
+	ra.MustThrottle(rackattack.ThrottleRule{
+		Key: "tiny:%{ip}", Limit: 10000, Period: time.Millisecond, Algorithm: rackattack.TokenBucket,
+	})
+	_, err = ra.Check(r)
+	assert.Error(t, err, "an interval under a microsecond is rejected, not admitted unchecked")
+	assert.False(t, mr.Exists("test:tiny:9.9.9.9"))
+}
+
+func mustGet(t *testing.T, mr *miniredis.Miniredis, key string) string {
+	t.Helper()
+	v, err := mr.Get(key)
+	require.NoError(t, err)
+	return v
+}
+
+// A burst allowance over a sustained rate is a token bucket: Burst is the
+// burst, Limit per Period the sustained rate, and both are enforced.
+func TestTokenBucketBurstAndSustainedRate(t *testing.T) {
+	clock := &manualClock{t: time.Unix(1_700_000_000, 0)}
+	ra, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithClock(clock))
+	require.NoError(t, err)
+	ra.MustThrottle(rackattack.ThrottleRule{
+		Key: "api:%{ip}", Limit: 5, Period: time.Second, Burst: 20, Algorithm: rackattack.TokenBucket,
+	})
+	r := req("GET", "/", "9.9.9.9:1")
+
+	for i := 0; i < 20; i++ {
+		d, _ := ra.Check(r)
+		require.True(t, d.Allowed, "request %d is within the burst", i)
+	}
+	d, _ := ra.Check(r)
+	assert.False(t, d.Allowed, "the burst is spent")
+	assert.Equal(t, 200*time.Millisecond, d.Throttle.RetryAfter, "one token refills every 200ms")
+
+	clock.Advance(time.Second)
+	for i := 0; i < 5; i++ {
+		d, _ = ra.Check(r)
+		require.True(t, d.Allowed, "request %d is within the sustained rate", i)
+	}
+	d, _ = ra.Check(r)
+	assert.False(t, d.Allowed, "no more than 5 per second once the burst is spent")
+}
+
+// Every key the Redis store writes must carry a TTL from the same atomic
+// script that creates it, so a crash mid-request cannot strand a counter.
+func TestRedisKeysAlwaysExpire(t *testing.T) {
+	ra, mr, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Key: "sw:%{ip}", Limit: 5, Period: time.Minute})
+	ra.Fail2Ban(rackattack.Fail2BanRule{Name: "f2b", MaxRetry: 5, FindTime: time.Minute, BanTime: time.Hour})
+
+	_, err := ra.Check(req("GET", "/", "9.9.9.9:1"))
+	require.NoError(t, err)
+
+	keys := mr.Keys()
+	require.NotEmpty(t, keys)
+	for _, k := range keys {
+		assert.Greater(t, mr.TTL(k), time.Duration(0), "key %q has no TTL", k)
+	}
+}
+
+func TestCheckPropagatesRequestContext(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Key: "ctx:%{ip}", Limit: 5, Period: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := req("GET", "/", "1.2.3.4:1").WithContext(ctx)
+
+	_, err := ra.Check(r)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	throttled, err := ra.IsThrottled(r)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, throttled)
+}
+
+func TestTrustedProxyWalksChainRightToLeft(t *testing.T) {
+	cases := []struct {
+		name, peer, xff, want string
+	}{
+		// The left-most entry is attacker-controlled; the right-most
+		// untrusted hop is what our edge proxy actually saw.
+		{"spoofed prefix", "10.0.0.1:1", "1.1.1.1, 203.0.113.5, 172.16.0.9", "203.0.113.5"},
+		{"single hop", "10.0.0.1:1", "198.51.100.2", "198.51.100.2"},
+		{"all trusted", "10.0.0.1:1", "10.0.0.2, 172.16.0.3", "10.0.0.1"},
+		{"no header", "10.0.0.1:1", "", "10.0.0.1"},
+		{"untrusted peer", "198.51.100.9:1", "1.1.1.1", "198.51.100.9"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ra, err := rackattack.New(rackattack.NewMemoryStore(),
+				rackattack.WithTrustedProxies("10.0.0.0/8", "172.16.0.0/12"))
+			require.NoError(t, err)
+			// Blocklisting the expected address proves which one was resolved.
+			ra.BlocklistIP(tc.want)
+
+			r := req("GET", "/", tc.peer)
+			if tc.xff != "" {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			d, err := ra.Check(r)
+			require.NoError(t, err)
+			assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+		})
+	}
+}
+
+func TestTrustedProxiesRejectsInvalidCIDR(t *testing.T) {
+	_, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithTrustedProxies("10.0.0.0/33"))
+	assert.Error(t, err)
+}
+
+func TestTrustedProxyHopsSkipsRightmostEntries(t *testing.T) {
+	cases := []struct {
+		name, xff, want string
+	}{
+		{"third from right", "1.1.1.1, 203.0.113.5, 198.51.100.7, 172.16.0.9", "203.0.113.5"},
+		{"exact length", "203.0.113.5, 198.51.100.7, 172.16.0.9", "203.0.113.5"},
+		{"too short", "198.51.100.7, 172.16.0.9", "10.0.0.1"},
+		{"no header", "", "10.0.0.1"},
+		{"garbage entry", "nonsense, 198.51.100.7, 172.16.0.9", "10.0.0.1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ra, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithTrustedProxyHops(2))
+			require.NoError(t, err)
+			ra.BlocklistIP(tc.want)
+
+			r := req("GET", "/", "10.0.0.1:1")
+			if tc.xff != "" {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			d, err := ra.Check(r)
+			require.NoError(t, err)
+			assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+		})
+	}
+
+	_, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithTrustedProxyHops(-1))
+	assert.Error(t, err)
+}
+
+func TestSafelistCIDRBypassesThrottleAndRejectsInvalid(t *testing.T) {
+	ra, _, _ := setup(t)
+	assert.Error(t, ra.SafelistCIDR("10.0.0.0"))
+	assert.Error(t, ra.SafelistCIDR("not-a-cidr"))
+	require.NoError(t, ra.SafelistCIDR("10.20.0.0/16"))
+	ra.Throttle(rackattack.ThrottleRule{Key: "s:%{ip}", Limit: 1, Period: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		d, err := ra.Check(req("GET", "/", "10.20.30.40:1"))
+		require.NoError(t, err)
+		assert.True(t, d.Allowed)
+		assert.Equal(t, rackattack.ReasonSafelisted, d.Reason)
+	}
+	_, _ = ra.Check(req("GET", "/", "10.21.0.1:1"))
+	d, _ := ra.Check(req("GET", "/", "10.21.0.1:1"))
+	assert.False(t, d.Allowed, "addresses outside the range are still throttled")
+}
+
+func TestThrottleRuleMultipleMethods(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{
+		PathPattern: "/items",
+		Method:      "post, PUT",
+		Key:         "w:%{ip}",
+		Limit:       1,
+		Period:      time.Minute,
+	})
+
+	d, _ := ra.Check(req("POST", "/items", "2.2.2.2:1"))
+	assert.True(t, d.Allowed)
+	d, _ = ra.Check(req("put", "/items", "2.2.2.2:1"))
+	assert.False(t, d.Allowed, "PUT shares the POST bucket")
+
+	d, _ = ra.Check(req("GET", "/items", "2.2.2.2:1"))
+	assert.True(t, d.Allowed)
+	assert.Nil(t, d.Rule, "GET is not in the method list")
+}
+
+func TestEmptyMethodMatchesEveryMethod(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Key: "any:%{ip}", Limit: 3, Period: time.Minute})
+
+	for _, m := range []string{"GET", "POST", "DELETE"} {
+		d, err := ra.Check(req(m, "/", "2.3.4.5:1"))
+		require.NoError(t, err)
+		require.NotNil(t, d.Rule, "%s should match an empty Method", m)
+	}
+	d, _ := ra.Check(req("PATCH", "/", "2.3.4.5:1"))
+	assert.False(t, d.Allowed, "all methods share one bucket")
+}
+
+func TestWildcardMethodMatchesEveryMethod(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Method: "*", Key: "any:%{ip}:%{method}", Limit: 1, Period: time.Minute})
+
+	for _, m := range []string{"GET", "POST", "DELETE"} {
+		throttled, err := ra.IsThrottled(req(m, "/", "2.3.4.5:1"))
+		require.NoError(t, err)
+		assert.False(t, throttled, "%s has its own bucket", m)
+		throttled, _ = ra.IsThrottled(req(m, "/", "2.3.4.5:1"))
+		assert.True(t, throttled, "%s should match a * Method", m)
+	}
+}
+
+type userIDKey struct{}
+
+func TestThrottleByContextValue(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithContextKey("userID", userIDKey{}))
+	require.NoError(t, err)
+	ra.MustThrottle(rackattack.ThrottleRule{Name: "user", Key: "user:%{context:userID}", Limit: 1, Period: time.Minute})
+	as := func(user any) *http.Request {
+		r := req("GET", "/", "10.0.0.1:1") // everyone shares one NAT address
+		return r.WithContext(context.WithValue(r.Context(), userIDKey{}, user))
+	}
+
+	assert.Equal(t, "user:alice", ra.KeyFor(ra.Rules()[0], as("alice")))
+	assert.Equal(t, "user:42", ra.KeyFor(ra.Rules()[0], as(42)))
+	d, _ := ra.Check(as("alice"))
+	assert.True(t, d.Allowed)
+	d, _ = ra.Check(as("bob"))
+	assert.True(t, d.Allowed, "users behind one IP have their own buckets")
+	d, _ = ra.Check(as("alice"))
+	assert.False(t, d.Allowed)
+
+	rule := rackattack.ThrottleRule{Name: "uid", KeyFunc: rackattack.ContextKeyFunc("uid:", userIDKey{}), Limit: 1, Period: time.Minute}
+	assert.Equal(t, "uid:alice", ra.KeyFor(rule, as("alice")))
+	assert.Empty(t, ra.KeyFor(rule, req("GET", "/", "10.0.0.1:1")), "anonymous requests skip the rule")
+
+	_, err = rackattack.New(rackattack.NewMemoryStore(), rackattack.WithContextKey("", userIDKey{}))
+	assert.Error(t, err)
+}
+
+func TestCustomClientIPFunc(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore(),
+		rackattack.WithClientIPFunc(func(r *http.Request) string {
+			return r.Header.Get("CF-Connecting-IP")
+		}),
+	)
+	require.NoError(t, err)
+	ra.BlocklistIP("203.0.113.50")
+
+	r := req("GET", "/", "198.51.100.1:1")
+	r.Header.Set("CF-Connecting-IP", "203.0.113.50")
+	d, _ := ra.Check(r)
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+
+	_, err = rackattack.New(rackattack.NewMemoryStore(), rackattack.WithClientIPFunc(nil))
+	assert.Error(t, err)
+}
+
+func TestUnresolvableClientIPUsesSentinel(t *testing.T) {
+	ra, _, _ := setup(t)
+	ctx := context.Background()
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}", Limit: 1, Period: time.Minute}))
+
+	_, err := ra.Check(req("GET", "/", "1.2.3.4"))
+	require.NoError(t, err)
+	found, err := ra.ResetThrottle(ctx, "api:1.2.3.4")
+	require.NoError(t, err)
+	assert.True(t, found, "a port-less RemoteAddr is the IP")
+
+	noAddr := req("GET", "/", "")
+	d, err := ra.Check(noAddr)
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	found, err = ra.ResetThrottle(ctx, "api:"+rackattack.UnknownClientIP)
+	require.NoError(t, err)
+	assert.True(t, found, "an empty RemoteAddr counts under the sentinel, not the empty key")
+
+	custom, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithClientIPFunc(func(*http.Request) string {
+		return "not-an-ip"
+	}))
+	require.NoError(t, err)
+	custom.Throttle(rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	_, _ = custom.Check(req("GET", "/", "1.1.1.1:1"))
+	found, _ = custom.ResetThrottle(ctx, "api:unknown")
+	assert.True(t, found, "an unparseable result counts under the sentinel")
+}
+
+func TestThrottleRulePathRegex(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{
+		PathRegex: regexp.MustCompile(`^/api/v[12]/users/\d+$`),
+		Key:       "re:%{ip}",
+		Limit:     1,
+		Period:    time.Minute,
+	})
+
+	d, _ := ra.Check(req("GET", "/api/v1/users/42", "2.2.2.2:1"))
+	assert.True(t, d.Allowed)
+	require.NotNil(t, d.Rule)
+	d, _ = ra.Check(req("GET", "/api/v2/users/7", "2.2.2.2:1"))
+	assert.False(t, d.Allowed)
+
+	for _, p := range []string{"/api/v3/users/1", "/api/v1/users/abc", "/api/v1/users/1/posts"} {
+		d, _ = ra.Check(req("GET", p, "2.2.2.2:1"))
+		assert.Nil(t, d.Rule, p)
+	}
+
+	// The path is cleaned before matching, so traversal cannot dodge the rule.
+	d, _ = ra.Check(req("GET", "/static/../api/v1/users/9", "2.2.2.2:1"))
+	assert.NotNil(t, d.Rule)
+}
+
+func TestRemoveAndClearThrottleRules(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Name: "login", Key: "l:%{ip}", Limit: 1, Period: time.Minute})
+	ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 100, Period: time.Minute})
+
+	d, _ := ra.Check(req("GET", "/", "2.2.2.2:1"))
+	assert.Equal(t, "login", d.RuleName)
+
+	assert.True(t, ra.RemoveThrottleRule("login"))
+	assert.False(t, ra.RemoveThrottleRule("login"))
+	d, _ = ra.Check(req("GET", "/", "2.2.2.2:1"))
+	assert.True(t, d.Allowed, "the removed rule no longer throttles")
+	assert.Equal(t, "api:%{ip}", d.RuleName, "unnamed rules are identified by Key")
+
+	// Removal by Key works for unnamed rules.
+	assert.True(t, ra.RemoveThrottleRule("api:%{ip}"))
+
+	ra.Throttle(rackattack.ThrottleRule{Key: "x", Limit: 1, Period: time.Minute})
+	ra.ClearThrottleRules()
+	d, _ = ra.Check(req("GET", "/", "2.2.2.2:1"))
+	assert.Nil(t, d.Rule)
+}
+
+func TestUnblocklistAndUnsafelist(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.BlocklistIP("6.6.6.6")
+	require.NoError(t, ra.BlocklistCIDR("192.0.2.0/24"))
+	ra.SafelistIP("7.7.7.7")
+	require.NoError(t, ra.SafelistCIDR("10.0.0.0/8"))
+
+	ra.UnblocklistIP("6.6.6.6")
+	require.NoError(t, ra.UnblocklistCIDR("192.0.2.77/24")) // normalizes to 192.0.2.0/24
+	ra.UnsafelistIP("7.7.7.7")
+	require.NoError(t, ra.UnsafelistCIDR("10.0.0.0/8"))
+	assert.Error(t, ra.UnblocklistCIDR("bogus"))
+
+	for _, ip := range []string{"6.6.6.6", "192.0.2.5", "7.7.7.7", "10.1.1.1"} {
+		d, err := ra.Check(req("GET", "/", ip+":1"))
+		require.NoError(t, err)
+		assert.Equal(t, rackattack.ReasonNone, d.Reason, ip)
+	}
+}
+
+func TestTemporaryBlocklist(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	newInstance := func() *rackattack.RedisRackAttack {
+		ra, err := rackattack.New(rackattack.NewRedisStore(client, "test:"), rackattack.WithTemporaryBlocklist())
+		require.NoError(t, err)
+		return ra
+	}
+	a, b := newInstance(), newInstance()
+	ctx := context.Background()
+
+	require.NoError(t, a.BlocklistIPFor(ctx, "203.0.113.9", 15*time.Minute))
+	assert.Error(t, a.BlocklistIPFor(ctx, "203.0.113.9", 0))
+
+	// The block is shared through the store.
+	d, err := b.Check(req("GET", "/", "203.0.113.9:1"))
+	require.NoError(t, err)
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+
+	d, _ = b.Check(req("GET", "/", "203.0.113.10:1"))
+	assert.True(t, d.Allowed)
+
+	mr.FastForward(15 * time.Minute)
+	d, _ = b.Check(req("GET", "/", "203.0.113.9:1"))
+	assert.True(t, d.Allowed, "the block expires on its own")
+}
+
+func TestIsBlockedCtx(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ra, err := rackattack.New(rackattack.NewRedisStore(client, "test:"), rackattack.WithTemporaryBlocklist())
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, ra.BlocklistIP("6.6.6.6"))
+	require.NoError(t, ra.BlocklistCIDR("198.51.100.0/24"))
+	require.NoError(t, ra.BlocklistIPFor(ctx, "203.0.113.9", time.Minute))
+
+	assert.True(t, ra.IsBlocked("6.6.6.6"))
+	assert.True(t, ra.IsBlocked("198.51.100.7"))
+	assert.False(t, ra.IsBlocked("203.0.113.9"), "IsBlocked does not ask the store")
+	assert.False(t, ra.IsBlocked("nope"))
+
+	for ip, want := range map[string]bool{"6.6.6.6": true, "198.51.100.7": true, "203.0.113.9": true, "203.0.113.10": false} {
+		blocked, err := ra.IsBlockedCtx(ctx, ip)
+		require.NoError(t, err)
+		assert.Equal(t, want, blocked, ip)
+	}
+	_, err = ra.IsBlockedCtx(ctx, "nope")
+	assert.Error(t, err)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = ra.IsBlockedCtx(canceled, "203.0.113.10")
+	assert.ErrorIs(t, err, context.Canceled)
+	var se *rackattack.StoreError
+	assert.ErrorAs(t, err, &se)
+
+	mr.FastForward(time.Minute)
+	blocked, _ := ra.IsBlockedCtx(ctx, "203.0.113.9")
+	assert.False(t, blocked, "the temporary block expired")
+}
+
+func TestTemporaryBlocklistRequiresOption(t *testing.T) {
+	ra, _, _ := setup(t)
+	assert.Error(t, ra.BlocklistIPFor(context.Background(), "1.2.3.4", time.Minute))
+}
+
+func TestThrottleBanPolicyEscalates(t *testing.T) {
+	ra, mr, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{
+		Name:   "login",
+		Key:    "login:%{ip}",
+		Limit:  1,
+		Period: time.Minute,
+		Ban:    rackattack.BanPolicy{MaxRetry: 2, FindTime: time.Minute, BanTime: time.Hour},
+	})
+	r := req("POST", "/login", "4.4.4.4:1")
+
+	d, _ := ra.Check(r)
+	require.True(t, d.Allowed)
+	for i := 0; i < 2; i++ {
+		d, _ = ra.Check(r)
+		assert.Equal(t, rackattack.ReasonThrottled, d.Reason)
+	}
+	d, _ = ra.Check(r)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, rackattack.ReasonBanned, d.Reason)
+	assert.Equal(t, "login", d.RuleName)
+
+	// The ban outlives the throttle window.
+	mr.FastForward(2 * time.Minute)
+	d, _ = ra.Check(r)
+	assert.Equal(t, rackattack.ReasonBanned, d.Reason)
+
+	// Other clients are unaffected.
+	d, _ = ra.Check(req("POST", "/login", "4.4.4.5:1"))
+	assert.True(t, d.Allowed)
+
+	mr.FastForward(time.Hour)
+	d, _ = ra.Check(r)
+	assert.True(t, d.Allowed)
+}
+
+func TestThrottleBanPolicyBackoff(t *testing.T) {
+	ra, mr, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{
+		Name:   "login",
+		Key:    "login:%{ip}",
+		Limit:  1,
+		Period: time.Minute,
+		Ban: rackattack.BanPolicy{
+			MaxRetry: 1, FindTime: time.Minute, BanTime: time.Minute,
+			Backoff: 2, MaxBanTime: 3 * time.Minute,
+		},
+	})
+	r := req("POST", "/login", "4.4.4.4:1")
+	banKey := "test:ban:throttle:login:4.4.4.4"
+
+	// Each ban doubles the last, up to MaxBanTime: 1m, 2m, then 3m not 4m.
+	for level, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		d, _ := ra.Check(r)
+		require.True(t, d.Allowed)
+		d, _ = ra.Check(r)
+		require.Equal(t, rackattack.ReasonThrottled, d.Reason)
+		assert.Equal(t, level+1, d.BanLevel)
+		assert.Equal(t, want, mr.TTL(banKey))
+
+		d, _ = ra.Check(r)
+		assert.Equal(t, rackattack.ReasonBanned, d.Reason)
+		mr.FastForward(want)
+	}
+
+	// A quiet spell as long as the last ban resets the level.
+	mr.FastForward(3 * time.Minute)
+	_, _ = ra.Check(r)
+	d, _ := ra.Check(r)
+	assert.Equal(t, 1, d.BanLevel)
+	assert.Equal(t, time.Minute, mr.TTL(banKey))
+}
+
+func TestRedisStoreStrikeUncappedBackoff(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := rackattack.NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:")
+	ctx := context.Background()
+	p := rackattack.BanPolicy{MaxRetry: 1, FindTime: time.Minute, BanTime: time.Hour, Backoff: 1e10}
+
+	// Ban 2 overflows time.Duration and ban 32 overflows float64; all are
+	// held to the longest Duration, as on MemoryStore.
+	for level := 1; level <= 32; level++ {
+		banned, got, err := store.Strike(ctx, "k", p)
+		require.NoError(t, err, level)
+		assert.True(t, banned)
+		assert.Equal(t, level, got)
+		if level > 1 {
+			assert.Equal(t, time.Duration(math.MaxInt64).Truncate(time.Millisecond), mr.TTL("test:ban:k"), level)
+		}
+		mr.Del("test:ban:k")
+	}
+}
+
+func TestTrackBansAfterLimit(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithTemporaryBlocklist())
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		banned, err := ra.Track(ctx, "5.5.5.5", 3, time.Minute, time.Hour)
+		require.NoError(t, err)
+		assert.False(t, banned)
+		d, _ := ra.Check(req("GET", "/", "5.5.5.5:1"))
+		assert.True(t, d.Allowed)
+	}
+	banned, err := ra.Track(ctx, "5.5.5.5", 3, time.Minute, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, banned)
+
+	d, _ := ra.Check(req("GET", "/", "5.5.5.5:1"))
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+
+	// The discriminator is normalized like a client IP.
+	_, err = ra.Track(ctx, "::ffff:6.6.6.6", 1, time.Minute, time.Hour)
+	require.NoError(t, err)
+	d, _ = ra.Check(req("GET", "/", "6.6.6.6:1"))
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+	_, err = ra.Track(ctx, "not-an-ip", 1, time.Minute, time.Hour)
+	assert.Error(t, err)
+	for _, bad := range [][3]int{{0, 1, 1}, {1, 0, 1}, {1, 1, -1}} {
+		_, err = ra.Track(ctx, "7.7.7.7", bad[0], time.Duration(bad[1])*time.Minute, time.Duration(bad[2])*time.Hour)
+		assert.ErrorIs(t, err, rackattack.ErrRuleInvalid, bad)
+	}
+
+	plain, _, _ := setup(t)
+	_, err = plain.Track(ctx, "5.5.5.5", 3, time.Minute, time.Hour)
+	assert.Error(t, err)
+}
+
+func TestDecisionExplainsOutcome(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.SafelistIP("1.1.1.1")
+	ra.BlocklistIP("2.2.2.2")
+	ra.Throttle(rackattack.ThrottleRule{Name: "tight", Key: "t:%{ip}", Limit: 1, Period: time.Minute})
+
+	d, _ := ra.Check(req("GET", "/", "1.1.1.1:1"))
+	assert.Equal(t, "safelisted", d.Reason.String())
+	d, _ = ra.Check(req("GET", "/", "2.2.2.2:1"))
+	assert.Equal(t, "blocklisted", d.Reason.String())
+	d, _ = ra.Check(req("GET", "/", "3.3.3.3:1"))
+	assert.Equal(t, "allowed", d.Reason.String())
+	d, _ = ra.Check(req("GET", "/", "3.3.3.3:1"))
+	assert.Equal(t, "throttled", d.Reason.String())
+	assert.Equal(t, "tight", d.RuleName)
+	assert.Equal(t, "banned", rackattack.ReasonBanned.String())
+	assert.Equal(t, "unknown", rackattack.ReasonKind(42).String())
+}
+
+func TestDenyCallbacks(t *testing.T) {
+	var throttled []string
+	var blocked []string
+	ra, err := rackattack.New(rackattack.NewMemoryStore(),
+		rackattack.WithOnThrottled(func(_ *http.Request, rule rackattack.ThrottleRule) {
+			throttled = append(throttled, rule.Name)
+		}),
+		rackattack.WithOnBlocked(func(_ *http.Request, ip string) {
+			blocked = append(blocked, ip)
+		}),
+	)
+	require.NoError(t, err)
+	ra.BlocklistIP("6.6.6.6")
+	ra.Throttle(rackattack.ThrottleRule{Name: "api", Key: "a:%{ip}", Limit: 1, Period: time.Minute})
+
+	_, _ = ra.Check(req("GET", "/", "1.2.3.4:1"))
+	assert.Empty(t, throttled, "allowed requests do not fire callbacks")
+	_, _ = ra.Check(req("GET", "/", "1.2.3.4:1"))
+	_, _ = ra.Check(req("GET", "/", "6.6.6.6:1"))
+
+	assert.Equal(t, []string{"api"}, throttled)
+	assert.Equal(t, []string{"6.6.6.6"}, blocked)
+}
+
+type countingMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (m *countingMetrics) ObserveDecision(d rackattack.Decision) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[d.Reason.String()+"/"+d.RuleName]++
+}
+
+func TestMetricsObservesDecisions(t *testing.T) {
+	m := &countingMetrics{counts: map[string]int{}}
+	ra, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithMetrics(m))
+	require.NoError(t, err)
+	ra.BlocklistIP("6.6.6.6")
+	ra.Throttle(rackattack.ThrottleRule{Name: "login", Key: "l:%{ip}", Limit: 1, Period: time.Minute})
+
+	_, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+	_, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+	_, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+	_, _ = ra.Check(req("GET", "/", "6.6.6.6:1"))
+
+	assert.Equal(t, map[string]int{
+		"allowed/login":   1,
+		"throttled/login": 2,
+		"blocklisted/":    1,
+	}, m.counts)
+}
+
+type recordedSpan struct {
+	name  string
+	attrs map[string]any
+	err   error
+	ended bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value any) { s.attrs[key] = value }
+func (s *recordedSpan) RecordError(err error)              { s.err = err }
+func (s *recordedSpan) End()                               { s.ended = true }
+
+type recordingTracer struct{ spans []*recordedSpan }
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, rackattack.Span) {
+	s := &recordedSpan{name: name, attrs: map[string]any{}}
+	t.spans = append(t.spans, s)
+	return ctx, s
+}
+
+func TestTracerSpansChecks(t *testing.T) {
+	mr := miniredis.RunT(t)
+	tr := &recordingTracer{}
+	store := rackattack.NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:")
+	ra, err := rackattack.New(store, rackattack.WithTracer(tr))
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Name: "login", Key: "l:%{ip}", Limit: 1, Period: time.Minute})
+
+	_, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+	_, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+	mr.Close()
+	_, err = ra.Check(req("GET", "/", "1.1.1.1:1"))
+	require.Error(t, err)
+
+	require.Len(t, tr.spans, 3)
+	for _, s := range tr.spans {
+		assert.Equal(t, "rackattack.check", s.name)
+		assert.True(t, s.ended)
+		assert.Greater(t, s.attrs["rackattack.store.duration_ms"], 0.0)
+	}
+	assert.Equal(t, "allowed", tr.spans[0].attrs["rackattack.decision"])
+	assert.Equal(t, true, tr.spans[0].attrs["rackattack.allowed"])
+	assert.Equal(t, "throttled", tr.spans[1].attrs["rackattack.decision"])
+	assert.Equal(t, "login", tr.spans[1].attrs["rackattack.rule"])
+	assert.Error(t, tr.spans[2].err)
+	assert.NotContains(t, tr.spans[2].attrs, "rackattack.decision")
+}
+
+func TestDryRunRuleReportsWithoutDenying(t *testing.T) {
+	var fired []string
+	m := &countingMetrics{counts: map[string]int{}}
+	ra, err := rackattack.New(rackattack.NewMemoryStore(),
+		rackattack.WithMetrics(m),
+		rackattack.WithOnThrottled(func(_ *http.Request, rule rackattack.ThrottleRule) {
+			fired = append(fired, rule.Name)
+		}),
+	)
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{
+		Name: "candidate", Key: "c:%{ip}", Limit: 1, Period: time.Minute, DryRun: true,
+		Ban: rackattack.BanPolicy{MaxRetry: 1, FindTime: time.Minute, BanTime: time.Hour},
+	})
+
+	for i := 0; i < 3; i++ {
+		d, err := ra.Check(req("GET", "/", "1.1.1.1:1"))
+		require.NoError(t, err)
+		assert.True(t, d.Allowed)
+		assert.Nil(t, d.Rule, "dry-run rules stay out of client-facing state")
+		if i == 0 {
+			assert.Empty(t, d.DryRun)
+		} else {
+			assert.Equal(t, []string{"candidate"}, d.DryRun)
+		}
+	}
+	assert.Equal(t, []string{"candidate", "candidate"}, fired)
+	assert.Equal(t, 3, m.counts["allowed/"])
+}
+
+func TestResetThrottle(t *testing.T) {
+	ra, _, _ := setup(t)
+	rule := rackattack.ThrottleRule{Key: "r:%{ip}", Limit: 1, Period: time.Minute}
+	ra.Throttle(rule)
+	ctx := context.Background()
+	r := req("GET", "/", "1.1.1.1:1")
+
+	_, _ = ra.Check(r)
+	d, _ := ra.Check(r)
+	require.False(t, d.Allowed)
+
+	existed, err := ra.ResetThrottle(ctx, "r:1.1.1.1")
+	require.NoError(t, err)
+	assert.True(t, existed)
+	d, _ = ra.Check(r)
+	assert.True(t, d.Allowed)
+
+	existed, err = ra.ResetThrottleFor(ctx, rule, r)
+	require.NoError(t, err)
+	assert.True(t, existed)
+	d, _ = ra.Check(r)
+	assert.True(t, d.Allowed)
+
+	existed, err = ra.ResetThrottle(ctx, "r:9.9.9.9")
+	require.NoError(t, err)
+	assert.False(t, existed)
+}
+
+func TestRetryAfter(t *testing.T) {
+	ra, _, _ := setup(t)
+	rule := rackattack.ThrottleRule{Key: "r:%{ip}", Limit: 2, Period: time.Minute}
+	require.NoError(t, ra.Throttle(rule))
+	ctx := context.Background()
+	r := req("GET", "/", "1.1.1.1:1")
+
+	wait, err := ra.RetryAfter(ctx, rule, r)
+	require.NoError(t, err)
+	assert.Zero(t, wait, "no counter yet")
+
+	_, _ = ra.Check(r)
+	wait, _ = ra.RetryAfter(ctx, rule, r)
+	assert.Zero(t, wait, "room left")
+
+	_, _ = ra.Check(r)
+	wait, err = ra.RetryAfter(ctx, rule, r)
+	require.NoError(t, err)
+	assert.Greater(t, wait, 59*time.Second)
+	assert.LessOrEqual(t, wait, time.Minute)
+
+	d, _ := ra.Check(r)
+	assert.False(t, d.Allowed, "RetryAfter does not consume the budget for the Check that follows")
+}
+
+func TestIPv6BlocklistAndForwarding(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithTrustedProxies("2001:db8:ffff::/48"))
+	require.NoError(t, err)
+	require.NoError(t, ra.BlocklistCIDR("2001:db8::/32"))
+	require.NoError(t, ra.SafelistCIDR("2001:db8:ffff::/48"))
+
+	d, _ := ra.Check(req("GET", "/", "[2001:db8::1]:443"))
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+
+	d, _ = ra.Check(req("GET", "/", "[2001:db9::1]:443"))
+	assert.Equal(t, rackattack.ReasonNone, d.Reason)
+
+	// A bracketed, port-carrying XFF entry behind a trusted IPv6 proxy is
+	// resolved to the client, not safelisted as the proxy.
+	r := req("GET", "/", "[2001:db8:ffff::10]:443")
+	r.Header.Set("X-Forwarded-For", "[2001:db8:0:0::7]:5555")
+	d, _ = ra.Check(r)
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+}
+
+func TestRedisStoreAcceptsUniversalClient(t *testing.T) {
+	mr := miniredis.RunT(t)
+	var client redis.UniversalClient = redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{mr.Addr()}})
+	ra, err := rackattack.New(rackattack.NewRedisStore(client, "u:"))
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "%{ip}", Limit: 1, Period: time.Minute})
+
+	d, err := ra.Check(req("GET", "/", "1.2.3.4:1"))
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.True(t, mr.Exists("u:1.2.3.4"))
+}
+
+func TestStoresRejectInvalidQuotas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	stores := map[string]rackattack.Store{
+		"memory": rackattack.NewMemoryStore(),
+		"redis":  rackattack.NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:"),
+	}
+	ctx := context.Background()
+	for name, store := range stores {
+		for _, alg := range []rackattack.Algorithm{rackattack.SlidingWindow, rackattack.FixedWindow, rackattack.TokenBucket, rackattack.LeakyBucket, rackattack.Distinct} {
+			for _, q := range []rackattack.Quota{{Limit: 0, Period: time.Minute}, {Limit: -1, Period: time.Minute}, {Limit: 5, Period: 0}} {
+				q.Algorithm = alg
+				_, err := store.Throttle(ctx, "k", q)
+				assert.Error(t, err, "%s %v Throttle %+v", name, alg, q)
+				_, err = store.Peek(ctx, "k", q)
+				assert.Error(t, err, "%s %v Peek %+v", name, alg, q)
+			}
+		}
+	}
+	assert.Empty(t, mr.Keys())
+
+	short := rackattack.Quota{Algorithm: rackattack.LeakyBucket, Limit: 5, Period: 500 * time.Microsecond}
+	_, err := stores["redis"].Throttle(ctx, "k", short)
+	assert.Error(t, err, "the period rounds to zero milliseconds")
+	_, err = stores["memory"].Throttle(ctx, "k", short)
+	assert.NoError(t, err)
+}
+
+func TestResultFromContextInAllowedHandler(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.MustThrottle(rackattack.ThrottleRule{Name: "api", PathPattern: "/api/*", Key: "api:%{ip}", Limit: 5, Period: time.Minute})
+	var res rackattack.Result
+	var matched bool
+	var d rackattack.Decision
+	h := ra.Middleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		res, matched = rackattack.ResultFromContext(r.Context())
+		d, _ = rackattack.DecisionFromContext(r)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), req("GET", "/api/x", "1.1.1.1:1"))
+	require.True(t, matched)
+	assert.Equal(t, 4, res.Remaining)
+	assert.Equal(t, 5, res.Limit)
+	assert.Equal(t, "api", d.RuleName)
+
+	h.ServeHTTP(httptest.NewRecorder(), req("GET", "/static/x", "1.1.1.1:1"))
+	assert.False(t, matched, "no throttle rule matched")
+	assert.True(t, d.Allowed)
+}
+
+func TestPerRuleDeniedHandler(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.BlocklistIP("6.6.6.6")
+	ra.Throttle(rackattack.ThrottleRule{
+		PathPattern: "/api/*",
+		Key:         "api:%{ip}",
+		Limit:       1,
+		Period:      time.Minute,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			d, ok := rackattack.DecisionFromContext(r)
+			require.True(t, ok)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = fmt.Fprintf(w, `{"error":"rate_limited","retry_after":%d}`, int(d.Throttle.RetryAfter.Round(time.Second).Seconds()))
+		},
+	})
+	h := ra.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/api/x", "1.1.1.1:1"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/api/x", "1.1.1.1:1"))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.JSONEq(t, `{"error":"rate_limited","retry_after":60}`, rec.Body.String())
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"), "headers are set before the handler runs")
+
+	// Denials not tied to the rule fall back to the default handler.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/api/x", "6.6.6.6:1"))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, "Forbidden\n", rec.Body.String())
+}
+
+func TestCountIfRecordsOnlyMatchingResponses(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{
+		Name:        "failed-logins",
+		PathPattern: "/login",
+		Key:         "login:%{ip}",
+		Limit:       2,
+		Period:      time.Minute,
+		CountIf:     func(status int) bool { return status == http.StatusUnauthorized },
+	})
+	status := http.StatusOK
+	h := ra.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}))
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req("POST", "/login", "7.7.7.7:1"))
+		return rec.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, http.StatusOK, serve(), "successful logins do not count")
+	}
+	status = http.StatusUnauthorized
+	assert.Equal(t, http.StatusUnauthorized, serve())
+	assert.Equal(t, http.StatusUnauthorized, serve())
+	assert.Equal(t, http.StatusTooManyRequests, serve())
+
+	// Check alone never counts; Record does.
+	other := req("POST", "/login", "7.7.7.8:1")
+	for i := 0; i < 3; i++ {
+		d, err := ra.Check(other)
+		require.NoError(t, err)
+		require.True(t, d.Allowed)
+	}
+	require.NoError(t, ra.Record(other, http.StatusUnauthorized))
+	require.NoError(t, ra.Record(other, http.StatusUnauthorized))
+	d, _ := ra.Check(other)
+	assert.Equal(t, rackattack.ReasonThrottled, d.Reason)
+}
+
+func TestStatusCostWeighsHitsByResponse(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.MustThrottle(rackattack.ThrottleRule{
+		Name:   "api",
+		Key:    "api:%{ip}",
+		Limit:  3,
+		Period: time.Minute,
+		StatusCost: func(status int) int {
+			switch {
+			case status >= 500:
+				return 0 // our fault, not the client's
+			case status == http.StatusTooManyRequests:
+				return 0
+			case status >= 400:
+				return 2
+			}
+			return 1
+		},
+	})
+	status := http.StatusInternalServerError
+	h := ra.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}))
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req("GET", "/", "7.7.7.7:1"))
+		return rec.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, http.StatusInternalServerError, serve(), "server errors do not count")
+	}
+	status = http.StatusOK
+	assert.Equal(t, http.StatusOK, serve())
+	status = http.StatusBadRequest
+	assert.Equal(t, http.StatusBadRequest, serve(), "counts as two")
+	assert.Equal(t, http.StatusTooManyRequests, serve())
+
+	err := ra.Throttle(rackattack.ThrottleRule{Key: "x:%{ip}", Limit: 1, Period: time.Minute, Cost: 2, StatusCost: func(int) int { return 1 }})
+	assert.ErrorIs(t, err, rackattack.ErrRuleInvalid)
+}
+
+func TestStatusCostFillsTheBudget(t *testing.T) {
+	for _, alg := range []rackattack.Algorithm{rackattack.SlidingWindow, rackattack.FixedWindow, rackattack.TokenBucket, rackattack.LeakyBucket} {
+		ra, err := rackattack.New(rackattack.NewMemoryStore())
+		require.NoError(t, err)
+		require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+			Name: "api", Key: "api:%{ip}", Limit: 10, Period: time.Minute, Algorithm: alg,
+			StatusCost: func(int) int { return 4 },
+		}))
+		h := ra.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		var allowed int
+		for i := 0; i < 50; i++ {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req("GET", "/", "7.7.7.7:1"))
+			if rec.Code == http.StatusOK {
+				allowed++
+			}
+		}
+		// 4 + 4 fit whole; the third request takes the last 2 and fills it.
+		assert.Equal(t, 3, allowed, alg)
+	}
+}
+
+func TestStorePeekDoesNotCount(t *testing.T) {
+	_, _, client := setup(t)
+	stores := map[string]rackattack.Store{
+		"redis":  rackattack.NewRedisStore(client, "peek:"),
+		"memory": rackattack.NewMemoryStore(),
+	}
+	ctx := context.Background()
+	for name, s := range stores {
+		for _, alg := range []rackattack.Algorithm{rackattack.SlidingWindow, rackattack.FixedWindow, rackattack.TokenBucket, rackattack.LeakyBucket} {
+			q := rackattack.Quota{Algorithm: alg, Limit: 2, Period: time.Minute}
+			key := fmt.Sprintf("k%d", alg)
+
+			res, err := s.Peek(ctx, key, q)
+			require.NoError(t, err)
+			assert.False(t, res.Limited, "%s/%d", name, alg)
+			assert.Equal(t, 2, res.Remaining, "%s/%d", name, alg)
+
+			_, _ = s.Throttle(ctx, key, q)
+			res, _ = s.Peek(ctx, key, q)
+			assert.Equal(t, 1, res.Remaining, "%s/%d", name, alg)
+			res, _ = s.Peek(ctx, key, q)
+			assert.Equal(t, 1, res.Remaining, "%s/%d: peeking twice changes nothing", name, alg)
+
+			_, _ = s.Throttle(ctx, key, q)
+			res, _ = s.Peek(ctx, key, q)
+			assert.True(t, res.Limited, "%s/%d", name, alg)
+			assert.Positive(t, res.RetryAfter, "%s/%d", name, alg)
+		}
+	}
+}
+
+func TestPeekAndCommit(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}", Limit: 2, Period: time.Minute})
+	ra.Fail2Ban(rackattack.Fail2BanRule{Name: "f2b", MaxRetry: 1, FindTime: time.Minute, BanTime: time.Hour,
+		Trigger: func(r *http.Request) bool { return r.URL.Path == "/wp-admin" }})
+	r := req("GET", "/", "8.8.8.8:1")
+
+	for i := 0; i < 3; i++ {
+		d, err := ra.Peek(r)
+		require.NoError(t, err)
+		require.True(t, d.Allowed, "peeking never consumes the budget")
+		assert.Equal(t, 2, d.Throttle.Remaining)
+	}
+
+	require.NoError(t, ra.Commit(r))
+	d, _ := ra.Peek(r)
+	assert.Equal(t, 1, d.Throttle.Remaining)
+	require.NoError(t, ra.Commit(r))
+	d, _ = ra.Peek(r)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, rackattack.ReasonThrottled, d.Reason)
+
+	// Peek does not count Fail2Ban offenses either.
+	probe := req("GET", "/wp-admin", "8.8.4.4:1")
+	d, _ = ra.Peek(probe)
+	assert.True(t, d.Allowed)
+	d, _ = ra.Check(probe)
+	assert.Equal(t, rackattack.ReasonBanned, d.Reason)
+	d, _ = ra.Peek(probe)
+	assert.Equal(t, rackattack.ReasonBanned, d.Reason)
+}
+
+func TestCommitLeavesDeferredRulesToRecord(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.MustThrottle(rackattack.ThrottleRule{Name: "errors", Key: "err:%{ip}", Limit: 2, Period: time.Minute,
+		CountIf: func(status int) bool { return status >= 400 }})
+	ra.MustThrottle(rackattack.ThrottleRule{Name: "weighted", Key: "w:%{ip}", Limit: 2, Period: time.Minute,
+		StatusCost: func(int) int { return 1 }})
+	r := req("GET", "/", "8.8.8.8:1")
+
+	require.NoError(t, ra.Commit(r))
+	require.NoError(t, ra.Record(r, http.StatusNotFound))
+	d, err := ra.Peek(r)
+	require.NoError(t, err)
+	assert.Equal(t, 1, d.Throttle.Remaining, "counted once, by Record")
+	require.NoError(t, ra.Record(r, http.StatusNotFound))
+	d, _ = ra.Peek(r)
+	assert.False(t, d.Allowed)
+}
+
+func TestWeightedRequests(t *testing.T) {
+	_, _, client := setup(t)
+	for _, alg := range []rackattack.Algorithm{rackattack.SlidingWindow, rackattack.FixedWindow, rackattack.TokenBucket, rackattack.LeakyBucket} {
+		ra, err := rackattack.New(rackattack.NewRedisStore(client, fmt.Sprintf("cost%d:", alg)))
+		require.NoError(t, err)
+		ra.Throttle(rackattack.ThrottleRule{
+			PathPattern: "/export", Key: "export:%{ip}", Limit: 10, Period: time.Minute,
+			Algorithm: alg, Cost: 4,
+		})
+		ra.Throttle(rackattack.ThrottleRule{
+			PathPattern: "/upload", Key: "upload:%{ip}", Limit: 10, Period: time.Minute,
+			Algorithm: alg,
+			CostFunc: func(r *http.Request) int {
+				n, _ := strconv.Atoi(r.URL.Query().Get("mb"))
+				return n
+			},
+		})
+
+		d, _ := ra.Check(req("GET", "/export", "9.9.9.9:1"))
+		assert.Equal(t, 6, d.Throttle.Remaining, alg)
+		d, _ = ra.Check(req("GET", "/export", "9.9.9.9:1"))
+		assert.True(t, d.Allowed, alg)
+		d, _ = ra.Check(req("GET", "/export", "9.9.9.9:1"))
+		assert.False(t, d.Allowed, "a hit that does not fit is throttled whole (%d)", alg)
+
+		d, _ = ra.Check(req("POST", "/upload?mb=9", "9.9.9.9:1"))
+		assert.Equal(t, 1, d.Throttle.Remaining, alg)
+		d, _ = ra.Check(req("POST", "/upload?mb=2", "9.9.9.9:1"))
+		assert.False(t, d.Allowed, alg)
+		d, _ = ra.Check(req("POST", "/upload", "9.9.9.9:1"))
+		assert.True(t, d.Allowed, "a cost below 1 counts as 1 (%d)", alg)
+	}
+}
+
+func TestGlobalLimit(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.SetGlobalLimit(3, time.Hour, "global:%{ip}")
+	ra.Throttle(rackattack.ThrottleRule{Name: "search", PathPattern: "/search", Key: "search:%{ip}", Limit: 1, Period: time.Minute})
+
+	d, _ := ra.Check(req("GET", "/search", "5.5.5.5:1"))
+	require.True(t, d.Allowed)
+	assert.Equal(t, "search", d.RuleName, "the rule with less headroom is reported")
+
+	for _, p := range []string{"/", "/about"} {
+		d, _ = ra.Check(req("GET", p, "5.5.5.5:1"))
+		require.True(t, d.Allowed)
+		assert.Equal(t, "global", d.RuleName)
+	}
+	d, _ = ra.Check(req("GET", "/contact", "5.5.5.5:1"))
+	assert.False(t, d.Allowed, "the global limit spans every path")
+	assert.Equal(t, "global", d.RuleName)
+
+	// Replacing rules keeps the global limit; a zero limit removes it.
+	ra.ClearThrottleRules()
+	d, _ = ra.Check(req("GET", "/", "5.5.5.5:1"))
+	assert.False(t, d.Allowed)
+	ra.SetGlobalLimit(0, 0, "")
+	d, _ = ra.Check(req("GET", "/", "5.5.5.5:1"))
+	assert.True(t, d.Allowed)
+}
+
+func TestOverlappingRulesAreAllCounted(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Name: "burst", Key: "burst:%{ip}", Limit: 2, Period: time.Second})
+	ra.Throttle(rackattack.ThrottleRule{Name: "hourly", Key: "hourly:%{ip}", Limit: 4, Period: time.Hour})
+	ra.Throttle(rackattack.ThrottleRule{Name: "daily", Key: "daily:%{ip}", Limit: 10, Period: 24 * time.Hour})
+	r := req("GET", "/", "3.3.3.3:1")
+
+	d, _ := ra.Check(r)
+	assert.Equal(t, "burst", d.RuleName, "the least remaining budget is reported")
+	assert.Equal(t, 1, d.Throttle.Remaining)
+	_, _ = ra.Check(r)
+
+	// The burst rule throttles, but the later rules still count the hit.
+	d, _ = ra.Check(r)
+	require.False(t, d.Allowed)
+	assert.Equal(t, "burst", d.RuleName)
+	d, _ = ra.Check(req("GET", "/", "3.3.3.3:1"))
+	require.False(t, d.Allowed)
+
+	d, err := ra.Peek(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hourly", d.RuleName, "of two exhausted rules, the longer wait is reported")
+	assert.Greater(t, d.Throttle.RetryAfter, time.Second)
+}
+
+func TestThrottledRequestCountsAgainstLaterRules(t *testing.T) {
+	ra, mr, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Name: "second", Key: "s:%{ip}", Limit: 1, Period: time.Second, Algorithm: rackattack.FixedWindow})
+	ra.Throttle(rackattack.ThrottleRule{Name: "hour", Key: "h:%{ip}", Limit: 3, Period: time.Hour, Algorithm: rackattack.FixedWindow})
+	r := req("GET", "/", "2.2.2.2:1")
+
+	d, _ := ra.Check(r)
+	require.True(t, d.Allowed)
+	for i := 0; i < 2; i++ {
+		d, _ = ra.Check(r)
+		require.Equal(t, "second", d.RuleName)
+	}
+
+	// Once the short window resets, the hourly rule has seen all three
+	// attempts and keeps the client out.
+	mr.FastForward(time.Second)
+	d, _ = ra.Check(r)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "hour", d.RuleName)
+}
+
+func TestBannedRequestCountsAgainstNoRule(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}", Limit: 5, Period: time.Minute})
+	ra.Throttle(rackattack.ThrottleRule{
+		Name: "login", Key: "login:%{ip}", Limit: 1, Period: time.Minute,
+		Ban: rackattack.BanPolicy{MaxRetry: 1, FindTime: time.Minute, BanTime: time.Hour},
+	})
+	r := req("POST", "/login", "2.2.2.3:1")
+
+	_, _ = ra.Check(r)
+	_, _ = ra.Check(r) // throttled, which trips the ban
+	for i := 0; i < 5; i++ {
+		d, _ := ra.Check(r)
+		require.Equal(t, rackattack.ReasonBanned, d.Reason)
+	}
+
+	ra.RemoveThrottleRule("login")
+	d, _ := ra.Check(r)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 2, d.Throttle.Remaining, "banned attempts left the api budget alone")
+}
+
+func TestNewMiddlewareOptions(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.BlocklistIP("6.6.6.6")
+	ra.Throttle(rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	h := rackattack.NewMiddleware(ra, rackattack.WithDeniedStatus(http.StatusServiceUnavailable, http.StatusNotFound))(ok)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/", "1.1.1.1:1"))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/", "1.1.1.1:1"))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/", "6.6.6.6:1"))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	h = rackattack.NewMiddleware(ra, rackattack.WithDeniedResponse(func(w http.ResponseWriter, r *http.Request) {
+		d, _ := rackattack.DecisionFromContext(r)
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte(d.Reason.String()))
+	}))(ok)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/", "6.6.6.6:1"))
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Equal(t, "blocklisted", rec.Body.String())
+}
+
+func TestRetryAfterHTTPDate(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ra, err := rackattack.New(rackattack.NewRedisStore(client, "test:"), rackattack.WithRetryAfterFormat(rackattack.RetryAfterHTTPDate))
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	h := ra.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	h.ServeHTTP(httptest.NewRecorder(), req("GET", "/", "1.1.1.1:1"))
+	before := time.Now().Truncate(time.Second)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/", "1.1.1.1:1"))
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	at, err := http.ParseTime(rec.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.WithinRange(t, at, before.Add(time.Minute), time.Now().Add(time.Minute+time.Second))
+
+	clock := &manualClock{t: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	ra, err = rackattack.New(rackattack.NewMemoryStore(), rackattack.WithClock(clock), rackattack.WithRetryAfterFormat(rackattack.RetryAfterHTTPDate))
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	h = ra.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), req("GET", "/", "1.1.1.1:1"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req("GET", "/", "1.1.1.1:1"))
+	assert.Equal(t, "Thu, 02 Jan 2020 03:05:05 GMT", rec.Header().Get("Retry-After"), "the date follows WithClock")
+
+	_, err = rackattack.New(rackattack.NewMemoryStore(), rackattack.WithRetryAfterFormat(rackattack.RetryAfterFormat(7)))
+	assert.Error(t, err)
+}
+
+func TestNewMiddlewareFailClosed(t *testing.T) {
+	ra, mr, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	mr.Close()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {})
+
+	rec := httptest.NewRecorder()
+	rackattack.NewMiddleware(ra)(ok).ServeHTTP(rec, req("GET", "/", "1.1.1.1:1"))
+	assert.Equal(t, http.StatusOK, rec.Code, "inherits the instance's fail-open default")
+
+	rec = httptest.NewRecorder()
+	rackattack.NewMiddleware(ra, rackattack.WithMiddlewareFailClosed(true))(ok).ServeHTTP(rec, req("GET", "/", "1.1.1.1:1"))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+// flakyStore fails the first failures Throttle calls, then allows; block
+// makes failing calls wait for their context instead.
+type flakyStore struct {
+	rackattack.Store
+	failures int
+	block    bool
+	calls    int
+}
+
+func (s *flakyStore) Throttle(ctx context.Context, _ string, q rackattack.Quota) (rackattack.Result, error) {
+	s.calls++
+	if s.calls > s.failures {
+		return rackattack.Result{Limit: q.Limit, Remaining: q.Limit - 1}, nil
+	}
+	if s.block {
+		<-ctx.Done()
+		return rackattack.Result{}, ctx.Err()
+	}
+	return rackattack.Result{}, errors.New("connection reset")
+}
+
+func TestDecide(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.BlocklistIP("6.6.6.6")
+	ra.MustThrottle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+
+	allow, headers, status, err := ra.Decide(req("GET", "/", "1.1.1.1:1"))
+	require.NoError(t, err)
+	assert.True(t, allow)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "0", headers.Get("RateLimit-Remaining"))
+
+	allow, headers, status, _ = ra.Decide(req("GET", "/", "1.1.1.1:1"))
+	assert.False(t, allow)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, "60", headers.Get("Retry-After"))
+
+	allow, _, status, _ = ra.Decide(req("GET", "/", "6.6.6.6:1"))
+	assert.False(t, allow)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	ra, err = rackattack.New(&flakyStore{failures: 1}, rackattack.WithFailClosed())
+	require.NoError(t, err)
+	ra.MustThrottle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	allow, headers, status, err = ra.Decide(req("GET", "/", "1.1.1.1:1"))
+	assert.Error(t, err)
+	assert.False(t, allow)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.NotNil(t, headers)
+}
+
+func TestStoreTimeout(t *testing.T) {
+	store := &flakyStore{failures: 1, block: true}
+	ra, err := rackattack.New(store, rackattack.WithStoreTimeout(10*time.Millisecond))
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "k:%{ip}", Limit: 5, Period: time.Minute})
+
+	start := time.Now()
+	throttled, err := ra.IsThrottled(req("GET", "/", "1.1.1.1:1"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, throttled, "a timeout fails open by default")
+	assert.Less(t, time.Since(start), time.Second)
+
+	_, err = rackattack.New(store, rackattack.WithStoreTimeout(0))
+	assert.Error(t, err)
+}
+
+func TestStoreRetries(t *testing.T) {
+	store := &flakyStore{failures: 2}
+	ra, err := rackattack.New(store, rackattack.WithStoreRetries(2))
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "k:%{ip}", Limit: 5, Period: time.Minute})
+
+	d, err := ra.Check(req("GET", "/", "1.1.1.1:1"))
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 3, store.calls)
+
+	// Retries give up once the request itself is done.
+	store = &flakyStore{failures: 10, block: true}
+	ra, err = rackattack.New(store, rackattack.WithStoreTimeout(time.Hour), rackattack.WithStoreRetries(3))
+	require.NoError(t, err)
+	ra.Throttle(rackattack.ThrottleRule{Key: "k:%{ip}", Limit: 5, Period: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = ra.Check(req("GET", "/", "1.1.1.1:1").WithContext(ctx))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, store.calls)
+}
+
+func TestSafelistIf(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	ra.SafelistIf(func(r *http.Request) bool { return r.Header.Get("X-Internal-Token") == "s3cret" })
+
+	internal := req("GET", "/", "10.1.2.3:1")
+	internal.Header.Set("X-Internal-Token", "s3cret")
+	for i := 0; i < 3; i++ {
+		d, err := ra.Check(internal)
+		require.NoError(t, err)
+		assert.Equal(t, rackattack.ReasonSafelisted, d.Reason)
+	}
+
+	external := req("GET", "/", "10.1.2.3:1")
+	external.Header.Set("X-Internal-Token", "guess")
+	d, _ := ra.Check(external)
+	assert.True(t, d.Allowed)
+	d, _ = ra.Check(external)
+	assert.Equal(t, rackattack.ReasonThrottled, d.Reason, "safelisted requests never touched the budget")
+}
+
+func TestBlocklistIf(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.SafelistIP("10.0.0.1")
+	ra.BlocklistIf(func(r *http.Request) bool { return strings.Contains(r.UserAgent(), "BadBot") })
+
+	bot := req("GET", "/", "1.1.1.1:1")
+	bot.Header.Set("User-Agent", "BadBot/1.0")
+	d, _ := ra.Check(bot)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+
+	bot.RemoteAddr = "10.0.0.1:1"
+	d, _ = ra.Check(bot)
+	assert.Equal(t, rackattack.ReasonSafelisted, d.Reason, "the safelist still wins")
+
+	d, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+	assert.True(t, d.Allowed)
+}
+
+func TestListIPsAreNormalizedAndValidated(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.SafelistIP(" 10.0.0.1 "))
+	require.NoError(t, ra.BlocklistIP("::ffff:192.0.2.7"))
+	require.NoError(t, ra.BlocklistIP("[2001:DB8::1]"))
+
+	d, _ := ra.Check(req("GET", "/", "10.0.0.1:1"))
+	assert.Equal(t, rackattack.ReasonSafelisted, d.Reason)
+	d, _ = ra.Check(req("GET", "/", "192.0.2.7:1"))
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+	d, _ = ra.Check(req("GET", "/", "[2001:db8::1]:1"))
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+
+	for _, bad := range []string{"10.0.00.1", "not-an-ip", "10.0.0.0/8", ""} {
+		assert.Error(t, ra.SafelistIP(bad), bad)
+		assert.Error(t, ra.BlocklistIP(bad), bad)
+	}
+
+	ra.UnblocklistIP("2001:db8:0::1")
+	d, _ = ra.Check(req("GET", "/", "[2001:db8::1]:1"))
+	assert.True(t, d.Allowed, "removal normalizes too")
+}
+
+func TestIntrospection(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.SafelistIP("10.0.0.2"))
+	require.NoError(t, ra.SafelistIP("10.0.0.1"))
+	require.NoError(t, ra.SafelistCIDR("192.168.0.0/16"))
+	require.NoError(t, ra.BlocklistIP("203.0.113.9"))
+	require.NoError(t, ra.BlocklistCIDR("198.51.100.7/24"))
+	ra.Throttle(rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}", Limit: 5, Period: time.Minute})
+	ra.SetGlobalLimit(100, time.Hour, "global:%{ip}")
+	ra.Fail2Ban(rackattack.Fail2BanRule{Name: "probe", MaxRetry: 3, FindTime: time.Minute, BanTime: time.Hour})
+
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, ra.SafelistedIPs())
+	assert.Equal(t, []string{"192.168.0.0/16"}, ra.SafelistedCIDRs())
+	assert.Equal(t, []string{"203.0.113.9"}, ra.BlocklistedIPs())
+	assert.Equal(t, []string{"198.51.100.0/24"}, ra.BlocklistedCIDRs())
+	assert.Equal(t, "probe", ra.Fail2BanRules()[0].Name)
+
+	rules := ra.Rules()
+	require.Len(t, rules, 2)
+	assert.Equal(t, "api", rules[0].Name)
+	assert.Equal(t, "global", rules[1].Name)
+
+	// The results are copies.
+	rules[0].Limit = 1
+	assert.Equal(t, 5, ra.Rules()[0].Limit)
+}
+
+func TestLoadConfigFromJSON(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.BlocklistIP("1.1.1.1"))
+	ra.Throttle(rackattack.ThrottleRule{Name: "old", Key: "old:%{ip}", Limit: 1, Period: time.Minute})
+
+	var cfg rackattack.Config
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"safelist": ["10.0.0.0/8", "192.0.2.1"],
+		"blocklist": ["203.0.113.9"],
+		"throttle": [{
+			"name": "login", "path_pattern": "/login", "method": "POST",
+			"key": "login:%{ip}", "limit": 2, "period": "1m",
+			"algorithm": "fixed_window",
+			"ban": {"max_retry": 3, "find_time": "10m", "ban_time": "1h"}
+		}],
+		"fail2ban": [{"name": "honeypot", "path_pattern": "/wp-admin/*", "max_retry": 1, "find_time": "1m", "ban_time": "24h"}]
+	}`), &cfg))
+	require.NoError(t, ra.LoadConfig(cfg))
+
+	assert.Equal(t, []string{"192.0.2.1"}, ra.SafelistedIPs())
+	assert.Equal(t, []string{"10.0.0.0/8"}, ra.SafelistedCIDRs())
+	assert.Equal(t, []string{"203.0.113.9"}, ra.BlocklistedIPs(), "the old state is replaced")
+	rules := ra.Rules()
+	require.Len(t, rules, 1)
+	assert.Equal(t, rackattack.FixedWindow, rules[0].Algorithm)
+	assert.Equal(t, time.Hour, rules[0].Ban.BanTime)
+
+	login := req("POST", "/login", "4.4.4.4:1")
+	_, _ = ra.Check(login)
+	_, _ = ra.Check(login)
+	d, _ := ra.Check(login)
+	assert.Equal(t, "login", d.RuleName)
+	d, _ = ra.Check(req("GET", "/wp-admin/x", "4.4.4.5:1"))
+	assert.Equal(t, rackattack.ReasonBanned, d.Reason)
+}
+
+func TestLoadConfigRejectsInvalidAtomically(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.BlocklistIP("1.1.1.1"))
+
+	for name, cfg := range map[string]rackattack.Config{
+		"bad ip":     {Blocklist: []string{"2.2.2.2", "nope"}},
+		"no key":     {Throttle: []rackattack.ThrottleConfig{{Name: "x", Limit: 1, Period: rackattack.Duration(time.Minute)}}},
+		"no period":  {Throttle: []rackattack.ThrottleConfig{{Name: "x", Key: "k", Limit: 1}}},
+		"bad regexp": {Throttle: []rackattack.ThrottleConfig{{Key: "k", Limit: 1, Period: rackattack.Duration(time.Minute), PathRegex: "("}}},
+		"bad ban":    {Fail2Ban: []rackattack.Fail2BanConfig{{Name: "f"}}},
+	} {
+		assert.Error(t, ra.LoadConfig(cfg), name)
+	}
+	assert.Equal(t, []string{"1.1.1.1"}, ra.BlocklistedIPs(), "nothing was applied")
+
+	var cfg rackattack.Config
+	assert.Error(t, json.Unmarshal([]byte(`{"throttle": [{"period": "soon"}]}`), &cfg))
+	assert.Error(t, json.Unmarshal([]byte(`{"throttle": [{"algorithm": "leaky"}]}`), &cfg))
+}
+
+func TestLoadBlocklist(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.BlocklistIP("1.1.1.1"))
+	feed := `# threat feed
+2.2.2.2
+10.0.0.0/8 ; SBL123
+
+nope
+2.2.2.2
+3.3.3.0/33
+`
+	added, err := ra.LoadBlocklist(strings.NewReader(feed))
+	assert.Equal(t, 2, added)
+	var lineErr *rackattack.LineError
+	require.ErrorAs(t, err, &lineErr)
+	assert.Equal(t, 5, lineErr.Line)
+	assert.Equal(t, "nope", lineErr.Text)
+	assert.Len(t, err.(interface{ Unwrap() []error }).Unwrap(), 2)
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, ra.BlocklistedIPs())
+	assert.Equal(t, []string{"10.0.0.0/8"}, ra.BlocklistedCIDRs())
+
+	_, err = ra.LoadBlocklist(strings.NewReader("10.0.0.0/8\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8"}, ra.BlocklistedCIDRs(), "reloading does not duplicate ranges")
+	d, _ := ra.Check(req("GET", "/", "10.1.2.3:1"))
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+
+	added, err = ra.ReplaceBlocklist(strings.NewReader("4.4.4.4\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, added)
+	assert.Equal(t, []string{"4.4.4.4"}, ra.BlocklistedIPs())
+	assert.Empty(t, ra.BlocklistedCIDRs())
+
+	_, err = ra.ReplaceBlocklist(io.MultiReader(strings.NewReader("5.5.5.5\n"), iotest.ErrReader(errors.New("feed cut off"))))
+	assert.EqualError(t, err, "feed cut off")
+	assert.Equal(t, []string{"4.4.4.4"}, ra.BlocklistedIPs(), "a failed read changes nothing")
+}
+
+func TestDebugHandler(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.BlocklistCIDR("6.6.6.0/24"))
+	ra.MustThrottle(rackattack.ThrottleRule{Name: "api", PathPattern: "/api/*", Key: "api:%{ip}", Limit: 10, Period: time.Minute})
+	ra.MustThrottle(rackattack.ThrottleRule{Name: "login", PathPattern: "/login", Key: "login:%{ip}", Limit: 5, Period: time.Hour})
+	ra.Fail2Ban(rackattack.Fail2BanRule{Name: "scan", PathPattern: "/wp-admin", MaxRetry: 1, FindTime: time.Minute, BanTime: time.Hour})
+	for i := 0; i < 3; i++ {
+		_, _ = ra.Check(req("GET", "/api/items", "1.2.3.4:1"))
+	}
+	_, _ = ra.Check(req("GET", "/wp-admin", "1.2.3.4:1"))
+	h := ra.DebugHandler()
+
+	var state struct {
+		IP          string `json:"ip"`
+		Blocklisted bool   `json:"blocklisted"`
+		Rules       []struct {
+			Name    string `json:"name"`
+			Key     string `json:"key"`
+			Matches bool   `json:"matches"`
+			Count   int    `json:"count"`
+			Limit   int    `json:"limit"`
+			TTL     string `json:"ttl"`
+		} `json:"rules"`
+		Fail2Ban []struct {
+			Name   string `json:"name"`
+			Banned bool   `json:"banned"`
+		} `json:"fail2ban"`
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/rackattack?ip=1.2.3.4&path=/api/items", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	assert.Equal(t, "1.2.3.4", state.IP)
+	assert.False(t, state.Blocklisted)
+	require.Len(t, state.Rules, 2)
+	assert.Equal(t, "api:1.2.3.4", state.Rules[0].Key)
+	assert.True(t, state.Rules[0].Matches)
+	assert.Equal(t, 3, state.Rules[0].Count)
+	assert.Equal(t, 10, state.Rules[0].Limit)
+	assert.NotEmpty(t, state.Rules[0].TTL)
+	assert.False(t, state.Rules[1].Matches)
+	assert.Zero(t, state.Rules[1].Count)
+	require.Len(t, state.Fail2Ban, 1)
+	assert.True(t, state.Fail2Ban[0].Banned)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/rackattack?ip=1.2.3.4&path=/api/items", nil))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	assert.Equal(t, 3, state.Rules[0].Count, "the handler records nothing")
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/rackattack?ip=6.6.6.6", nil))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	assert.True(t, state.Blocklisted)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/rackattack?ip=nope", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestThrottleValidatesRules(t *testing.T) {
+	ra, _, _ := setup(t)
+	valid := rackattack.ThrottleRule{Key: "k:%{ip}", Limit: 1, Period: time.Minute}
+	require.NoError(t, ra.Throttle(valid))
+
+	for name, mutate := range map[string]func(*rackattack.ThrottleRule){
+		"empty key":       func(r *rackattack.ThrottleRule) { r.Key = "" },
+		"zero limit":      func(r *rackattack.ThrottleRule) { r.Limit = 0 },
+		"negative period": func(r *rackattack.ThrottleRule) { r.Period = -time.Second },
+		"zero period":     func(r *rackattack.ThrottleRule) { r.Period = 0 },
+		"bad algorithm":   func(r *rackattack.ThrottleRule) { r.Algorithm = rackattack.Algorithm(42) },
+		"bad glob":        func(r *rackattack.ThrottleRule) { r.PathPattern = "/files/[" },
+		"bad host glob":   func(r *rackattack.ThrottleRule) { r.HostPattern = "[a-.example.com" },
+		"pattern+regex": func(r *rackattack.ThrottleRule) {
+			r.PathPattern = "/a"
+			r.PathRegex = regexp.MustCompile("^/b$")
+		},
+	} {
+		r := valid
+		r.Name = name
+		mutate(&r)
+		err := ra.Throttle(r)
+		assert.ErrorContains(t, err, name, "the error names the rule")
+		assert.ErrorIs(t, err, rackattack.ErrRuleInvalid)
+		assert.Panics(t, func() { ra.MustThrottle(r) }, name)
+	}
+	assert.Len(t, ra.Rules(), 1, "invalid rules are not registered")
+
+	assert.ErrorIs(t, ra.SetGlobalLimit(10, 0, "global:%{ip}"), rackattack.ErrRuleInvalid)
+	assert.Error(t, ra.SetGlobalLimit(10, time.Hour, ""))
+	assert.NoError(t, ra.SetGlobalLimit(0, 0, ""), "a zero limit removes the global rule")
+}
+
+func TestStrictKeysRejectsSharedKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ra, err := rackattack.New(rackattack.NewRedisStore(client, "test:"), rackattack.WithStrictKeys())
+	require.NoError(t, err)
+
+	shared := rackattack.ThrottleRule{Name: "oops", Key: "throttle:%{path}", Limit: 10, Period: time.Minute}
+	assert.ErrorContains(t, ra.Throttle(shared), "per-client placeholder")
+	assert.ErrorIs(t, ra.Throttle(shared), rackattack.ErrRuleInvalid)
+	assert.Error(t, ra.SetGlobalLimit(100, time.Minute, "global"))
+	assert.Error(t, ra.LoadConfig(rackattack.Config{Throttle: []rackattack.ThrottleConfig{
+		{Name: "oops", Key: "throttle:global", Limit: 10, Period: rackattack.Duration(time.Minute)},
+	}}))
+
+	shared.SharedKey = true
+	assert.NoError(t, ra.Throttle(shared), "SharedKey opts in to a shared counter")
+	assert.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 10, Period: time.Minute}))
+	assert.Len(t, ra.Rules(), 2)
+
+	// Without the option the rule is accepted with a warning.
+	lax, _, _ := setup(t)
+	assert.NoError(t, lax.Throttle(rackattack.ThrottleRule{Key: "throttle:global", Limit: 10, Period: time.Minute}))
+}
+
+func TestKeyFunc(t *testing.T) {
+	ra, mr, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		Name: "tenant",
+		KeyFunc: func(r *http.Request) string {
+			// Only requests carrying a tenant are limited.
+			if tenant := r.Header.Get("X-Tenant"); tenant != "" {
+				return "tenant:" + strings.ToLower(tenant)
+			}
+			return ""
+		},
+		Limit:  1,
+		Period: time.Minute,
+	}))
+
+	r := req("GET", "/", "1.1.1.1:1")
+	r.Header.Set("X-Tenant", "Acme")
+	d, _ := ra.Check(r)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, "tenant", d.RuleName)
+	assert.True(t, mr.Exists("test:tenant:acme"), "KeyFunc's result is the store key")
+
+	// A different client of the same tenant shares the bucket.
+	other := req("GET", "/", "2.2.2.2:1")
+	other.Header.Set("X-Tenant", "ACME")
+	d, _ = ra.Check(other)
+	assert.False(t, d.Allowed)
+
+	// No tenant, no limit.
+	for i := 0; i < 3; i++ {
+		d, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+		assert.True(t, d.Allowed)
+		assert.Nil(t, d.Rule)
+	}
+
+	assert.Error(t, ra.Throttle(rackattack.ThrottleRule{KeyFunc: func(*http.Request) string { return "k" }, Limit: 1, Period: time.Minute}),
+		"a KeyFunc rule without a Key needs a Name")
+}
+
+func TestWithLogger(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ra, err := rackattack.New(rackattack.NewRedisStore(client, "test:"), rackattack.WithLogger(logger))
+	require.NoError(t, err)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}", Limit: 1, Period: time.Minute}))
+
+	r := req("GET", "/v1/items", "1.1.1.1:1")
+	_, _ = ra.Check(r)
+	_, _ = ra.Check(r)
+
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		entries = append(entries, e)
+	}
+	require.Len(t, entries, 4, "a rule entry and a decision entry per Check")
+
+	assert.Equal(t, "DEBUG", entries[0]["level"])
+	assert.Equal(t, "api", entries[0]["rule"])
+	assert.Equal(t, "api:1.1.1.1", entries[0]["key"])
+	assert.Equal(t, float64(1), entries[0]["count"])
+	assert.Equal(t, float64(1), entries[0]["limit"])
+
+	assert.Equal(t, "DEBUG", entries[1]["level"])
+	assert.Equal(t, true, entries[1]["allowed"])
+
+	denied := entries[3]
+	assert.Equal(t, "INFO", denied["level"])
+	assert.Equal(t, false, denied["allowed"])
+	assert.Equal(t, "throttled", denied["reason"])
+	assert.Equal(t, "1.1.1.1", denied["ip"])
+	assert.Equal(t, "/v1/items", denied["path"])
+}
+
+func TestThrottleHostPattern(t *testing.T) {
+	ra, mr, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		HostPattern: "*.example.com",
+		Key:         "tenant:%{host}:%{ip}",
+		Limit:       1,
+		Period:      time.Minute,
+	}))
+
+	onHost := func(host string) *http.Request {
+		r := req("GET", "/", "1.1.1.1:1")
+		r.Host = host
+		return r
+	}
+	d, _ := ra.Check(onHost("acme.example.com"))
+	assert.True(t, d.Allowed)
+	d, _ = ra.Check(onHost("ACME.example.com:8443"))
+	assert.False(t, d.Allowed, "host matching ignores case and port")
+	assert.True(t, mr.Exists("test:tenant:acme.example.com:1.1.1.1"))
+
+	d, _ = ra.Check(onHost("globex.example.com"))
+	assert.True(t, d.Allowed, "each host has its own bucket")
+	for i := 0; i < 3; i++ {
+		d, _ = ra.Check(onHost("example.org"))
+		assert.True(t, d.Allowed, "other hosts are not limited")
+	}
+}
+
+func TestPathScopedLists(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "all:%{ip}", Limit: 1, Period: time.Minute}))
+	require.NoError(t, ra.SafelistIPForPath("10.0.0.9", "/health"))
+	require.NoError(t, ra.BlocklistIPForPath("::ffff:10.0.0.9", "/admin/*"))
+	assert.Error(t, ra.SafelistIPForPath("not-an-ip", "/health"))
+
+	for i := 0; i < 3; i++ {
+		d, _ := ra.Check(req("GET", "/health", "10.0.0.9:1"))
+		assert.Equal(t, rackattack.ReasonSafelisted, d.Reason, "the bypass applies on /health")
+	}
+	d, _ := ra.Check(req("GET", "/admin/users", "10.0.0.9:1"))
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason)
+
+	d, _ = ra.Check(req("GET", "/api", "10.0.0.9:1"))
+	assert.True(t, d.Allowed)
+	d, _ = ra.Check(req("GET", "/api", "10.0.0.9:1"))
+	assert.Equal(t, rackattack.ReasonThrottled, d.Reason, "other paths stay limited")
+
+	d, _ = ra.Check(req("GET", "/health", "10.0.0.8:1"))
+	assert.NotEqual(t, rackattack.ReasonSafelisted, d.Reason, "other IPs are not safelisted")
+
+	ra.UnsafelistIPForPath("10.0.0.9", "/health")
+	ra.UnblocklistIPForPath("10.0.0.9", "/admin/*")
+	d, _ = ra.Check(req("GET", "/health", "10.0.0.9:1"))
+	assert.Equal(t, rackattack.ReasonThrottled, d.Reason)
+	d, _ = ra.Check(req("GET", "/admin/users", "10.0.0.9:1"))
+	assert.Equal(t, rackattack.ReasonThrottled, d.Reason)
+}
+
+// roundTrips counts the calls and pipelines a go-redis client sends.
+type roundTrips struct{ n atomic.Int64 }
+
+func (h *roundTrips) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *roundTrips) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.n.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *roundTrips) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.n.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+func TestCheckBatch(t *testing.T) {
+	ra, _, client := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "hook:%{header:X-Target}", Limit: 2, Period: time.Minute}))
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "all:%{ip}", Limit: 4, Period: time.Minute}))
+	require.NoError(t, ra.SafelistIP("10.0.0.1"))
+
+	delivery := func(target, ip string) *http.Request {
+		r := req("POST", "/deliver", ip+":1")
+		r.Header.Set("X-Target", target)
+		return r
+	}
+	reqs := []*http.Request{
+		delivery("a", "1.1.1.1"),
+		delivery("a", "1.1.1.1"),
+		delivery("a", "1.1.1.1"), // third hit on target a
+		delivery("b", "1.1.1.1"),
+		delivery("c", "1.1.1.1"), // fifth hit from the IP
+		delivery("a", "10.0.0.1"),
+	}
+
+	// Load the scripts, so the batch is not a cold start.
+	_, _ = ra.Check(delivery("warmup", "9.9.9.9"))
+	hook := &roundTrips{}
+	client.AddHook(hook)
+	denied, err := ra.CheckBatch(context.Background(), reqs)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false, true, false, true, false}, denied)
+	assert.Equal(t, int64(1), hook.n.Load(), "every hit in one pipeline")
+
+	// Later calls see the batch's hits.
+	d, _ := ra.Check(delivery("b", "2.2.2.2"))
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Throttle.Remaining)
+}
+
+func TestRedisStoreBatchReloadsFlushedScripts(t *testing.T) {
+	_, _, client := setup(t)
+	store := rackattack.NewRedisStore(client, "batch:")
+	ctx := context.Background()
+	ops := []rackattack.BatchOp{
+		{Key: "fw", Quota: rackattack.Quota{Algorithm: rackattack.FixedWindow, Limit: 1, Period: time.Minute}},
+		{Key: "fw", Quota: rackattack.Quota{Algorithm: rackattack.FixedWindow, Limit: 1, Period: time.Minute}},
+		{Key: "tb", Quota: rackattack.Quota{Algorithm: rackattack.TokenBucket, Limit: 1, Period: time.Minute}, Peek: true},
+	}
+
+	require.NoError(t, client.ScriptFlush(ctx).Err())
+	results, err := store.Batch(ctx, ops)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.False(t, results[0].Limited)
+	assert.True(t, results[1].Limited, "operations run in order")
+	assert.Equal(t, 1, results[2].Remaining)
+}
+
+func TestCheckPipelinesMatchedRules(t *testing.T) {
+	ra, _, client := setup(t)
+	for _, key := range []string{"a:%{ip}", "b:%{ip}", "c:%{ip}", "d:%{ip}", "e:%{ip}"} {
+		require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: key, Limit: 1, Period: time.Minute}))
+	}
+	// Load the scripts, so the checks below are not a cold start.
+	_, _ = ra.Check(req("GET", "/", "9.9.9.9:1"))
+
+	hook := &roundTrips{}
+	client.AddHook(hook)
+	r := req("GET", "/", "1.1.1.1:1")
+	d, err := ra.Check(r)
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, int64(1), hook.n.Load(), "five rules, one round trip")
+
+	d, _ = ra.Check(r)
+	assert.False(t, d.Allowed)
+	require.NoError(t, ra.Commit(r))
+	assert.Equal(t, int64(3), hook.n.Load())
+}
+
+func TestWithKeyPrefix(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	store := rackattack.NewRedisStore(client, "test:")
+	newApp := func(prefix string) *rackattack.RedisRackAttack {
+		ra, err := rackattack.New(store, rackattack.WithKeyPrefix(prefix))
+		require.NoError(t, err)
+		require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "throttle:%{ip}", Limit: 1, Period: time.Minute}))
+		ra.Fail2Ban(rackattack.Fail2BanRule{Name: "trap", PathPattern: "/wp-admin", MaxRetry: 1, FindTime: time.Minute, BanTime: time.Hour})
+		return ra
+	}
+	billing, search := newApp("billing:"), newApp("search:")
+	r := req("GET", "/", "1.1.1.1:1")
+
+	d, _ := billing.Check(r)
+	assert.True(t, d.Allowed)
+	d, _ = search.Check(r)
+	assert.True(t, d.Allowed, "the apps' identical keys do not collide")
+	assert.True(t, mr.Exists("test:billing:throttle:1.1.1.1"))
+	assert.True(t, mr.Exists("test:search:throttle:1.1.1.1"))
+
+	_, _ = billing.Check(req("GET", "/wp-admin", "2.2.2.2:1"))
+	assert.True(t, mr.Exists("test:ban:billing:trap:2.2.2.2"))
+	d, _ = search.Check(req("GET", "/", "2.2.2.2:1"))
+	assert.True(t, d.Allowed, "a ban in one app does not carry over")
+
+	existed, err := billing.ResetThrottle(context.Background(), "throttle:1.1.1.1")
+	require.NoError(t, err)
+	assert.True(t, existed)
+	assert.True(t, mr.Exists("test:search:throttle:1.1.1.1"))
+}
+
+func TestResetAll(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	require.NoError(t, client.Set(ctx, "unrelated", "1", 0).Err())
+
+	newApp := func(store rackattack.Store, opts ...rackattack.Option) *rackattack.RedisRackAttack {
+		ra, err := rackattack.New(store, opts...)
+		require.NoError(t, err)
+		require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "throttle:%{ip}", Limit: 1, Period: time.Minute}))
+		ra.Fail2Ban(rackattack.Fail2BanRule{Name: "trap", PathPattern: "/wp-admin", MaxRetry: 1, FindTime: time.Minute, BanTime: time.Hour})
+		_, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+		_, _ = ra.Check(req("GET", "/wp-admin", "2.2.2.2:1"))
+		return ra
+	}
+
+	ra := newApp(rackattack.NewRedisStore(client, "test:"))
+	newApp(rackattack.NewRedisStore(client, "other:"))
+	require.True(t, mr.Exists("test:throttle:1.1.1.1"))
+	require.True(t, mr.Exists("test:ban:trap:2.2.2.2"))
+	require.NoError(t, ra.ResetAll(ctx))
+	for _, k := range mr.Keys() {
+		assert.False(t, strings.HasPrefix(k, "test:"), k)
+	}
+	assert.True(t, mr.Exists("unrelated"))
+	assert.True(t, mr.Exists("other:throttle:1.1.1.1"), "another store's keys are left alone")
+	d, _ := ra.Check(req("GET", "/", "2.2.2.2:1"))
+	assert.True(t, d.Allowed, "the ban is gone")
+
+	// Under WithKeyPrefix only that app's keys go, including its bans.
+	store := rackattack.NewRedisStore(client, "")
+	billing := newApp(store, rackattack.WithKeyPrefix("bill[1]:"))
+	newApp(store, rackattack.WithKeyPrefix("search:"))
+	require.True(t, mr.Exists("ban:bill[1]:trap:2.2.2.2"))
+	require.NoError(t, billing.ResetAll(ctx))
+	assert.False(t, mr.Exists("bill[1]:throttle:1.1.1.1"))
+	assert.False(t, mr.Exists("ban:bill[1]:trap:2.2.2.2"))
+	assert.True(t, mr.Exists("search:throttle:1.1.1.1"))
+	assert.True(t, mr.Exists("ban:search:trap:2.2.2.2"))
+
+	unscoped, err := rackattack.New(store)
+	require.NoError(t, err)
+	assert.ErrorIs(t, unscoped.ResetAll(ctx), rackattack.ErrUnscopedReset)
+	assert.True(t, mr.Exists("unrelated"))
+}
+
+func TestResetAllOnRing(t *testing.T) {
+	ctx := context.Background()
+	shards := map[string]*miniredis.Miniredis{"a": miniredis.RunT(t), "b": miniredis.RunT(t)}
+	addrs := make(map[string]string)
+	for name, mr := range shards {
+		addrs[name] = mr.Addr()
+	}
+	ring := redis.NewRing(&redis.RingOptions{Addrs: addrs})
+	t.Cleanup(func() { _ = ring.Close() })
+	ra, err := rackattack.New(rackattack.NewRedisStore(ring, "test:"))
+	require.NoError(t, err)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "throttle:%{ip}", Limit: 1, Period: time.Minute}))
+	for i := 0; i < 20; i++ {
+		_, _ = ra.Check(req("GET", "/", fmt.Sprintf("10.0.0.%d:1", i)))
+	}
+	for name, mr := range shards {
+		require.NotEmpty(t, mr.Keys(), "shard %s holds some keys", name)
+	}
+
+	require.NoError(t, ra.ResetAll(ctx))
+	for name, mr := range shards {
+		assert.Empty(t, mr.Keys(), "shard %s", name)
+	}
+}
+
+func TestRedisCounterStore(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	store := rackattack.NewRedisCounterStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:")
+	q := rackattack.Quota{Algorithm: rackattack.FixedWindow, Limit: 5, Period: time.Minute, Cost: 2}
+
+	for _, want := range []int{3, 1} {
+		res, err := store.Throttle(ctx, "k", q)
+		require.NoError(t, err)
+		assert.False(t, res.Limited)
+		assert.Equal(t, want, res.Remaining)
+		assert.Equal(t, time.Minute, res.Reset)
+	}
+	res, err := store.Throttle(ctx, "k", q)
+	require.NoError(t, err)
+	assert.True(t, res.Limited)
+	assert.Equal(t, time.Minute, res.RetryAfter)
+	mr.CheckGet(t, "test:k", "4") // the throttled hit was taken back
+	res, err = store.Peek(ctx, "k", q)
+	require.NoError(t, err)
+	assert.True(t, res.Limited)
+	assert.Equal(t, 1, res.Remaining)
+	mr.FastForward(time.Minute)
+	res, _ = store.Throttle(ctx, "k", q)
+	assert.Equal(t, 3, res.Remaining, "the window expired")
+
+	_, err = store.Throttle(ctx, "k", rackattack.Quota{Limit: 5, Period: time.Minute})
+	assert.Error(t, err, "only FixedWindow is supported")
+
+	p := rackattack.BanPolicy{MaxRetry: 2, FindTime: time.Minute, BanTime: time.Minute, Backoff: 2}
+	banned, _, err := store.Strike(ctx, "s", p)
+	require.NoError(t, err)
+	assert.False(t, banned)
+	banned, level, err := store.Strike(ctx, "s", p)
+	require.NoError(t, err)
+	assert.True(t, banned)
+	assert.Equal(t, 1, level)
+	assert.Equal(t, time.Minute, mr.TTL("test:ban:s"))
+	banned, _ = store.Banned(ctx, "s")
+	assert.True(t, banned)
+	mr.FastForward(time.Minute)
+	_, _, _ = store.Strike(ctx, "s", p)
+	_, level, _ = store.Strike(ctx, "s", p)
+	assert.Equal(t, 2, level)
+	assert.Equal(t, 2*time.Minute, mr.TTL("test:ban:s"), "backoff doubles the ban")
+
+	n, err := store.ResetAll(ctx, "")
+	require.NoError(t, err)
+	assert.Positive(t, n)
+	assert.Empty(t, mr.Keys())
+}
+
+func TestStartRefiller(t *testing.T) {
+	mr := miniredis.RunT(t)
+	clock := &manualClock{t: time.Unix(1_700_000_000, 0)}
+	ra, err := rackattack.New(rackattack.NewRedisCounterStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:"), rackattack.WithClock(clock))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ra.Close() })
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 10, Period: time.Second, Algorithm: rackattack.FixedWindow}))
+	r := req("GET", "/", "1.1.1.1:1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, ra.StartRefiller(ctx))
+	assert.Error(t, ra.StartRefiller(ctx), "one refiller at a time")
+	for i := 0; i < 10; i++ {
+		_, _ = ra.Check(r)
+	}
+	d, _ := ra.Check(r)
+	require.False(t, d.Allowed)
+
+	clock.Advance(300 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		v, _ := mr.Get("test:api:1.1.1.1")
+		return v == "7"
+	}, time.Second, 10*time.Millisecond, "3 hits drain in 300ms at 10 per second")
+	d, _ = ra.Check(r)
+	assert.True(t, d.Allowed, "the drained budget is usable before the window ends")
+
+	clock.Advance(time.Second)
+	assert.Eventually(t, func() bool { return !mr.Exists("test:api:1.1.1.1") }, time.Second, 10*time.Millisecond,
+		"an empty counter is deleted")
+
+	cancel()
+	assert.Eventually(t, func() bool { return ra.StartRefiller(context.Background()) == nil }, time.Second, 10*time.Millisecond,
+		"a cancelled refiller can be started again")
+
+	mem, err := rackattack.New(rackattack.NewMemoryStore())
+	require.NoError(t, err)
+	assert.Error(t, mem.StartRefiller(context.Background()), "MemoryStore is not a DecayStore")
+}
+
+func TestRedisCounterStoreNeedsFixedWindow(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ra, err := rackattack.New(rackattack.NewRedisCounterStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:"))
+	require.NoError(t, err)
+
+	err = ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	assert.ErrorIs(t, err, rackattack.ErrRuleInvalid, "the default SlidingWindow cannot be counted")
+	assert.ErrorIs(t, ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute, Algorithm: rackattack.TokenBucket}),
+		rackattack.ErrRuleInvalid)
+	assert.ErrorIs(t, ra.LoadConfig(rackattack.Config{Throttle: []rackattack.ThrottleConfig{
+		{Name: "api", Key: "api:%{ip}", Limit: 1, Period: rackattack.Duration(time.Minute)},
+	}}), rackattack.ErrRuleInvalid)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute, Algorithm: rackattack.FixedWindow}))
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "poll", Key: "poll:%{ip}", Interval: time.Second}))
+
+	require.NoError(t, ra.SetGlobalLimit(2, time.Minute, "global:%{ip}"))
+	r := req("GET", "/other", "1.1.1.1:1")
+	for i := 0; i < 2; i++ {
+		_, _ = ra.Check(r)
+	}
+	mr.CheckGet(t, "test:global:1.1.1.1", "2")
+
+	allowed, remaining, err := ra.Allow(context.Background(), "vendor", 1, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Zero(t, remaining)
+	allowed, _, err = ra.Allow(context.Background(), "vendor", 1, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, allowed, "Allow counts a fixed window rather than failing open")
+}
+
+func TestDecisionReasonSeparatesBlocksFromThrottles(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.BlocklistIP("6.6.6.6"))
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute}))
+
+	status := func(r *http.Request) int {
+		d, err := ra.Check(r)
+		require.NoError(t, err)
+		switch d.Reason {
+		case rackattack.ReasonBlocklisted, rackattack.ReasonBanned:
+			return http.StatusForbidden
+		case rackattack.ReasonThrottled:
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	}
+
+	blocked := req("GET", "/", "6.6.6.6:1")
+	denied, _ := ra.IsThrottled(blocked)
+	assert.True(t, denied, "IsThrottled folds every denial into true")
+	assert.Equal(t, http.StatusForbidden, status(blocked))
+
+	r := req("GET", "/", "1.1.1.1:1")
+	assert.Equal(t, http.StatusOK, status(r))
+	assert.Equal(t, http.StatusTooManyRequests, status(r))
+}
+
+// manualClock is a Clock advanced by hand.
+type manualClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func TestWithClock(t *testing.T) {
+	clock := &manualClock{t: time.Unix(1_700_000_000, 0)}
+	ra, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithClock(clock))
+	require.NoError(t, err)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute}))
+	r := req("GET", "/", "1.1.1.1:1")
+
+	d, _ := ra.Check(r)
+	require.True(t, d.Allowed)
+	clock.Advance(59 * time.Second)
+	d, _ = ra.Check(r)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, time.Second, d.Throttle.RetryAfter)
+
+	clock.Advance(time.Second)
+	d, _ = ra.Check(r)
+	assert.True(t, d.Allowed, "the window slid without sleeping")
+
+	h := http.Header{}
+	ra, err = rackattack.New(rackattack.NewMemoryStore(), rackattack.WithClock(clock), rackattack.WithRateLimitHeaders(rackattack.XRateLimitHeaders))
+	require.NoError(t, err)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute}))
+	d, _ = ra.Check(r)
+	ra.SetRateLimitHeaders(h, d)
+	assert.Equal(t, strconv.FormatInt(clock.Now().Add(time.Minute).Unix(), 10), h.Get("X-RateLimit-Reset"))
+
+	_, err = rackattack.New(rackattack.NewMemoryStore(), rackattack.WithClock(nil))
+	assert.Error(t, err)
+}
+
+func TestWithClockOnSharedRedisStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := rackattack.NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:")
+	ra, err := rackattack.New(store)
+	require.NoError(t, err)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 100, Period: time.Minute}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			_, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		_, err := rackattack.New(store, rackattack.WithClock(&manualClock{t: time.Now()}))
+		require.NoError(t, err)
+	}
+	wg.Wait()
+}
+
+// ctxStore records a context value seen by Throttle.
+type ctxStore struct {
+	rackattack.Store
+	seen atomic.Value
+}
+
+func (s *ctxStore) Throttle(ctx context.Context, key string, q rackattack.Quota) (rackattack.Result, error) {
+	if v, ok := ctx.Value(traceKey{}).(string); ok {
+		s.seen.Store(v)
+	}
+	return s.Store.Throttle(ctx, key, q)
+}
+
+type traceKey struct{}
+
+func TestWithContextFunc(t *testing.T) {
+	store := &ctxStore{Store: rackattack.NewMemoryStore()}
+	base := context.WithValue(context.Background(), traceKey{}, "trace-123")
+	ra, err := rackattack.New(store, rackattack.WithContextFunc(func(r *http.Request) context.Context {
+		return base
+	}))
+	require.NoError(t, err)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d, err := ra.Check(req("GET", "/", "1.1.1.1:1").WithContext(ctx))
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, "trace-123", store.seen.Load(), "store calls use the derived context")
+}
+
+func TestStats(t *testing.T) {
+	ra, _, _ := setup(t)
+	rule := rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 5, Period: time.Minute, Cost: 2}
+	require.NoError(t, ra.Throttle(rule))
+	ctx := context.Background()
+	r := req("GET", "/", "1.1.1.1:1")
+
+	current, limit, ttl, err := ra.Stats(ctx, rule, r)
+	require.NoError(t, err)
+	assert.Equal(t, 0, current)
+	assert.Equal(t, 5, limit)
+	assert.LessOrEqual(t, ttl, time.Minute)
+
+	_, _ = ra.Check(r)
+	_, _ = ra.Check(r)
+	for i := 0; i < 2; i++ {
+		current, limit, ttl, err = ra.Stats(ctx, rule, r)
+		require.NoError(t, err)
+		assert.Equal(t, 4, current, "Stats does not count")
+		assert.Equal(t, 5, limit)
+		assert.Greater(t, ttl, 59*time.Second)
+	}
+
+	bucket := rackattack.ThrottleRule{Key: "tb:%{ip}", Limit: 1, Period: time.Second, Burst: 3, Algorithm: rackattack.TokenBucket}
+	require.NoError(t, ra.Throttle(bucket))
+	_, _ = ra.Check(r)
+	current, limit, _, _ = ra.Stats(ctx, bucket, r)
+	assert.Equal(t, 1, current)
+	assert.Equal(t, 3, limit, "buckets report their capacity")
+}
+
+func TestAllow(t *testing.T) {
+	ra, mr, _ := setup(t)
+	ctx := context.Background()
+
+	for want := 1; want >= 0; want-- {
+		allowed, remaining, err := ra.Allow(ctx, "vendor:acme", 2, time.Minute)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, want, remaining)
+	}
+	allowed, remaining, err := ra.Allow(ctx, "vendor:acme", 2, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Zero(t, remaining)
+
+	allowed, _, err = ra.Allow(ctx, "vendor:other", 2, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, allowed, "keys count separately")
+
+	found, err := ra.ResetThrottle(ctx, "vendor:acme")
+	require.NoError(t, err)
+	assert.True(t, found)
+	allowed, _, _ = ra.Allow(ctx, "vendor:acme", 2, time.Minute)
+	assert.True(t, allowed)
+
+	_, _, err = ra.Allow(ctx, "vendor:acme", 0, time.Minute)
+	assert.Error(t, err)
+
+	mr.Close()
+	allowed, _, err = ra.Allow(ctx, "vendor:acme", 2, time.Minute)
+	assert.Error(t, err)
+	assert.True(t, allowed, "fails open by default")
+}
+
+func TestCaseInsensitivePath(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		PathPattern:         "/api/*",
+		CaseInsensitivePath: true,
+		Key:                 "api:%{ip}",
+		Limit:               1,
+		Period:              time.Minute,
+	}))
+
+	d, _ := ra.Check(req("GET", "/api/users", "1.1.1.1:1"))
+	assert.True(t, d.Allowed)
+	d, _ = ra.Check(req("GET", "/API/Users", "1.1.1.1:1"))
+	assert.False(t, d.Allowed, "varying case does not evade the rule")
+	d, _ = ra.Check(req("GET", "/Api/", "2.2.2.2:1"))
+	assert.NotNil(t, d.Rule, "trailing slashes are ignored too")
+	d, _ = ra.Check(req("GET", "/apix", "3.3.3.3:1"))
+	assert.Nil(t, d.Rule)
+}
+
+func TestSetRuleEnabled(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}", Limit: 1, Period: time.Minute}))
+	require.NoError(t, ra.SetGlobalLimit(2, time.Minute, "global:%{ip}"))
+	r := req("GET", "/", "1.1.1.1:1")
+
+	_, _ = ra.Check(r)
+	d, _ := ra.Check(r)
+	require.Equal(t, "api", d.RuleName)
+	require.False(t, d.Allowed)
+
+	assert.True(t, ra.SetRuleEnabled("api", false))
+	assert.True(t, ra.SetRuleEnabled("global", false))
+	for i := 0; i < 3; i++ {
+		d, _ = ra.Check(r)
+		assert.True(t, d.Allowed, "disabled rules are skipped")
+		assert.Nil(t, d.Rule)
+	}
+	assert.Len(t, ra.Rules(), 2, "disabling keeps the rules")
+
+	assert.True(t, ra.SetRuleEnabled("api", true))
+	d, _ = ra.Check(r)
+	assert.False(t, d.Allowed, "the rule kept its counter while off")
+	assert.False(t, ra.SetRuleEnabled("missing", true))
+}
+
+func TestThrottleMethodLimits(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		Name:         "api",
+		Key:          "api:%{ip}",
+		MethodLimits: map[string]int{"GET": 3, "post": 1},
+		Period:       time.Minute,
+	}))
+
+	post := req("POST", "/", "1.1.1.1:1")
+	d, _ := ra.Check(post)
+	assert.True(t, d.Allowed)
+	d, _ = ra.Check(post)
+	assert.False(t, d.Allowed, "POST has its own limit of 1")
+	assert.Equal(t, 1, d.Throttle.Limit)
+
+	get := req("GET", "/", "1.1.1.1:1")
+	for i := 0; i < 3; i++ {
+		d, _ = ra.Check(get)
+		assert.True(t, d.Allowed, "GET counts separately from POST")
+	}
+	d, _ = ra.Check(get)
+	assert.False(t, d.Allowed)
+
+	d, _ = ra.Check(req("DELETE", "/", "1.1.1.1:1"))
+	assert.True(t, d.Allowed)
+	assert.Nil(t, d.Rule, "unlisted methods skip a rule with no Limit")
+
+	found, err := ra.ResetThrottle(context.Background(), "api:1.1.1.1:POST")
+	require.NoError(t, err)
+	assert.True(t, found, "the method is appended to the key")
+
+	rules := ra.Rules()
+	assert.Equal(t, map[string]int{"GET": 3, "POST": 1}, rules[0].MethodLimits, "names are upper-cased")
+	rules[0].MethodLimits["POST"] = 100
+	assert.Equal(t, 1, ra.Rules()[0].MethodLimits["POST"], "Rules copies the map")
+
+	err = ra.Throttle(rackattack.ThrottleRule{Key: "x:%{ip}", MethodLimits: map[string]int{"GET": 0}, Period: time.Minute})
+	assert.Error(t, err)
+	err = ra.Throttle(rackattack.ThrottleRule{Key: "x:%{ip}", MethodLimits: map[string]int{"GET": 1, "get": 2}, Period: time.Minute})
+	assert.ErrorIs(t, err, rackattack.ErrRuleInvalid)
+}
+
+func TestPriorityAndStopOnMatch(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "api", PathPattern: "/api/*", Key: "api:%{ip}", Limit: 1, Period: time.Minute}))
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		Name: "login", PathPattern: "/api/login", Key: "login:%{ip}", Limit: 3, Period: time.Minute,
+		Priority: 10, StopOnMatch: true,
+	}))
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "low", Key: "low:%{ip}", Limit: 5, Period: time.Minute, Priority: -1}))
+
+	var names []string
+	for _, r := range ra.Rules() {
+		names = append(names, r.Name)
+	}
+	assert.Equal(t, []string{"login", "api", "low"}, names, "higher priority first, ties in registration order")
+
+	login := req("POST", "/api/login", "1.1.1.1:1")
+	for i := 0; i < 3; i++ {
+		d, err := ra.Check(login)
+		require.NoError(t, err)
+		assert.True(t, d.Allowed, "the broad api rule is suppressed")
+		assert.Equal(t, "login", d.RuleName)
+	}
+	d, _ := ra.Check(login)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "login", d.RuleName)
+
+	_, _ = ra.Check(req("GET", "/api/users", "1.1.1.1:1"))
+	d, _ = ra.Check(req("GET", "/api/users", "1.1.1.1:1"))
+	assert.False(t, d.Allowed, "other paths still fall to the api rule")
+	assert.Equal(t, "api", d.RuleName)
+
+	// Commit stops where Check does.
+	require.NoError(t, ra.Commit(req("POST", "/api/login", "2.2.2.2:1")))
+	d, _ = ra.Check(req("GET", "/api/users", "2.2.2.2:1"))
+	assert.True(t, d.Allowed, "Commit did not count the api rule")
+}
+
+func TestCommitSamplesRules(t *testing.T) {
+	ra, mr, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "rare", Key: "rare:%{ip}", Limit: 1, Period: time.Minute, SampleRate: 1e-12}))
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, ra.Commit(req("GET", "/", "1.1.1.1:1")))
+	}
+	assert.Empty(t, mr.Keys(), "the rule was sampled out")
+}
+
+func TestRecordSamplesRules(t *testing.T) {
+	ra, mr, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		Name: "rare", Key: "rare:%{ip}", Limit: 1, Period: time.Minute, SampleRate: 0.0001,
+		CountIf: func(int) bool { return true },
+	}))
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, ra.Record(req("GET", "/", "1.1.1.1:1"), http.StatusOK))
+	}
+	assert.Empty(t, mr.Keys(), "the rule was sampled out")
+}
+
+func TestRecordStopsOnMatch(t *testing.T) {
+	ra, mr, _ := setup(t)
+	failed := func(status int) bool { return status >= 400 }
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "api", PathPattern: "/api/*", Key: "api:%{ip}", Limit: 1, Period: time.Minute, CountIf: failed}))
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		Name: "login", PathPattern: "/api/login", Key: "login:%{ip}", Limit: 3, Period: time.Minute,
+		Priority: 10, StopOnMatch: true,
+	}))
+
+	require.NoError(t, ra.Record(req("POST", "/api/login", "1.1.1.1:1"), http.StatusUnauthorized))
+	assert.False(t, mr.Exists("test:api:1.1.1.1"), "the login rule suppresses the api rule")
+
+	var served int
+	h := ra.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		served++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req("POST", "/api/login", "1.1.1.1:1"))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	assert.Equal(t, 2, served)
+	assert.False(t, mr.Exists("test:api:1.1.1.1"))
+
+	require.NoError(t, ra.Record(req("GET", "/api/users", "1.1.1.1:1"), http.StatusUnauthorized))
+	assert.True(t, mr.Exists("test:api:1.1.1.1"), "other paths still count")
+}
+
+func TestStoreErrorsAreTyped(t *testing.T) {
+	ra, mr, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}", Limit: 1, Period: time.Minute}))
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "vip", Key: "vip:%{ip}", Limit: 1, Period: time.Minute}))
+	mr.Close()
+
+	_, err := ra.Check(req("GET", "/", "1.1.1.1:1"))
+	var se *rackattack.StoreError
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, "Batch", se.Op, "both rules were counted in one batch")
+	assert.NotErrorIs(t, err, rackattack.ErrRuleInvalid)
+
+	_, err = ra.IsThrottled(req("GET", "/", "1.1.1.1:1"))
+	assert.ErrorAs(t, err, &se)
+	_, _, err = ra.Allow(context.Background(), "k", 1, time.Minute)
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, "Throttle", se.Op)
+
+	err = ra.LoadConfig(rackattack.Config{Throttle: []rackattack.ThrottleConfig{{Name: "bad", Key: "k:%{ip}", Period: rackattack.Duration(time.Minute)}}})
+	assert.ErrorIs(t, err, rackattack.ErrRuleInvalid)
+	assert.False(t, errors.As(err, &se))
+}
+
+func TestSampleRateAppliesRuleToFraction(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore())
+	require.NoError(t, err)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "ramp", Key: "r:%{ip}", Limit: 10000, Period: time.Minute, SampleRate: 0.5}))
+
+	applied := 0
+	for i := 0; i < 1000; i++ {
+		d, err := ra.Check(req("GET", "/", "1.1.1.1:1"))
+		require.NoError(t, err)
+		if d.RuleName == "ramp" {
+			applied++
+		}
+	}
+	assert.InDelta(t, 500, applied, 100)
+
+	assert.ErrorIs(t, ra.Throttle(rackattack.ThrottleRule{Key: "x:%{ip}", Limit: 1, Period: time.Minute, SampleRate: 1.5}), rackattack.ErrRuleInvalid)
+}
+
+type closingStore struct {
+	*rackattack.MemoryStore
+	closed int
+}
+
+func (s *closingStore) Close() error {
+	s.closed++
+	return errors.New("already gone")
+}
+
+func TestClose(t *testing.T) {
+	ra, _, _ := setup(t)
+	assert.NoError(t, ra.Close(), "the bundled stores have nothing to close")
+
+	store := &closingStore{MemoryStore: rackattack.NewMemoryStore()}
+	ra, err := rackattack.New(store, rackattack.WithKeyPrefix("app:"))
+	require.NoError(t, err)
+	assert.EqualError(t, ra.Close(), "already gone")
+	assert.EqualError(t, ra.Close(), "already gone")
+	assert.Equal(t, 1, store.closed, "the store is closed once")
+}
+
+func TestRuleGroups(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "site", Key: "site:%{ip}", Limit: 100, Period: time.Minute}))
+	require.NoError(t, ra.AddRuleGroup("auth", []rackattack.ThrottleRule{
+		{Name: "login", PathPattern: "/login", Key: "login:%{ip}", Limit: 1, Period: time.Minute},
+		{Name: "reset", PathPattern: "/reset", Key: "reset:%{ip}", Limit: 1, Period: time.Minute},
+	}))
+	require.NoError(t, ra.AddRuleGroup("api", []rackattack.ThrottleRule{
+		{Name: "api", PathPattern: "/api/*", Key: "api:%{ip}", Limit: 10, Period: time.Minute},
+	}))
+	assert.Len(t, ra.Rules(), 4)
+
+	login := req("POST", "/login", "1.1.1.1:1")
+	_, _ = ra.Check(login)
+	d, _ := ra.Check(login)
+	require.False(t, d.Allowed)
+	assert.Equal(t, "auth", d.Rule.Group, "decisions carry the group")
+
+	err := ra.AddRuleGroup("auth", []rackattack.ThrottleRule{
+		{Name: "login", Key: "login:%{ip}", Limit: 5, Period: time.Minute},
+		{Name: "broken", Key: "b:%{ip}", Period: time.Minute},
+	})
+	assert.ErrorIs(t, err, rackattack.ErrRuleInvalid)
+	assert.Len(t, ra.Rules(), 4, "an invalid group leaves the old one in place")
+
+	require.NoError(t, ra.AddRuleGroup("auth", []rackattack.ThrottleRule{
+		{Name: "login", PathPattern: "/login", Key: "login:%{ip}", Limit: 5, Period: time.Minute},
+	}))
+	assert.Len(t, ra.Rules(), 3, "adding a group again replaces it")
+
+	assert.True(t, ra.RemoveRuleGroup("auth"))
+	assert.False(t, ra.RemoveRuleGroup("auth"))
+	var names []string
+	for _, r := range ra.Rules() {
+		names = append(names, r.Name)
+	}
+	assert.Equal(t, []string{"site", "api"}, names)
+}
+
+type mapGeo map[string]string
+
+func (g mapGeo) CountryOf(ip string) (string, error) {
+	if c, ok := g[ip]; ok {
+		return c, nil
+	}
+	return "", errors.New("not in database")
+}
+
+func TestGeoResolver(t *testing.T) {
+	geo := mapGeo{"1.1.1.1": "cn", "2.2.2.2": "DE", "3.3.3.3": "RU"}
+	ra, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithGeoResolver(geo))
+	require.NoError(t, err)
+	ra.BlocklistIf(func(r *http.Request) bool { return rackattack.CountryFromRequest(r) == "RU" })
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		Name: "cn", CountryPattern: "CN,KP", Key: "country:%{country}", Limit: 1, Period: time.Minute, SharedKey: true,
+	}))
+
+	d, _ := ra.Check(req("GET", "/", "3.3.3.3:1"))
+	assert.Equal(t, rackattack.ReasonBlocklisted, d.Reason, "predicates see the country")
+
+	d, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+	assert.Equal(t, "cn", d.RuleName)
+	d, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+	assert.False(t, d.Allowed)
+	found, _ := ra.ResetThrottle(context.Background(), "country:CN")
+	assert.True(t, found, "%{country} expands to the upper-cased code")
+
+	for _, addr := range []string{"2.2.2.2:1", "9.9.9.9:1"} {
+		d, _ = ra.Check(req("GET", "/", addr))
+		assert.True(t, d.Allowed)
+		assert.Nil(t, d.Rule, "other and unknown countries do not match")
+	}
+	assert.Empty(t, rackattack.CountryFromRequest(req("GET", "/", "1.1.1.1:1")))
+}
+
+func TestByteLimit(t *testing.T) {
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+		Name: "upload", Key: "up:%{ip}", Limit: 1000, Period: time.Minute,
+		Algorithm: rackattack.FixedWindow, ByteLimit: true, DefaultContentLength: 300,
+	}))
+	upload := func(size int) *http.Request {
+		r := httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("x", size)))
+		r.RemoteAddr = "1.1.1.1:1"
+		return r
+	}
+
+	d, _ := ra.Check(upload(600))
+	require.True(t, d.Allowed)
+	assert.Equal(t, 400, d.Throttle.Remaining, "the budget is in bytes")
+
+	chunked := upload(0)
+	chunked.ContentLength = -1
+	d, _ = ra.Check(chunked)
+	require.True(t, d.Allowed)
+	assert.Equal(t, 100, d.Throttle.Remaining, "unknown lengths count DefaultContentLength")
+
+	d, _ = ra.Check(upload(200))
+	assert.False(t, d.Allowed)
+
+	for name, rule := range map[string]rackattack.ThrottleRule{
+		"sliding": {Key: "k:%{ip}", Limit: 1, Period: time.Minute, ByteLimit: true},
+		"cost":    {Key: "k:%{ip}", Limit: 1, Period: time.Minute, ByteLimit: true, Algorithm: rackattack.TokenBucket, Cost: 2},
+	} {
+		assert.ErrorIs(t, ra.Throttle(rule), rackattack.ErrRuleInvalid, name)
+	}
+}
+
+func TestByteLimitHugeContentLength(t *testing.T) {
+	for _, alg := range []rackattack.Algorithm{rackattack.FixedWindow, rackattack.TokenBucket, rackattack.LeakyBucket} {
+		ra, err := rackattack.New(rackattack.NewMemoryStore())
+		require.NoError(t, err)
+		require.NoError(t, ra.Throttle(rackattack.ThrottleRule{
+			Name: "upload", Key: "up:%{ip}", Limit: 1000, Period: time.Minute, Algorithm: alg, ByteLimit: true,
+		}))
+		upload := func(size int64) *http.Request {
+			r := req("POST", "/upload", "1.1.1.1:1")
+			r.ContentLength = size
+			return r
+		}
+
+		d, err := ra.Check(upload(math.MaxInt64))
+		require.NoError(t, err)
+		assert.False(t, d.Allowed, "%v: a request larger than the budget is throttled", alg)
+		d, _ = ra.Check(upload(900))
+		assert.True(t, d.Allowed, alg)
+		d, _ = ra.Check(upload(900))
+		assert.False(t, d.Allowed, "%v: the counter did not wrap", alg)
+	}
+}
+
+func TestKeyFor(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithTrustedProxies("10.0.0.0/8"))
+	require.NoError(t, err)
+	r := req("POST", "/api/items?tenant=acme", "10.0.0.1:1")
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	r.Header.Set("X-Api-Key", "k1")
+
+	rule := rackattack.ThrottleRule{Key: "api:%{ip}:%{method}:%{path}:%{header:X-Api-Key}:%{query:tenant}"}
+	assert.Equal(t, "api:203.0.113.9:POST:/api/items:k1:acme", ra.KeyFor(rule, r))
+
+	rule.MethodLimits = map[string]int{"POST": 1}
+	assert.Equal(t, "api:203.0.113.9:POST:/api/items:k1:acme:POST", ra.KeyFor(rule, r))
+
+	rule = rackattack.ThrottleRule{KeyFunc: func(*http.Request) string { return "" }}
+	assert.Empty(t, ra.KeyFor(rule, r))
+}
+
+func TestKeyScope(t *testing.T) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithStrictKeys())
+	require.NoError(t, err)
+	r := req("POST", "/api/items", "203.0.113.9:1")
+
+	for scope, want := range map[rackattack.KeyScope]string{
+		rackattack.ScopeIP:           "api:203.0.113.9",
+		rackattack.ScopeIPPath:       "api:203.0.113.9:/api/items",
+		rackattack.ScopeIPPathMethod: "api:203.0.113.9:/api/items:POST",
+		rackattack.ScopeGlobal:       "api",
+	} {
+		rule := rackattack.ThrottleRule{Name: "api", Key: "ignored:%{ip}", KeyScope: scope, Limit: 1, Period: time.Minute}
+		assert.Equal(t, want, ra.KeyFor(rule, r), scope)
+		assert.NoError(t, ra.Throttle(rule), "%v passes WithStrictKeys", scope)
+	}
+
+	for name, rule := range map[string]rackattack.ThrottleRule{
+		"no name":  {KeyScope: rackattack.ScopeIP, Limit: 1, Period: time.Minute},
+		"key func": {Name: "f", KeyScope: rackattack.ScopeIP, KeyFunc: func(*http.Request) string { return "k" }, Limit: 1, Period: time.Minute},
+		"unknown":  {Name: "u", KeyScope: rackattack.KeyScope(9), Limit: 1, Period: time.Minute},
+	} {
+		assert.ErrorIs(t, ra.Throttle(rule), rackattack.ErrRuleInvalid, name)
+	}
+
+	var cfg rackattack.Config
+	require.NoError(t, json.Unmarshal([]byte(`{"throttle": [{"name": "login", "key_scope": "ip_path", "limit": 1, "period": "1m"}]}`), &cfg))
+	require.NoError(t, ra.LoadConfig(cfg))
+	assert.Equal(t, rackattack.ScopeIPPath, ra.Rules()[0].KeyScope)
+	d, _ := ra.Check(req("GET", "/login", "1.1.1.1:1"))
+	assert.True(t, d.Allowed)
+	d, _ = ra.Check(req("GET", "/login", "1.1.1.1:1"))
+	assert.False(t, d.Allowed)
+	d, _ = ra.Check(req("GET", "/other", "1.1.1.1:1"))
+	assert.True(t, d.Allowed, "each path has its own counter")
+	assert.Error(t, json.Unmarshal([]byte(`{"throttle": [{"key_scope": "user"}]}`), &cfg))
+}
+
+func TestIntervalAllowsOnePerInterval(t *testing.T) {
+	clock := &manualClock{t: time.Unix(1_700_000_000, 0)}
+	ra, err := rackattack.New(rackattack.NewMemoryStore(), rackattack.WithClock(clock))
+	require.NoError(t, err)
+	require.NoError(t, ra.Throttle(rackattack.ThrottleRule{Name: "hook", Key: "hook:%{ip}", Interval: 10 * time.Second, Cost: 5}))
+	r := req("POST", "/webhook", "1.1.1.1:1")
+
+	d, _ := ra.Check(r)
+	require.True(t, d.Allowed, "every request counts as one hit")
+	clock.Advance(4 * time.Second)
+	d, _ = ra.Check(r)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 6*time.Second, d.Throttle.RetryAfter)
+
+	clock.Advance(6 * time.Second)
+	d, _ = ra.Check(r)
+	assert.True(t, d.Allowed)
+
+	err = ra.Throttle(rackattack.ThrottleRule{Key: "x:%{ip}", Interval: time.Second, Limit: 5, Period: time.Minute})
+	assert.ErrorIs(t, err, rackattack.ErrRuleInvalid)
+}
+
+// countingStore counts the calls that reach the store.
+type countingStore struct {
+	rackattack.Store
+	calls atomic.Int64
+}
+
+func (s *countingStore) Throttle(ctx context.Context, key string, q rackattack.Quota) (rackattack.Result, error) {
+	s.calls.Add(1)
+	return s.Store.Throttle(ctx, key, q)
+}
+
+func (s *countingStore) Banned(ctx context.Context, key string) (bool, error) {
+	s.calls.Add(1)
+	return s.Store.Banned(ctx, key)
+}
+
+func TestCheckSkipsStoreWithoutMatchingRule(t *testing.T) {
+	store := &countingStore{Store: rackattack.NewMemoryStore()}
+	ra, err := rackattack.New(store)
+	require.NoError(t, err)
+	ra.MustThrottle(rackattack.ThrottleRule{PathPattern: "/api/*", Key: "api:%{ip}", Limit: 10, Period: time.Minute})
+
+	d, err := ra.Check(req("GET", "/static/app.js", "1.1.1.1:1"))
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Zero(t, store.calls.Load())
+
+	_, _ = ra.Check(req("GET", "/api/items", "1.1.1.1:1"))
+	assert.Equal(t, int64(1), store.calls.Load())
+}
+
+func benchmarkCheck(b *testing.B, r *http.Request) {
+	store := &countingStore{Store: rackattack.NewMemoryStore()}
+	ra, err := rackattack.New(store)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ra.SafelistIP("10.0.0.9")
+	for _, p := range []string{"/api/*", "/login", "/admin/**", "/upload"} {
+		ra.MustThrottle(rackattack.ThrottleRule{PathPattern: p, Key: "t:" + p + ":%{ip}", Limit: 1 << 30, Period: time.Minute})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ra.Check(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(store.calls.Load())/float64(b.N), "storecalls/op")
+}
+
+func BenchmarkCheckNoMatchingRule(b *testing.B) {
+	benchmarkCheck(b, req("GET", "/static/app.js", "1.1.1.1:1"))
+}
+
+func BenchmarkCheckSafelisted(b *testing.B) {
+	benchmarkCheck(b, req("GET", "/api/items", "10.0.0.9:1"))
+}
+
+func BenchmarkCheckMatchingRule(b *testing.B) {
+	benchmarkCheck(b, req("GET", "/api/items", "1.1.1.1:1"))
+}
+
+// benchmarkCheck100Rules checks r against 100 rules of mixed pattern kinds,
+// at most one of which matches it, registered one by one with Throttle or,
+// if viaConfig, all at once with LoadConfig.
+func benchmarkCheck100Rules(b *testing.B, r *http.Request, viaConfig bool) {
+	ra, err := rackattack.New(rackattack.NewMemoryStore())
+	if err != nil {
+		b.Fatal(err)
+	}
+	var cfg rackattack.Config
+	for i := 0; i < 100; i++ {
+		var p string
+		switch i % 5 {
+		case 0:
+			p = fmt.Sprintf("/svc%d/*", i)
+		case 1:
+			p = fmt.Sprintf("/svc%d/items", i)
+		case 2:
+			p = fmt.Sprintf("/svc%d/v*/items", i)
+		case 3:
+			p = fmt.Sprintf("/svc%d/**/admin", i)
+		case 4:
+			p = fmt.Sprintf("/svc%d/files/*.json", i)
+		}
+		key := fmt.Sprintf("t%d:%%{ip}", i)
+		if viaConfig {
+			cfg.Throttle = append(cfg.Throttle, rackattack.ThrottleConfig{PathPattern: p, Key: key, Limit: 1 << 30, Period: rackattack.Duration(time.Minute)})
+		} else {
+			ra.MustThrottle(rackattack.ThrottleRule{PathPattern: p, Key: key, Limit: 1 << 30, Period: time.Minute})
+		}
+	}
+	if viaConfig {
+		if err := ra.LoadConfig(cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ra.Check(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCheck100RulesNoMatch(b *testing.B) {
+	benchmarkCheck100Rules(b, req("GET", "/static/app.js", "1.1.1.1:1"), false)
+}
+
+func BenchmarkCheck100RulesOneMatch(b *testing.B) {
+	benchmarkCheck100Rules(b, req("GET", "/svc98/a/b/admin", "1.1.1.1:1"), false)
+}
+
+func BenchmarkCheck100RulesFromConfig(b *testing.B) {
+	benchmarkCheck100Rules(b, req("GET", "/svc98/a/b/admin", "1.1.1.1:1"), true)
+}
+
+func TestSafelistPrivateNetworks(t *testing.T) {
+	ra, _, _ := setup(t)
+	ra.Throttle(rackattack.ThrottleRule{Key: "api:%{ip}", Limit: 1, Period: time.Minute})
+	ra.SafelistPrivateNetworks()
+
+	for _, addr := range []string{"127.0.0.1:1", "[::1]:1", "10.1.2.3:1", "172.20.0.1:1", "192.168.1.1:1", "169.254.0.5:1", "[fd00::7]:1", "[fe80::1]:1"} {
+		d, err := ra.Check(req("GET", "/", addr))
+		require.NoError(t, err)
+		assert.Equal(t, rackattack.ReasonSafelisted, d.Reason, addr)
+	}
+	d, _ := ra.Check(req("GET", "/", "172.32.0.1:1"))
+	assert.NotEqual(t, rackattack.ReasonSafelisted, d.Reason, "172.32/16 is outside 172.16/12")
+
+	require.NoError(t, ra.UnsafelistCIDR("10.0.0.0/8"))
+	d, _ = ra.Check(req("GET", "/", "10.1.2.3:1"))
+	assert.NotEqual(t, rackattack.ReasonSafelisted, d.Reason)
+}
+
+func TestRateHelpers(t *testing.T) {
+	base := rackattack.ThrottleRule{Name: "api", Key: "api:%{ip}"}
+	for _, tc := range []struct {
+		rule   rackattack.ThrottleRule
+		period time.Duration
+	}{
+		{base.PerSecond(10), time.Second},
+		{base.PerMinute(10), time.Minute},
+		{base.PerHour(10), time.Hour},
+	} {
+		assert.Equal(t, 10, tc.rule.Limit)
+		assert.Equal(t, tc.period, tc.rule.Period)
+		assert.Equal(t, "api", tc.rule.Name)
+	}
+	assert.Zero(t, base.Limit, "the receiver is left unchanged")
+
+	ra, _, _ := setup(t)
+	require.NoError(t, ra.Throttle(base.PerMinute(1)))
+	_, _ = ra.Check(req("GET", "/", "1.1.1.1:1"))
+	d, _ := ra.Check(req("GET", "/", "1.1.1.1:1"))
+	assert.False(t, d.Allowed)
+}
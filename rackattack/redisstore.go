@@ -2,7 +2,10 @@ package rackattack
 
 import (
 	"context"
+	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,51 +18,234 @@ import (
 // ARGV[1] = window in milliseconds
 // ARGV[2] = limit
 // ARGV[3] = current time in milliseconds
-// ARGV[4] = a unique member for this request (time-suffixed)
+// ARGV[4] = a unique member prefix for this request (time-suffixed)
+// ARGV[5] = cost, the number of hits to record
 //
 // It trims entries older than (now - window), counts what remains, and only
-// records the new hit when under limit. The key is given a TTL equal to the
-// window so idle keys self-evict. Returns {count, limited(0|1), oldestMs}.
+// records the new hits when they all fit under limit. The key is given a TTL equal to the
+// window so idle keys self-evict. Returns {count, limited(0|1), oldestMs},
+// where oldestMs is the score of the oldest hit still in the window.
 var throttleScript = redis.NewScript(`
 local key    = KEYS[1]
 local window = tonumber(ARGV[1])
 local limit  = tonumber(ARGV[2])
 local now    = tonumber(ARGV[3])
 local member = ARGV[4]
+local cost   = tonumber(ARGV[5])
 
 redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
 local count = redis.call('ZCARD', key)
+local limited = 0
 
-if count >= limit then
-  local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
-  local oldestMs = now
-  if oldest[2] then oldestMs = tonumber(oldest[2]) end
-  return {count, 1, oldestMs}
+if count + cost > limit then
+  limited = 1
+else
+  for i = 1, cost do
+    redis.call('ZADD', key, now, member .. ':' .. i)
+  end
+  redis.call('PEXPIRE', key, window)
+  count = count + cost
 end
 
-redis.call('ZADD', key, now, member)
-redis.call('PEXPIRE', key, window)
-return {count + 1, 0, now}
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+local oldestMs = now
+if oldest[2] then oldestMs = tonumber(oldest[2]) end
+return {count, limited, oldestMs}
+`)
+
+// fixedWindowScript implements a fixed-window counter atomically.
+//
+// KEYS[1] = throttle key
+// ARGV[1] = window in milliseconds
+// ARGV[2] = limit
+// ARGV[3] = cost
+//
+// When the hit would exceed limit it returns without counting. Otherwise it
+// adds cost to the counter, starting the window's TTL on the first hit, so a crash between
+// the two steps cannot leave a counter without an expiry.
+// Returns {count, limited(0|1), ttlMs}.
+var fixedWindowScript = redis.NewScript(`
+local key    = KEYS[1]
+local window = tonumber(ARGV[1])
+local limit  = tonumber(ARGV[2])
+local cost   = tonumber(ARGV[3])
+
+local count = tonumber(redis.call('GET', key) or '0')
+if count + cost > limit then
+  return {count, 1, redis.call('PTTL', key)}
+end
+
+count = redis.call('INCRBY', key, cost)
+if count == cost then
+  redis.call('PEXPIRE', key, window)
+end
+return {count, 0, redis.call('PTTL', key)}
+`)
+
+// gcraScript implements a token bucket as GCRA (generic cell rate
+// algorithm) atomically.
+//
+// KEYS[1] = throttle key
+// ARGV[1] = emission interval in milliseconds (period / limit, fractional)
+// ARGV[2] = burst capacity
+// ARGV[3] = current time in milliseconds
+// ARGV[4] = cost
+//
+// The key holds the theoretical arrival time (TAT) of the next request, in
+// full precision so that sub-millisecond intervals add up. A request is
+// admitted while its TAT, advanced by cost intervals, is no more than burst
+// intervals ahead of now; admitting it stores the advanced TAT. The key
+// expires once the bucket would be full again. Returns {limited(0|1),
+// remaining, retryAfterMs, resetMs}.
+var gcraScript = redis.NewScript(`
+local key      = KEYS[1]
+local interval = tonumber(ARGV[1])
+local burst    = tonumber(ARGV[2])
+local now      = tonumber(ARGV[3])
+local cost     = tonumber(ARGV[4])
+
+local tat = tonumber(redis.call('GET', key) or now)
+if tat < now then tat = now end
+
+local newTat  = tat + interval * cost
+local allowAt = newTat - interval * burst
+
+if now < allowAt then
+  return {1, 0, math.ceil(allowAt - now), math.ceil(tat - now)}
+end
+
+local ttl = math.ceil(newTat - now)
+redis.call('SET', key, string.format('%.17g', newTat), 'PX', ttl)
+return {0, math.floor((now - allowAt) / interval), 0, ttl}
+`)
+
+// peekSlidingScript reads a sliding-window log without modifying it.
+//
+// KEYS[1] = throttle key
+// ARGV[1] = window in milliseconds
+// ARGV[2] = current time in milliseconds
+//
+// Returns {count, oldestMs}, counting only the hits still inside the window.
+var peekSlidingScript = redis.NewScript(`
+local key    = KEYS[1]
+local window = tonumber(ARGV[1])
+local now    = tonumber(ARGV[2])
+
+local cutoff = '(' .. (now - window)
+local count  = redis.call('ZCOUNT', key, cutoff, '+inf')
+local oldest = redis.call('ZRANGEBYSCORE', key, cutoff, '+inf', 'WITHSCORES', 'LIMIT', 0, 1)
+local oldestMs = now
+if oldest[2] then oldestMs = tonumber(oldest[2]) end
+return {count, oldestMs}
+`)
+
+// peekFixedScript reads a fixed-window counter and its TTL in one step.
+// Returns {count, ttlMs}.
+var peekFixedScript = redis.NewScript(`
+return {tonumber(redis.call('GET', KEYS[1]) or '0'), redis.call('PTTL', KEYS[1])}
+`)
+
+// leakyScript implements a leaky bucket atomically.
+//
+// KEYS[1] = throttle key, a hash of the bucket level and last drain time
+// ARGV[1] = drain rate in hits per millisecond (limit / period, fractional)
+// ARGV[2] = capacity
+// ARGV[3] = current time in milliseconds
+// ARGV[4] = cost
+//
+// It drains the bucket for the time since it was last drained, then adds cost
+// unless that would overflow capacity. The key expires once the bucket would
+// be empty. Returns {limited(0|1), level}, with the level as a string so no
+// precision is lost.
+var leakyScript = redis.NewScript(`
+local key      = KEYS[1]
+local rate     = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local now      = tonumber(ARGV[3])
+local cost     = tonumber(ARGV[4])
+
+local state = redis.call('HMGET', key, 'level', 'last')
+local level = tonumber(state[1]) or 0
+local last  = tonumber(state[2]) or now
+if now > last then
+  level = math.max(level - (now - last) * rate, 0)
+  last = now
+end
+
+local limited = 0
+if level + cost > capacity then
+  limited = 1
+else
+  level = level + cost
+end
+redis.call('HSET', key, 'level', string.format('%.17g', level), 'last', string.format('%d', last))
+redis.call('PEXPIRE', key, math.max(math.ceil(level / rate), 1))
+return {limited, string.format('%.17g', level)}
+`)
+
+// peekLeakyScript reads a leaky bucket's level and last drain time.
+// Returns {level, lastMs}, each nil when the key does not exist.
+var peekLeakyScript = redis.NewScript(`
+return redis.call('HMGET', KEYS[1], 'level', 'last')
+`)
+
+// peekGCRAScript reads a token bucket's theoretical arrival time, or "" when
+// the key does not exist. It is a script rather than a plain GET so that it
+// pipelines like the others.
+var peekGCRAScript = redis.NewScript(`
+return redis.call('GET', KEYS[1]) or ''
+`)
+
+// distinctScript counts distinct values in a HyperLogLog atomically.
+//
+// KEYS[1] = throttle key
+// ARGV[1] = window in milliseconds
+// ARGV[2] = member
+//
+// It adds member, starting the window's TTL when the key has none, so a
+// crash between the two steps cannot leave a log without an expiry.
+// Returns {count, ttlMs}.
+var distinctScript = redis.NewScript(`
+local key = KEYS[1]
+redis.call('PFADD', key, ARGV[2])
+if redis.call('PTTL', key) < 0 then
+  redis.call('PEXPIRE', key, tonumber(ARGV[1]))
+end
+return {redis.call('PFCOUNT', key), redis.call('PTTL', key)}
+`)
+
+// peekDistinctScript reads a HyperLogLog's count and TTL in one step.
+// Returns {count, ttlMs}.
+var peekDistinctScript = redis.NewScript(`
+return {redis.call('PFCOUNT', KEYS[1]), redis.call('PTTL', KEYS[1])}
 `)
 
 // strikeScript implements Fail2Ban atomically.
 //
-// KEYS[1] = ban key, KEYS[2] = strike-counter key
-// ARGV[1] = maxRetry, ARGV[2] = findTime ms, ARGV[3] = banTime ms
+// KEYS[1] = ban key, KEYS[2] = strike-counter key, KEYS[3] = backoff-level key
+// ARGV[1] = maxRetry, ARGV[2] = findTime ms, ARGV[3] = banTime ms,
+// ARGV[4] = backoff factor, ARGV[5] = maxBanTime ms (0 = uncapped)
 //
-// If a ban is already set, it returns 1 immediately. Otherwise it increments
+// If a ban is already set, it returns immediately. Otherwise it increments
 // the offense counter (setting findTime TTL on first offense). When offenses
-// reach maxRetry it sets the ban with banTime TTL and clears the counter.
-// Returns 1 when banned after this call, else 0.
+// reach maxRetry it sets the ban and clears the counter. With a backoff
+// factor above 1 it first bumps the level, and the ban lasts
+// banTime * backoff^(level-1), capped at maxBanTime and, like BanPolicy's
+// Go arithmetic, at math.MaxInt64 nanoseconds; the level key outlives the ban
+// by the ban's own length, within the same cap. Returns {banned(0|1), level}.
 var strikeScript = redis.NewScript(`
-local banKey    = KEYS[1]
-local countKey  = KEYS[2]
-local maxRetry  = tonumber(ARGV[1])
-local findTime  = tonumber(ARGV[2])
-local banTime   = tonumber(ARGV[3])
+local banKey     = KEYS[1]
+local countKey   = KEYS[2]
+local levelKey   = KEYS[3]
+local maxRetry   = tonumber(ARGV[1])
+local findTime   = tonumber(ARGV[2])
+local banTime    = tonumber(ARGV[3])
+local backoff    = tonumber(ARGV[4])
+local maxBanTime = tonumber(ARGV[5])
 
+local level = tonumber(redis.call('GET', levelKey) or '0')
 if redis.call('EXISTS', banKey) == 1 then
-  return 1
+  return {1, level}
 end
 
 local count = redis.call('INCR', countKey)
@@ -67,13 +253,27 @@ if count == 1 then
   redis.call('PEXPIRE', countKey, findTime)
 end
 
-if count >= maxRetry then
-  redis.call('SET', banKey, 1, 'PX', banTime)
-  redis.call('DEL', countKey)
-  return 1
+if count < maxRetry then
+  return {0, level}
 end
 
-return 0
+local ttl = banTime
+if backoff > 1 then
+  level = redis.call('INCR', levelKey)
+  ttl = banTime * backoff ^ (level - 1)
+  -- A high level overflows the power to inf, and a zero banTime times inf
+  -- is NaN.
+  if ttl ~= ttl then ttl = banTime end
+  if maxBanTime > 0 and ttl > maxBanTime then ttl = maxBanTime end
+  if ttl > 9223372036854 then ttl = 9223372036854 end
+  ttl = math.floor(ttl)
+  redis.call('PEXPIRE', levelKey, string.format('%d', math.min(2 * ttl, 9223372036854)))
+else
+  level = 0
+end
+redis.call('SET', banKey, 1, 'PX', string.format('%d', ttl))
+redis.call('DEL', countKey)
+return {1, level}
 `)
 
 // RedisStore is a Redis-backed Store. It uses server-side Lua scripts so that
@@ -81,23 +281,188 @@ return 0
 type RedisStore struct {
 	client    redis.Cmdable
 	keyPrefix string
-	now       func() time.Time
+	clock     atomic.Pointer[Clock]
 	seq       atomic.Uint64
 }
 
-// NewRedisStore wraps a go-redis client as a Store. keyPrefix is prepended to
-// every key (pass "" for none); a trailing separator is recommended, e.g.
-// "rackattack:".
+// NewRedisStore wraps a go-redis client as a Store. Any redis.Cmdable works:
+// *redis.Client, *redis.ClusterClient, a Sentinel failover client, or a
+// redis.UniversalClient. keyPrefix is prepended to every key (pass "" for
+// none); a trailing separator is recommended, e.g. "rackattack:".
+//
+// On Redis Cluster, every script touches a single key except Strike, whose
+// ban, counter, and backoff-level keys must hash to the same slot. A hash-tagged prefix such
+// as "{rackattack}:" guarantees that, at the cost of keeping all keys on one
+// shard.
 func NewRedisStore(client redis.Cmdable, keyPrefix string) *RedisStore {
-	return &RedisStore{client: client, keyPrefix: keyPrefix, now: time.Now}
+	return &RedisStore{client: client, keyPrefix: keyPrefix}
+}
+
+// setClock is safe to call while the store is in use, as when two instances
+// share it.
+func (s *RedisStore) setClock(c Clock) {
+	s.clock.Store(&c)
+}
+
+// now returns the time from the clock set by WithClock, if any.
+func (s *RedisStore) now() time.Time {
+	if c := s.clock.Load(); c != nil {
+		return (*c).Now()
+	}
+	return time.Now()
 }
 
 func (s *RedisStore) k(key string) string {
 	return s.keyPrefix + key
 }
 
+// scriptCall is one throttle-state script invocation and the parser for its
+// reply, so that single calls and pipelined batches share the same code.
+type scriptCall struct {
+	script *redis.Script
+	keys   []string
+	args   []any
+	parse  func(reply any) (Result, error)
+}
+
+// run executes c on its own.
+func (s *RedisStore) run(ctx context.Context, c scriptCall) (Result, error) {
+	res, err := c.script.Run(ctx, s.client, c.keys, c.args...).Result()
+	if err != nil {
+		return Result{}, err
+	}
+	return c.parse(res)
+}
+
 // Throttle implements Store.
-func (s *RedisStore) Throttle(ctx context.Context, key string, limit int, period time.Duration) (Result, error) {
+func (s *RedisStore) Throttle(ctx context.Context, key string, q Quota) (Result, error) {
+	c, err := s.throttleCall(key, q)
+	if err != nil {
+		return Result{}, err
+	}
+	return s.run(ctx, c)
+}
+
+// Peek implements Store.
+func (s *RedisStore) Peek(ctx context.Context, key string, q Quota) (Result, error) {
+	c, err := s.peekCall(key, q)
+	if err != nil {
+		return Result{}, err
+	}
+	return s.run(ctx, c)
+}
+
+// Batch implements BatchStore by sending every operation in one pipeline.
+// Redis runs the scripts in order, so later operations see earlier hits.
+func (s *RedisStore) Batch(ctx context.Context, ops []BatchOp) ([]Result, error) {
+	calls := make([]scriptCall, len(ops))
+	for i, op := range ops {
+		var err error
+		if op.Peek {
+			calls[i], err = s.peekCall(op.Key, op.Quota)
+		} else {
+			calls[i], err = s.throttleCall(op.Key, op.Quota)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := s.pipeline(ctx, calls)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(calls))
+	for i, c := range calls {
+		if results[i], err = c.parse(replies[i]); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// pipeline sends calls in one pipeline and returns their raw replies. If the
+// script cache was flushed, the EVALSHAs that failed did not run: it loads
+// their scripts and sends just those again, so no call runs twice.
+func (s *RedisStore) pipeline(ctx context.Context, calls []scriptCall) ([]any, error) {
+	replies := make([]any, len(calls))
+	pending := make([]int, len(calls))
+	for i := range pending {
+		pending[i] = i
+	}
+	for attempt := 0; len(pending) > 0; attempt++ {
+		pipe := s.client.Pipeline()
+		cmds := make([]*redis.Cmd, len(pending))
+		for j, i := range pending {
+			c := calls[i]
+			cmds[j] = c.script.EvalSha(ctx, pipe, c.keys, c.args...)
+		}
+		// Exec's error is that of the first failed command; each is checked
+		// below.
+		_, _ = pipe.Exec(ctx)
+
+		var missing []int
+		toLoad := make(map[*redis.Script]bool)
+		for j, i := range pending {
+			res, err := cmds[j].Result()
+			if attempt == 0 && redis.HasErrorPrefix(err, "NOSCRIPT") {
+				missing = append(missing, i)
+				toLoad[calls[i].script] = true
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			replies[i] = res
+		}
+		for script := range toLoad {
+			if err := script.Load(ctx, s.client).Err(); err != nil {
+				return nil, err
+			}
+		}
+		pending = missing
+	}
+	return replies, nil
+}
+
+// checkRedisQuota is Quota.check for a store that keeps time in whole
+// milliseconds: a shorter Period would round to zero. A TokenBucket interval
+// (Period / Limit) under a microsecond is lost when added to a Unix time in
+// milliseconds, so it is rejected too.
+func checkRedisQuota(q Quota) error {
+	if err := q.check(); err != nil {
+		return err
+	}
+	if q.Period < time.Millisecond {
+		return fmt.Errorf("%w: period %v is under RedisStore's millisecond resolution", errInvalidQuota, q.Period)
+	}
+	if q.Algorithm == TokenBucket && q.Period/time.Duration(q.Limit) < time.Microsecond {
+		return fmt.Errorf("%w: token bucket interval %v is under a microsecond", errInvalidQuota, q.Period/time.Duration(q.Limit))
+	}
+	return nil
+}
+
+func (s *RedisStore) throttleCall(key string, q Quota) (scriptCall, error) {
+	if err := checkRedisQuota(q); err != nil {
+		return scriptCall{}, err
+	}
+	switch q.Algorithm {
+	case SlidingWindow:
+		return s.slidingCall(key, q.Limit, q.Period, q.cost()), nil
+	case FixedWindow:
+		return s.fixedCall(key, q.Limit, q.window(), q.cost()), nil
+	case TokenBucket:
+		return s.gcraCall(key, q), nil
+	case LeakyBucket:
+		return s.leakyCall(key, q), nil
+	case Distinct:
+		return s.distinctCall(distinctScript, key, q, []any{q.Period.Milliseconds(), q.Member}), nil
+	default:
+		return scriptCall{}, errUnknownAlgorithm
+	}
+}
+
+func (s *RedisStore) slidingCall(key string, limit int, period time.Duration, cost int) scriptCall {
 	nowMs := s.now().UnixMilli()
 	windowMs := period.Milliseconds()
 	// The sorted-set member must be unique per request so that two hits in the
@@ -105,44 +470,262 @@ func (s *RedisStore) Throttle(ctx context.Context, key string, limit int, period
 	// without relying on clock resolution.
 	member := strconv.FormatInt(nowMs, 10) + "-" + strconv.FormatUint(s.seq.Add(1), 10)
 
-	res, err := throttleScript.Run(ctx, s.client, []string{s.k(key)},
-		windowMs, limit, nowMs, member).Result()
-	if err != nil {
-		return Result{}, err
+	return scriptCall{
+		script: throttleScript,
+		keys:   []string{s.k(key)},
+		args:   []any{windowMs, limit, nowMs, member, cost},
+		parse: func(res any) (Result, error) {
+			vals, ok := res.([]any)
+			if !ok || len(vals) < 3 {
+				return Result{}, errMalformedScriptReply
+			}
+			count := toInt(vals[0])
+			limited := toInt(vals[1]) == 1
+			oldestMs := toInt64(vals[2])
+
+			// The window frees a slot once the oldest entry ages out.
+			elapsed := nowMs - oldestMs
+			reset := time.Duration(max(windowMs-elapsed, 0)) * time.Millisecond
+			result := Result{
+				Limit:     limit,
+				Limited:   limited,
+				Remaining: max(limit-count, 0),
+				Reset:     reset,
+			}
+			if limited {
+				result.Remaining = 0
+				result.RetryAfter = reset
+			}
+			return result, nil
+		},
 	}
+}
 
-	vals, ok := res.([]any)
-	if !ok || len(vals) < 3 {
-		return Result{}, errMalformedScriptReply
+func (s *RedisStore) fixedCall(key string, limit int, period time.Duration, cost int) scriptCall {
+	return scriptCall{
+		script: fixedWindowScript,
+		keys:   []string{s.k(key)},
+		args:   []any{period.Milliseconds(), limit, cost},
+		parse: func(res any) (Result, error) {
+			vals, ok := res.([]any)
+			if !ok || len(vals) < 3 {
+				return Result{}, errMalformedScriptReply
+			}
+			count := toInt(vals[0])
+			limited := toInt(vals[1]) == 1
+			reset := time.Duration(max(toInt64(vals[2]), 0)) * time.Millisecond
+
+			result := Result{
+				Limit:     limit,
+				Limited:   limited,
+				Remaining: max(limit-count, 0),
+				Reset:     reset,
+			}
+			if limited {
+				result.RetryAfter = reset
+			}
+			return result, nil
+		},
+	}
+}
+
+func (s *RedisStore) gcraCall(key string, q Quota) scriptCall {
+	interval := float64(q.Period) / float64(time.Millisecond) / float64(q.Limit)
+	return scriptCall{
+		script: gcraScript,
+		keys:   []string{s.k(key)},
+		args:   []any{strconv.FormatFloat(interval, 'g', -1, 64), q.burst(), s.now().UnixMilli(), q.cost()},
+		parse: func(res any) (Result, error) {
+			vals, ok := res.([]any)
+			if !ok || len(vals) < 4 {
+				return Result{}, errMalformedScriptReply
+			}
+			return Result{
+				Limited:    toInt(vals[0]) == 1,
+				Limit:      q.burst(),
+				Remaining:  toInt(vals[1]),
+				RetryAfter: time.Duration(toInt64(vals[2])) * time.Millisecond,
+				Reset:      time.Duration(toInt64(vals[3])) * time.Millisecond,
+			}, nil
+		},
+	}
+}
+
+func (s *RedisStore) leakyCall(key string, q Quota) scriptCall {
+	rate := float64(q.Limit) / float64(q.Period.Milliseconds())
+	return scriptCall{
+		script: leakyScript,
+		keys:   []string{s.k(key)},
+		args:   []any{strconv.FormatFloat(rate, 'g', -1, 64), q.burst(), s.now().UnixMilli(), q.cost()},
+		parse: func(res any) (Result, error) {
+			vals, ok := res.([]any)
+			if !ok || len(vals) < 2 {
+				return Result{}, errMalformedScriptReply
+			}
+			raw, _ := vals[1].(string)
+			level, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return Result{}, errMalformedScriptReply
+			}
+			return leakyResult(level, toInt(vals[0]) == 1, q), nil
+		},
+	}
+}
+
+// distinctCall runs script, distinctScript or peekDistinctScript, on key
+// with args.
+func (s *RedisStore) distinctCall(script *redis.Script, key string, q Quota, args []any) scriptCall {
+	return scriptCall{
+		script: script,
+		keys:   []string{s.k(key)},
+		args:   args,
+		parse: func(res any) (Result, error) {
+			vals, ok := res.([]any)
+			if !ok || len(vals) < 2 {
+				return Result{}, errMalformedScriptReply
+			}
+			return distinctResult(toInt(vals[0]), time.Duration(max(toInt64(vals[1]), 0))*time.Millisecond, q), nil
+		},
+	}
+}
+
+func (s *RedisStore) peekCall(key string, q Quota) (scriptCall, error) {
+	if err := checkRedisQuota(q); err != nil {
+		return scriptCall{}, err
+	}
+	switch q.Algorithm {
+	case SlidingWindow:
+		return s.peekSlidingCall(key, q.Limit, q.Period, q.cost()), nil
+	case FixedWindow:
+		return s.peekFixedCall(key, q.Limit, q.cost()), nil
+	case TokenBucket:
+		return s.peekGCRACall(key, q), nil
+	case LeakyBucket:
+		return s.peekLeakyCall(key, q), nil
+	case Distinct:
+		return s.distinctCall(peekDistinctScript, key, q, nil), nil
+	default:
+		return scriptCall{}, errUnknownAlgorithm
+	}
+}
+
+func (s *RedisStore) peekSlidingCall(key string, limit int, period time.Duration, cost int) scriptCall {
+	nowMs := s.now().UnixMilli()
+	windowMs := period.Milliseconds()
+	return scriptCall{
+		script: peekSlidingScript,
+		keys:   []string{s.k(key)},
+		args:   []any{windowMs, nowMs},
+		parse: func(res any) (Result, error) {
+			vals, ok := res.([]any)
+			if !ok || len(vals) < 2 {
+				return Result{}, errMalformedScriptReply
+			}
+			count := toInt(vals[0])
+			oldestMs := toInt64(vals[1])
+			reset := time.Duration(max(windowMs-(nowMs-oldestMs), 0)) * time.Millisecond
+			result := Result{
+				Limit:     limit,
+				Limited:   count+cost > limit,
+				Remaining: max(limit-count, 0),
+				Reset:     reset,
+			}
+			if result.Limited {
+				result.RetryAfter = reset
+			}
+			return result, nil
+		},
+	}
+}
+
+func (s *RedisStore) peekFixedCall(key string, limit, cost int) scriptCall {
+	return scriptCall{
+		script: peekFixedScript,
+		keys:   []string{s.k(key)},
+		parse: func(res any) (Result, error) {
+			vals, ok := res.([]any)
+			if !ok || len(vals) < 2 {
+				return Result{}, errMalformedScriptReply
+			}
+			count := toInt(vals[0])
+			reset := time.Duration(max(toInt64(vals[1]), 0)) * time.Millisecond
+			result := Result{
+				Limit:     limit,
+				Limited:   count+cost > limit,
+				Remaining: max(limit-count, 0),
+				Reset:     reset,
+			}
+			if result.Limited {
+				result.RetryAfter = reset
+			}
+			return result, nil
+		},
 	}
-	count := toInt(vals[0])
-	limited := toInt(vals[1]) == 1
-	oldestMs := toInt64(vals[2])
+}
 
-	result := Result{
-		Limit:     limit,
-		Limited:   limited,
-		Remaining: max(limit-count, 0),
+func (s *RedisStore) peekLeakyCall(key string, q Quota) scriptCall {
+	now := s.now()
+	return scriptCall{
+		script: peekLeakyScript,
+		keys:   []string{s.k(key)},
+		parse: func(res any) (Result, error) {
+			vals, ok := res.([]any)
+			if !ok || len(vals) < 2 {
+				return Result{}, errMalformedScriptReply
+			}
+			var level float64
+			if raw, ok := vals[0].(string); ok {
+				lastRaw, _ := vals[1].(string)
+				stored, err1 := strconv.ParseFloat(raw, 64)
+				lastMs, err2 := strconv.ParseInt(lastRaw, 10, 64)
+				if err1 != nil || err2 != nil {
+					return Result{}, errMalformedScriptReply
+				}
+				level = leakyLevel(stored, time.UnixMilli(lastMs), now, q)
+			}
+			return peekLeaky(level, q), nil
+		},
 	}
-	if limited {
-		result.Remaining = 0
-		// The window frees a slot once the oldest entry ages out.
-		elapsed := nowMs - oldestMs
-		retry := max(windowMs-elapsed, 0)
-		result.RetryAfter = time.Duration(retry) * time.Millisecond
+}
+
+func (s *RedisStore) peekGCRACall(key string, q Quota) scriptCall {
+	now := s.now()
+	return scriptCall{
+		script: peekGCRAScript,
+		keys:   []string{s.k(key)},
+		parse: func(res any) (Result, error) {
+			raw, ok := res.(string)
+			if !ok {
+				return Result{}, errMalformedScriptReply
+			}
+			tat := now
+			if raw != "" {
+				ms, err := strconv.ParseFloat(raw, 64)
+				if err != nil {
+					return Result{}, errMalformedScriptReply
+				}
+				tat = time.UnixMilli(0).Add(time.Duration(ms * float64(time.Millisecond)))
+			}
+			return peekGCRA(now, tat, q), nil
+		},
 	}
-	return result, nil
 }
 
 // Strike implements Store.
-func (s *RedisStore) Strike(ctx context.Context, key string, maxRetry int, findTime, banTime time.Duration) (bool, error) {
-	banned, err := strikeScript.Run(ctx, s.client,
-		[]string{s.k("ban:" + key), s.k("strike:" + key)},
-		maxRetry, findTime.Milliseconds(), banTime.Milliseconds()).Int()
+func (s *RedisStore) Strike(ctx context.Context, key string, p BanPolicy) (bool, int, error) {
+	res, err := strikeScript.Run(ctx, s.client,
+		[]string{s.k("ban:" + key), s.k("strike:" + key), s.k("level:" + key)},
+		p.MaxRetry, p.FindTime.Milliseconds(), p.BanTime.Milliseconds(),
+		strconv.FormatFloat(p.Backoff, 'f', -1, 64), p.MaxBanTime.Milliseconds()).Result()
 	if err != nil {
-		return false, err
+		return false, 0, err
+	}
+
+	vals, ok := res.([]any)
+	if !ok || len(vals) < 2 {
+		return false, 0, errMalformedScriptReply
 	}
-	return banned == 1, nil
+	return toInt(vals[0]) == 1, toInt(vals[1]), nil
 }
 
 // Banned implements Store.
@@ -153,3 +736,109 @@ func (s *RedisStore) Banned(ctx context.Context, key string) (bool, error) {
 	}
 	return n == 1, nil
 }
+
+// BanTTL implements BanTTLStore.
+func (s *RedisStore) BanTTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := s.client.PTTL(ctx, s.k("ban:"+key)).Result()
+	return max(ttl, 0), err
+}
+
+// Reset implements Store.
+func (s *RedisStore) Reset(ctx context.Context, key string) (bool, error) {
+	n, err := s.client.Del(ctx, s.k(key)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ResetAll implements ResetAllStore. It deletes the keys under the store's
+// prefix followed by prefix, with SCAN, across every master of a
+// *redis.ClusterClient and every shard of a *redis.Ring. It returns
+// ErrUnscopedReset when both prefixes are empty.
+func (s *RedisStore) ResetAll(ctx context.Context, prefix string) (int, error) {
+	if s.keyPrefix == "" && prefix == "" {
+		return 0, ErrUnscopedReset
+	}
+	// Strike and Ban namespace their keys after the store prefix.
+	matches := []string{escapeGlob(s.k(prefix)) + "*"}
+	if prefix != "" {
+		for _, ns := range []string{"ban:", "strike:", "level:"} {
+			matches = append(matches, escapeGlob(s.k(ns+prefix))+"*")
+		}
+	}
+	var mu sync.Mutex
+	var deleted int
+	for _, match := range matches {
+		err := s.forEachNode(ctx, func(ctx context.Context, c redis.Cmdable) error {
+			n, err := scanDelete(ctx, c, match)
+			mu.Lock()
+			deleted += n
+			mu.Unlock()
+			return err
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// forEachNode calls fn with each server that holds a share of the keys: the
+// masters of a *redis.ClusterClient, the shards of a *redis.Ring, or else the
+// client itself. Cluster and ring nodes are visited concurrently.
+func (s *RedisStore) forEachNode(ctx context.Context, fn func(context.Context, redis.Cmdable) error) error {
+	node := func(ctx context.Context, c *redis.Client) error { return fn(ctx, c) }
+	switch c := s.client.(type) {
+	case *redis.ClusterClient:
+		return c.ForEachMaster(ctx, node)
+	case *redis.Ring:
+		return c.ForEachShard(ctx, node)
+	}
+	return fn(ctx, s.client)
+}
+
+// scanDelete deletes the keys matching match on c, a batch per SCAN step.
+// Keys are deleted one at a time in a pipeline, since on a cluster node they
+// can span hash slots.
+func scanDelete(ctx context.Context, c redis.Cmdable, match string) (int, error) {
+	var deleted int
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(ctx, cursor, match, 500).Result()
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) > 0 {
+			pipe := c.Pipeline()
+			for _, key := range keys {
+				pipe.Del(ctx, key)
+			}
+			if _, err := pipe.Exec(ctx); err != nil {
+				return deleted, err
+			}
+			deleted += len(keys)
+		}
+		if next == 0 {
+			return deleted, nil
+		}
+		cursor = next
+	}
+}
+
+// escapeGlob escapes the SCAN MATCH metacharacters in s.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Ban implements Store.
+func (s *RedisStore) Ban(ctx context.Context, key string, banTime time.Duration) error {
+	return s.client.Set(ctx, s.k("ban:"+key), 1, banTime).Err()
+}
@@ -0,0 +1,170 @@
+package rackattack
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// refillTick is how often StartRefiller drains counters.
+const refillTick = 100 * time.Millisecond
+
+// StartRefiller drains the FixedWindow counters ra has counted in the
+// background, each at its quota's Limit per Period, until ctx is done or ra
+// is closed. A counter then empties steadily rather than all at once when its
+// window ends: a crude leaky bucket for a store that cannot run LeakyBucket,
+// such as RedisCounterStore on a managed Redis without scripting, whose rules
+// must all be FixedWindow. The store must implement DecayStore, and only one
+// refiller runs at a time; counters of other algorithms are left alone.
+//
+// The refiller drains only the keys this instance has counted, so run it on a
+// single instance: on several, each drains the shared counters again. Drain
+// failures are logged through WithLogger and retried on the next tick.
+func (ra *RedisRackAttack) StartRefiller(ctx context.Context) error {
+	r := ra.refill
+	if r == nil {
+		return errors.New("rackattack: store does not implement DecayStore")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running() {
+		return errors.New("rackattack: refiller already running")
+	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	r.keys = make(map[string]*refillKey)
+	go r.run(r.ctx)
+	return nil
+}
+
+// refiller is the state behind StartRefiller: the FixedWindow counters hit
+// since it started, and how to drain them.
+type refiller struct {
+	store  DecayStore
+	now    func() time.Time
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	ctx    context.Context // the current run's, nil before the first
+	cancel context.CancelFunc
+	keys   map[string]*refillKey
+}
+
+// running reports whether a run is under way. The caller must hold r.mu.
+func (r *refiller) running() bool {
+	return r.ctx != nil && r.ctx.Err() == nil
+}
+
+// refillKey is a tracked counter: its quota, the fraction of a hit drained
+// but not yet taken off, and when it was last drained and last hit.
+type refillKey struct {
+	limit   int
+	period  time.Duration
+	owed    float64
+	drained time.Time
+	hit     time.Time
+}
+
+// track records a hit on the FixedWindow counter key, if the refiller runs.
+func (r *refiller) track(key string, q Quota) {
+	if q.Algorithm != FixedWindow {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.running() {
+		return
+	}
+	now := r.now()
+	k := r.keys[key]
+	if k == nil {
+		k = &refillKey{drained: now}
+		r.keys[key] = k
+	}
+	k.limit, k.period, k.hit = q.Limit, q.Period, now
+}
+
+func (r *refiller) run(ctx context.Context) {
+	t := time.NewTicker(refillTick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.halt(ctx)
+			return
+		case <-t.C:
+			for key, n := range r.due() {
+				if err := r.store.Decay(ctx, key, n); err != nil && ctx.Err() == nil && r.logger != nil {
+					r.logger.WarnContext(ctx, "rackattack: store error", "key", key, "error", storeError("Decay", err))
+				}
+			}
+		}
+	}
+}
+
+// due returns how many whole hits each tracked counter has drained since the
+// last call, and forgets counters whose window has certainly ended.
+func (r *refiller) due() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	due := make(map[string]int)
+	for key, k := range r.keys {
+		k.owed += float64(now.Sub(k.drained)) * float64(k.limit) / float64(k.period)
+		k.drained = now
+		if n := int(k.owed); n > 0 {
+			due[key] = n
+			k.owed -= float64(n)
+		}
+		if now.Sub(k.hit) >= k.period {
+			delete(r.keys, key)
+		}
+	}
+	return due
+}
+
+// halt forgets the counters of the run ctx belongs to, unless a newer run
+// has replaced it.
+func (r *refiller) halt(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ctx == ctx {
+		r.keys = nil
+	}
+}
+
+// close stops the current run, if any.
+func (r *refiller) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// refillStore reports each FixedWindow hit to the refiller.
+type refillStore struct {
+	Store
+	refill *refiller
+}
+
+func (s *refillStore) Throttle(ctx context.Context, key string, q Quota) (Result, error) {
+	res, err := s.Store.Throttle(ctx, key, q)
+	if err == nil {
+		s.refill.track(key, q)
+	}
+	return res, err
+}
+
+func (s *refillStore) Batch(ctx context.Context, ops []BatchOp) ([]Result, error) {
+	results, err := runBatch(ctx, s.Store, ops)
+	if err == nil {
+		for _, op := range ops {
+			if !op.Peek {
+				s.refill.track(op.Key, op.Quota)
+			}
+		}
+	}
+	return results, err
+}
@@ -2,9 +2,164 @@ package rackattack
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
 	"time"
 )
 
+// Algorithm selects how a throttle rule counts hits.
+type Algorithm int
+
+const (
+	// SlidingWindow keeps a log of hit timestamps and counts those within the
+	// trailing Period, so there are no boundary bursts. This is the default.
+	SlidingWindow Algorithm = iota
+	// FixedWindow counts hits in consecutive windows of Period, each starting
+	// at the first hit after the previous window expired. It stores a single
+	// counter per key but admits up to 2x Limit across a window boundary.
+	FixedWindow
+	// TokenBucket refills at a steady Limit per Period up to a capacity of
+	// Burst, admitting short bursts while enforcing the sustained rate. It is
+	// implemented as GCRA, so it needs only one timestamp per key.
+	TokenBucket
+	// LeakyBucket adds each hit to a bucket that drains at a steady Limit per
+	// Period and rejects the hits that would overflow its capacity of Burst.
+	// It admits the same traffic as TokenBucket, but stores the bucket level
+	// and last drain time, for those who think in terms of drain rates.
+	LeakyBucket
+	// Distinct counts the distinct Quota.Member values seen for a key in
+	// windows of Period, each starting at the first value, and throttles once
+	// there are more than Limit, as for an API token used from too many IPs.
+	// RedisStore keeps a HyperLogLog per key (PFADD and PFCOUNT), so the
+	// count is approximate, within about 1%, and takes 12KB however many
+	// values there are. A value is counted even when it is throttled, so
+	// once a key crosses Limit every request for it is throttled until the
+	// window ends. Peek, which cannot tell whether a value is new, reports
+	// Limited only once a key is past Limit.
+	Distinct
+)
+
+// Quota is the limit a Store enforces for a single throttle key.
+type Quota struct {
+	// Algorithm selects the counting strategy.
+	Algorithm Algorithm
+	// Limit is the maximum number of hits allowed within Period. It must be
+	// positive.
+	Limit int
+	// Period is the window length. It must be positive, and RedisStore, which
+	// keeps time in milliseconds, needs at least a millisecond.
+	Period time.Duration
+	// Burst is the TokenBucket and LeakyBucket capacity. Zero means Limit.
+	// Other algorithms ignore it.
+	Burst int
+	// Cost is how many hits a single Throttle call records. A hit that would
+	// take the key past Limit is throttled whole, never partly counted. Values
+	// below 1 mean 1.
+	Cost int
+	// Member is the value Distinct counts for this hit, such as the client
+	// IP. Other algorithms ignore it.
+	Member string
+	// Jitter randomizes each FixedWindow window length by up to ±Jitter, so
+	// windows started together do not all reset at the same instant. Other
+	// algorithms ignore it.
+	Jitter time.Duration
+}
+
+// burst returns the effective TokenBucket or LeakyBucket capacity.
+func (q Quota) burst() int {
+	if q.Burst > 0 {
+		return q.Burst
+	}
+	return q.Limit
+}
+
+// BanPolicy bans a key after MaxRetry offenses within FindTime. On a
+// ThrottleRule, each throttled request is an offense, and while banned,
+// requests matching the rule are denied with ReasonBanned without consuming
+// the throttle budget.
+type BanPolicy struct {
+	MaxRetry int
+	FindTime time.Duration
+	BanTime  time.Duration
+	// Backoff, when greater than 1, lengthens each consecutive ban of the same
+	// key: ban n lasts BanTime * Backoff^(n-1). A key's level is forgotten
+	// once it stays unbanned for as long as its last ban lasted.
+	Backoff float64
+	// MaxBanTime caps the ban length under Backoff. Zero means no cap.
+	MaxBanTime time.Duration
+}
+
+// enabled reports whether the policy is configured.
+func (p BanPolicy) enabled() bool {
+	return p.MaxRetry > 0
+}
+
+// banTime returns the length of ban number level under the policy. Levels
+// below 1 get the base BanTime.
+func (p BanPolicy) banTime(level int) time.Duration {
+	if p.Backoff <= 1 || level <= 1 {
+		return p.BanTime
+	}
+	d := float64(p.BanTime) * math.Pow(p.Backoff, float64(level-1))
+	if math.IsNaN(d) {
+		// A zero BanTime times an overflowed power.
+		return p.BanTime
+	}
+	if p.MaxBanTime > 0 && d > float64(p.MaxBanTime) {
+		return p.MaxBanTime
+	}
+	if d > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// check returns an error unless q has a positive Limit and Period.
+func (q Quota) check() error {
+	switch {
+	case q.Limit <= 0:
+		return fmt.Errorf("%w: limit %d is not positive", errInvalidQuota, q.Limit)
+	case q.Period <= 0:
+		return fmt.Errorf("%w: period %v is not positive", errInvalidQuota, q.Period)
+	}
+	return nil
+}
+
+// window returns the length of a new FixedWindow window: Period randomized
+// by ±Jitter, and never less than a millisecond.
+func (q Quota) window() time.Duration {
+	if q.Jitter <= 0 {
+		return q.Period
+	}
+	d := q.Period - q.Jitter + time.Duration(rand.Int64N(int64(2*q.Jitter)+1))
+	return max(d, time.Millisecond)
+}
+
+// cost returns the effective hit weight. A hit heavier than the quota's
+// capacity is throttled however heavy it is, so the weight is capped at one
+// more than the capacity: a client-supplied cost, such as a Content-Length,
+// then cannot overflow the stores' arithmetic.
+func (q Quota) cost() int {
+	capacity := q.Limit
+	if q.Algorithm == TokenBucket || q.Algorithm == LeakyBucket {
+		capacity = q.burst()
+	}
+	if capacity < math.MaxInt {
+		capacity++
+	}
+	return min(max(q.Cost, 1), capacity)
+}
+
+// mulDuration returns d*n, saturating at the longest Duration rather than
+// overflowing.
+func mulDuration(d time.Duration, n int) time.Duration {
+	if n > 0 && d > math.MaxInt64/time.Duration(n) {
+		return math.MaxInt64
+	}
+	return d * time.Duration(n)
+}
+
 // Result describes the outcome of a throttle check against the store.
 type Result struct {
 	// Limited reports whether this request exceeded the configured limit.
@@ -17,23 +172,208 @@ type Result struct {
 	// RetryAfter is how long the caller should wait before the window has
 	// room again. Only meaningful when Limited is true.
 	RetryAfter time.Duration
+	// Reset is how long until the oldest hit in the current window ages out
+	// and returns a slot to the budget. It equals RetryAfter when Limited.
+	Reset time.Duration
 }
 
 // Store is the persistence backend for throttling and ban tracking. A Store
 // must be safe for concurrent use; all methods are called on the request hot
 // path from multiple goroutines.
 type Store interface {
-	// Throttle records a hit against key within a sliding window of period and
-	// reports whether the caller is now over limit.
-	Throttle(ctx context.Context, key string, limit int, period time.Duration) (Result, error)
+	// Throttle records a hit against key under quota and reports whether the
+	// caller is now over limit. A Store that does not support q.Algorithm must
+	// return an error rather than silently falling back.
+	Throttle(ctx context.Context, key string, q Quota) (Result, error)
 
-	// Strike records an offense against key. Once maxRetry offenses accumulate
-	// within findTime, key is banned for banTime. It returns true when key is
-	// currently banned (either because this call triggered the ban or because a
-	// ban was already in effect).
-	Strike(ctx context.Context, key string, maxRetry int, findTime, banTime time.Duration) (bool, error)
+	// Peek reports the throttle state of key under quota without recording a
+	// hit. Limited means the next hit would be throttled, and Remaining counts
+	// the hits still admitted.
+	Peek(ctx context.Context, key string, q Quota) (Result, error)
+
+	// Strike records an offense against key. Once p.MaxRetry offenses
+	// accumulate within p.FindTime, key is banned for p.BanTime, lengthened by
+	// p.Backoff for repeat offenders. It returns true when key is currently
+	// banned (either because this call triggered the ban or because a ban was
+	// already in effect), along with the key's backoff level, which is zero
+	// unless p.Backoff is set.
+	Strike(ctx context.Context, key string, p BanPolicy) (banned bool, level int, err error)
 
 	// Banned reports whether key is currently banned, without recording an
 	// offense.
 	Banned(ctx context.Context, key string) (bool, error)
+
+	// Reset clears the throttle state of key under every algorithm, and
+	// reports whether there was any. Ban and strike state is not affected.
+	Reset(ctx context.Context, key string) (bool, error)
+
+	// Ban bans key outright for banTime, as if Strike had tripped. Banning an
+	// already-banned key replaces its expiry.
+	Ban(ctx context.Context, key string, banTime time.Duration) error
+}
+
+// peekGCRA reports a token bucket's state at now from its theoretical arrival
+// time, without admitting a hit. Both stores share it so their Peek results
+// agree.
+func peekGCRA(now, tat time.Time, q Quota) Result {
+	interval := q.Period / time.Duration(q.Limit)
+	burst := q.burst()
+	if tat.Before(now) {
+		tat = now
+	}
+	// The next hit is admitted once now reaches allowAt.
+	allowAt := tat.Add(mulDuration(interval, q.cost())).Add(-mulDuration(interval, burst))
+	if now.Before(allowAt) {
+		return Result{
+			Limited:    true,
+			Limit:      burst,
+			RetryAfter: allowAt.Sub(now),
+			Reset:      tat.Sub(now),
+		}
+	}
+	return Result{
+		Limit:     burst,
+		Remaining: int(now.Sub(allowAt)/interval) + q.cost(),
+		Reset:     tat.Sub(now),
+	}
+}
+
+// leakyLevel returns the level of a leaky bucket that held level when last
+// drained at last, drained up to now.
+func leakyLevel(level float64, last, now time.Time, q Quota) float64 {
+	if now.After(last) {
+		level -= float64(now.Sub(last)) * float64(q.Limit) / float64(q.Period)
+	}
+	return max(level, 0)
+}
+
+// leakyResult reports a leaky bucket's state at the given level, drained up
+// to now: after admitting a hit, or with limited set, when the next one does
+// not fit. Both stores share it so their results agree.
+func leakyResult(level float64, limited bool, q Quota) Result {
+	drain := func(amount float64) time.Duration {
+		return time.Duration(math.Ceil(amount * float64(q.Period) / float64(q.Limit)))
+	}
+	capacity := q.burst()
+	if limited {
+		return Result{
+			Limited:    true,
+			Limit:      capacity,
+			RetryAfter: drain(level + float64(q.cost()) - float64(capacity)),
+			Reset:      drain(level),
+		}
+	}
+	return Result{
+		Limit:     capacity,
+		Remaining: max(int(math.Floor(float64(capacity)-level)), 0),
+		Reset:     drain(level),
+	}
+}
+
+// peekLeaky reports a leaky bucket's state without admitting a hit.
+func peekLeaky(level float64, q Quota) Result {
+	return leakyResult(level, level+float64(q.cost()) > float64(q.burst()), q)
+}
+
+// distinctResult reports the state of a Distinct key that has seen count
+// distinct values, with reset left in its window. Both stores share it so
+// their results agree.
+func distinctResult(count int, reset time.Duration, q Quota) Result {
+	result := Result{
+		Limit:     q.Limit,
+		Limited:   count > q.Limit,
+		Remaining: max(q.Limit-count, 0),
+		Reset:     reset,
+	}
+	if result.Limited {
+		result.RetryAfter = reset
+	}
+	return result
+}
+
+// Clock is a time source. See WithClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// clockSetter is implemented by the bundled stores, so WithClock can replace
+// their time source.
+type clockSetter interface {
+	setClock(Clock)
+}
+
+// BatchOp is one operation in a batch: a Throttle hit on Key under Quota, or
+// a Peek when Peek is set.
+type BatchOp struct {
+	Key   string
+	Quota Quota
+	Peek  bool
+}
+
+// BatchStore is an optional Store extension that runs several throttle
+// operations in a single round trip. RedisStore implements it with a
+// pipeline; for other stores, operations are run one at a time.
+type BatchStore interface {
+	Store
+
+	// Batch runs ops in order, as if by calling Throttle and Peek one after
+	// another, and returns their results in the same order. It is not
+	// atomic: on error, some operations may already have been applied.
+	Batch(ctx context.Context, ops []BatchOp) ([]Result, error)
+}
+
+// ResetAllStore is an optional Store extension that deletes state in bulk,
+// for ResetAll. The bundled stores implement it.
+type ResetAllStore interface {
+	Store
+
+	// ResetAll deletes the throttle, strike, and ban state of every key that
+	// begins with prefix, and reports how many store entries it deleted.
+	ResetAll(ctx context.Context, prefix string) (int, error)
+}
+
+// BanTTLStore is an optional Store extension that reports how long a ban has
+// left, so a response denied by a ThrottleRule's Ban can carry Retry-After
+// and RateLimit-* headers. The bundled stores implement it.
+type BanTTLStore interface {
+	Store
+
+	// BanTTL returns how long key stays banned, or zero if it is not.
+	BanTTL(ctx context.Context, key string) (time.Duration, error)
+}
+
+// DecayStore is an optional Store extension that drains FixedWindow counters,
+// for StartRefiller. RedisCounterStore implements it.
+type DecayStore interface {
+	Store
+
+	// Decay lowers key's FixedWindow counter by n hits, deleting it once it
+	// reaches zero.
+	Decay(ctx context.Context, key string, n int) error
+}
+
+// runBatch runs ops on store in one round trip if it is a BatchStore, and
+// one at a time otherwise.
+func runBatch(ctx context.Context, store Store, ops []BatchOp) ([]Result, error) {
+	if bs, ok := store.(BatchStore); ok && len(ops) > 1 {
+		return bs.Batch(ctx, ops)
+	}
+	return runEach(ctx, store, ops)
+}
+
+// runEach runs ops on store one at a time, stopping at the first error.
+func runEach(ctx context.Context, store Store, ops []BatchOp) ([]Result, error) {
+	results := make([]Result, len(ops))
+	for i, op := range ops {
+		var err error
+		if op.Peek {
+			results[i], err = store.Peek(ctx, op.Key, op.Quota)
+		} else {
+			results[i], err = store.Throttle(ctx, op.Key, op.Quota)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
 }
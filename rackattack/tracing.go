@@ -0,0 +1,113 @@
+package rackattack
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer starts a span around every request Check evaluates. Like Metrics, it
+// keeps the core free of any particular tracing library; adapting an
+// OpenTelemetry trace.Tracer takes a few lines (see the README).
+// Implementations must be safe for concurrent use.
+//
+// Each span is named "rackattack.check" and carries the attributes
+// rackattack.decision (d.Reason.String()), rackattack.allowed,
+// rackattack.rule (when a rule decided), rackattack.group (when that rule is
+// in a group), and rackattack.store.duration_ms, the time spent in the store.
+// A store error is recorded on the span.
+type Tracer interface {
+	// Start starts a span named name as a child of any span in ctx, and
+	// returns a context carrying it. Store calls for the request use that
+	// context, so a traced store client nests its spans under it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute records an attribute. value is a string, bool, int, or
+	// float64.
+	SetAttribute(key string, value any)
+	// RecordError records err and marks the span as failed.
+	RecordError(err error)
+	// End completes the span.
+	End()
+}
+
+// traceDecision records the outcome of Check on span.
+func traceDecision(span Span, d Decision, err error, storeTime time.Duration) {
+	span.SetAttribute("rackattack.store.duration_ms", float64(storeTime)/float64(time.Millisecond))
+	if err != nil {
+		span.RecordError(err)
+		return
+	}
+	span.SetAttribute("rackattack.decision", d.Reason.String())
+	span.SetAttribute("rackattack.allowed", d.Allowed)
+	if d.RuleName != "" {
+		span.SetAttribute("rackattack.rule", d.RuleName)
+	}
+	if d.Rule != nil && d.Rule.Group != "" {
+		span.SetAttribute("rackattack.group", d.Rule.Group)
+	}
+}
+
+// storeTimerKey is the context key for the *time.Duration that timedStore
+// adds store call time to.
+type storeTimerKey struct{}
+
+// withStoreTimer returns a context under which timedStore adds the time spent
+// in store calls to t.
+func withStoreTimer(ctx context.Context, t *time.Duration) context.Context {
+	return context.WithValue(ctx, storeTimerKey{}, t)
+}
+
+// timedStore measures calls to the wrapped Store made under withStoreTimer,
+// for the store latency on WithTracer's spans. A request's store calls run one
+// after another, so the timer needs no locking.
+type timedStore struct {
+	Store
+}
+
+// time starts timing a call under ctx and returns the func that stops it.
+func (s *timedStore) time(ctx context.Context) func() {
+	t, _ := ctx.Value(storeTimerKey{}).(*time.Duration)
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() { *t += time.Since(start) }
+}
+
+func (s *timedStore) Throttle(ctx context.Context, key string, q Quota) (Result, error) {
+	defer s.time(ctx)()
+	return s.Store.Throttle(ctx, key, q)
+}
+
+func (s *timedStore) Peek(ctx context.Context, key string, q Quota) (Result, error) {
+	defer s.time(ctx)()
+	return s.Store.Peek(ctx, key, q)
+}
+
+func (s *timedStore) Strike(ctx context.Context, key string, p BanPolicy) (bool, int, error) {
+	defer s.time(ctx)()
+	return s.Store.Strike(ctx, key, p)
+}
+
+func (s *timedStore) Banned(ctx context.Context, key string) (bool, error) {
+	defer s.time(ctx)()
+	return s.Store.Banned(ctx, key)
+}
+
+func (s *timedStore) Reset(ctx context.Context, key string) (bool, error) {
+	defer s.time(ctx)()
+	return s.Store.Reset(ctx, key)
+}
+
+func (s *timedStore) Ban(ctx context.Context, key string, banTime time.Duration) error {
+	defer s.time(ctx)()
+	return s.Store.Ban(ctx, key, banTime)
+}
+
+func (s *timedStore) Batch(ctx context.Context, ops []BatchOp) ([]Result, error) {
+	defer s.time(ctx)()
+	return runBatch(ctx, s.Store, ops)
+}